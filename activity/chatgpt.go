@@ -0,0 +1,17 @@
+package activity
+
+import (
+	"context"
+
+	integration "github.com/jyouturer/gmail-ai/integration"
+)
+
+// ChatGPTChecker tells the rejections by asking ChatGPT, it is a RejectionChecking
+type ChatGPTChecker struct {
+	Client *integration.ChatGPTClient
+}
+
+// IsRejection check whether the given text is rejection or not
+func (c *ChatGPTChecker) IsRejection(ctx context.Context, text string) (bool, error) {
+	return c.Client.IsRejectionEmail(text)
+}
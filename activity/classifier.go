@@ -0,0 +1,205 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/integration/classifierv2"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UncertainLabel is the label of the texts no label is probable enough for
+const UncertainLabel = "Uncertain"
+
+// DefaultRejectionLabelV2 is the label of the rejections in the v2 classifier
+const DefaultRejectionLabelV2 = "reject"
+
+// DefaultThreshold is the probability a label needs when no threshold is set for it
+const DefaultThreshold = 0.5
+
+// ErrV2Unimplemented is returned when the classifier service does not serve the v2 protocol, like the Python
+// server of the classifier directory, which only serves v1
+var ErrV2Unimplemented = errors.New(`the classifier service does not implement the v2 protocol, run a v2 classifier server or set "version" to "v1"`)
+
+// callError returns the error of the gRPC call, ErrV2Unimplemented when the service does not implement the call
+func callError(call string, err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("%w: %s: %v", ErrV2Unimplemented, call, err)
+	}
+	return fmt.Errorf("error calling %s gRPC: %w", call, err)
+}
+
+// LabelScore is the probability of a label
+type LabelScore struct {
+	Label       string
+	Probability float64
+}
+
+// Prediction is what the classifier tells about a text
+type Prediction struct {
+	// Label is the most probable label reaching its threshold, UncertainLabel if none does
+	Label string
+	// Probability is the probability of the label, or of the most probable label when uncertain
+	Probability float64
+	// Scores are all the labels scored, highest probability first
+	Scores []LabelScore
+	// Model is the name and version of the model
+	Model string
+}
+
+// Thresholds are the probabilities the labels need to be chosen
+type Thresholds struct {
+	// Default is the threshold of the labels without one, DefaultThreshold if 0
+	Default float64
+	// Labels are the thresholds by label, they override the thresholds advised by the model
+	Labels map[string]float64
+}
+
+// of returns the threshold of the label: the one set for it, else the one advised by the model, else the default
+func (t Thresholds) of(label string, advised float64) float64 {
+	if threshold, ok := t.Labels[label]; ok {
+		return threshold
+	}
+	if advised > 0 {
+		return advised
+	}
+	if t.Default > 0 {
+		return t.Default
+	}
+	return DefaultThreshold
+}
+
+// Classifier classifies texts with the v2 classifier gRPC service, applying the thresholds to the probabilities
+// of the labels. It is also a RejectionChecking, telling the rejections by their label.
+type Classifier struct {
+	GRPCClientPool *integration.ConnectionPool
+	Thresholds     Thresholds
+	// RejectionLabel is the label of the rejections, DefaultRejectionLabelV2 if empty
+	RejectionLabel string
+	// Batching groups the texts classified concurrently into batches when set, instead of one call per text
+	Batching *Batching
+
+	batcherOnce sync.Once
+	batcher     *classifyBatcher
+}
+
+// NewClassifier creates a new Classifier, it will initiate the gRPC connection pool, and return a function to close the connection pool
+func NewClassifier(grpcUrl string, grpcConnectionNumber int, grpcTimeoutSeconds int, thresholds Thresholds) (*Classifier, func() error, error) {
+	cp, err := integration.NewConnectionPool(grpcUrl, grpcConnectionNumber, time.Duration(grpcTimeoutSeconds)*time.Second)
+	if err != nil {
+		logging.Logger.Error("Error creating connection pool", zap.Error(err))
+		return nil, nil, err
+	}
+	c := &Classifier{GRPCClientPool: cp, Thresholds: thresholds}
+	return c, func() error {
+		// the batches still pending are sent before the pool is closed
+		c.stopBatching()
+		cp.Close()
+		return nil
+	}, nil
+}
+
+// Classify classifies the text, scoring only the given labels if any
+func (c *Classifier) Classify(ctx context.Context, text string, labels ...string) (Prediction, error) {
+	req := &classifierv2.ClassifyRequest{Text: text, Labels: labels}
+	var res *classifierv2.ClassifyResponse
+	var err error
+	if c.Batching != nil {
+		c.batcherOnce.Do(func() { c.batcher = newClassifyBatcher(c.GRPCClientPool, *c.Batching) })
+		if c.batcher == nil {
+			return Prediction{}, errBatcherClosed
+		}
+		res, err = c.batcher.classify(ctx, req)
+	} else {
+		res, err = c.classify(ctx, req)
+	}
+	if err != nil {
+		return Prediction{}, err
+	}
+	return c.predict(res), nil
+}
+
+// stopBatching closes the batcher, so no batch is sent after it returns
+func (c *Classifier) stopBatching() {
+	// no batcher is created afterwards
+	c.batcherOnce.Do(func() {})
+	if c.batcher != nil {
+		c.batcher.close()
+	}
+}
+
+// classify classifies the text alone, with a connection of the pool
+func (c *Classifier) classify(ctx context.Context, req *classifierv2.ClassifyRequest) (*classifierv2.ClassifyResponse, error) {
+	rc, err := c.GRPCClientPool.GetGRPCClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get classifier from pool %w", err)
+	}
+	defer c.GRPCClientPool.ReturnGRPCClient(rc)
+
+	res, err := rc.V2.Classify(ctx, req)
+	if err != nil {
+		return nil, callError("Classify", err)
+	}
+	return res, nil
+}
+
+// predict applies the thresholds to the response of the classifier
+func (c *Classifier) predict(res *classifierv2.ClassifyResponse) Prediction {
+	p := Prediction{Label: UncertainLabel, Model: res.ModelName}
+	if res.ModelVersion != "" {
+		p.Model += "@" + res.ModelVersion
+	}
+	scores := append([]*classifierv2.LabelScore(nil), res.Labels...)
+	// the service ranks the labels, but the choice should not depend on it
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Probability > scores[j].Probability })
+	chosen := false
+	for _, s := range scores {
+		p.Scores = append(p.Scores, LabelScore{Label: s.Label, Probability: s.Probability})
+		if !chosen && s.Probability >= c.Thresholds.of(s.Label, s.Threshold) {
+			p.Label, p.Probability, chosen = s.Label, s.Probability, true
+		}
+	}
+	if !chosen && len(scores) > 0 {
+		p.Probability = scores[0].Probability
+	}
+	return p
+}
+
+// rejectionLabel returns the label of the rejections
+func (c *Classifier) rejectionLabel() string {
+	if c.RejectionLabel == "" {
+		return DefaultRejectionLabelV2
+	}
+	return c.RejectionLabel
+}
+
+// IsRejection check whether the given text is rejection or not, uncertain texts are not
+func (c *Classifier) IsRejection(ctx context.Context, text string) (bool, error) {
+	classification, err := c.ClassifyRejection(ctx, text)
+	return classification.Positive, err
+}
+
+// ClassifyRejection classifies the text as a rejection or not, with the label and probability the classifier chose
+func (c *Classifier) ClassifyRejection(ctx context.Context, text string) (datamodel.Classification, error) {
+	p, err := c.Classify(ctx, text)
+	if err != nil {
+		return datamodel.Classification{}, err
+	}
+	return datamodel.Classification{
+		Classifier: "rejection",
+		Positive:   p.Label == c.rejectionLabel(),
+		Label:      p.Label,
+		Confidence: p.Probability,
+		Model:      p.Model,
+		Text:       text,
+	}, nil
+}
@@ -0,0 +1,218 @@
+package activity
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/integration/classifierv2"
+)
+
+// mockClassifierV2Server scores "reject" by the words of the text, and advises a threshold for it. It records the
+// size of the batches and streams it is sent.
+type mockClassifierV2Server struct {
+	classifierv2.UnimplementedClassifierServer
+
+	mu      sync.Mutex
+	batches []int
+	streams []int
+}
+
+func (m *mockClassifierV2Server) Classify(ctx context.Context, req *classifierv2.ClassifyRequest) (*classifierv2.ClassifyResponse, error) {
+	return score(req)
+}
+
+func (m *mockClassifierV2Server) ClassifyBatch(ctx context.Context, req *classifierv2.ClassifyBatchRequest) (*classifierv2.ClassifyBatchResponse, error) {
+	m.mu.Lock()
+	m.batches = append(m.batches, len(req.Requests))
+	m.mu.Unlock()
+	res := &classifierv2.ClassifyBatchResponse{}
+	for _, r := range req.Requests {
+		score, err := score(r)
+		if err != nil {
+			return nil, err
+		}
+		res.Responses = append(res.Responses, score)
+	}
+	return res, nil
+}
+
+func (m *mockClassifierV2Server) ClassifyStream(stream classifierv2.Classifier_ClassifyStreamServer) error {
+	n := 0
+	defer func() {
+		m.mu.Lock()
+		m.streams = append(m.streams, n)
+		m.mu.Unlock()
+	}()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		res, err := score(req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// calls returns the sizes of the batches and streams the server was sent
+func (m *mockClassifierV2Server) calls() (batches, streams []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int(nil), m.batches...), append([]int(nil), m.streams...)
+}
+
+// score scores the request, echoing its id
+func score(req *classifierv2.ClassifyRequest) (*classifierv2.ClassifyResponse, error) {
+	if req.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty text")
+	}
+	reject := 0.1
+	switch {
+	case strings.Contains(req.Text, "unfortunately"):
+		reject = 0.95
+	case strings.Contains(req.Text, "maybe"):
+		reject = 0.55
+	}
+	// the labels are not ranked, the client ranks them
+	return &classifierv2.ClassifyResponse{
+		Labels: []*classifierv2.LabelScore{
+			{Label: "not_reject", Probability: 1 - reject},
+			{Label: "reject", Probability: reject, Threshold: 0.7},
+		},
+		ModelName:    "tfidf-lr",
+		ModelVersion: "3",
+		Id:           req.Id,
+	}, nil
+}
+
+// newMockClassifierV2Pool serves the v2 classifier over an in-memory connection
+func newMockClassifierV2Pool(t *testing.T) *integration.ConnectionPool {
+	pool, _ := newMockClassifierV2Server(t)
+	return pool
+}
+
+// newMockClassifierV2Server serves the mock over an in-memory connection, it returns the pool and the mock
+func newMockClassifierV2Server(t *testing.T) (*integration.ConnectionPool, *mockClassifierV2Server) {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	mock := &mockClassifierV2Server{}
+	classifierv2.RegisterClassifierServer(s, mock)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return lis.Dial()
+	}), grpc.WithInsecure())
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	pool := make(chan *integration.GRPCClient, 1)
+	pool <- &integration.GRPCClient{Client: integration.NewClassifierClient(conn), V2: classifierv2.NewClassifierClient(conn)}
+	return &integration.ConnectionPool{Pool: pool, Timeout: time.Second}, mock
+}
+
+func TestClassifierThresholds(t *testing.T) {
+	pool := newMockClassifierV2Pool(t)
+	for _, tc := range []struct {
+		name        string
+		thresholds  Thresholds
+		text        string
+		label       string
+		probability float64
+	}{
+		{"confident rejection", Thresholds{}, "unfortunately no", "reject", 0.95},
+		{"threshold of the model", Thresholds{}, "maybe no", UncertainLabel, 0.55},
+		{"threshold of the config", Thresholds{Labels: map[string]float64{"reject": 0.5}}, "maybe no", "reject", 0.55},
+		{"uncertain", Thresholds{Default: 0.6}, "maybe no", UncertainLabel, 0.55},
+		{"label over its threshold", Thresholds{Labels: map[string]float64{"reject": 0.99}}, "unfortunately no", UncertainLabel, 0.95},
+		{"other label", Thresholds{}, "yes", "not_reject", 0.9},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Classifier{GRPCClientPool: pool, Thresholds: tc.thresholds}
+			p, err := c.Classify(context.Background(), tc.text)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.label, p.Label)
+			assert.InDelta(t, tc.probability, p.Probability, 1e-9)
+			assert.Equal(t, "tfidf-lr@3", p.Model)
+			// the scores are ranked
+			assert.Len(t, p.Scores, 2)
+			assert.GreaterOrEqual(t, p.Scores[0].Probability, p.Scores[1].Probability)
+		})
+	}
+
+	_, err := (&Classifier{GRPCClientPool: pool}).Classify(context.Background(), "")
+	assert.ErrorContains(t, err, "empty text")
+}
+
+func TestClassifierV2Unimplemented(t *testing.T) {
+	// a service serving only v1, like the Python server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	classifierv2.RegisterClassifierServer(s, classifierv2.UnimplementedClassifierServer{})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return lis.Dial()
+	}), grpc.WithInsecure())
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	pool := make(chan *integration.GRPCClient, 1)
+	pool <- &integration.GRPCClient{V2: classifierv2.NewClassifierClient(conn)}
+
+	for _, batching := range []*Batching{nil, {}, {Stream: true}} {
+		c := &Classifier{GRPCClientPool: &integration.ConnectionPool{Pool: pool, Timeout: time.Second}, Batching: batching}
+		_, err := c.Classify(context.Background(), "unfortunately no")
+		assert.ErrorIs(t, err, ErrV2Unimplemented)
+	}
+}
+
+func TestClassifierRejection(t *testing.T) {
+	c := &Classifier{GRPCClientPool: newMockClassifierV2Pool(t)}
+
+	isRejection, err := c.IsRejection(context.Background(), "unfortunately no")
+	assert.NoError(t, err)
+	assert.True(t, isRejection)
+	// uncertain texts are not rejections
+	isRejection, err = c.IsRejection(context.Background(), "maybe no")
+	assert.NoError(t, err)
+	assert.False(t, isRejection)
+
+	// the rejection handler keeps the output of the classifier on its actions
+	h := NewRejectionEmail(c)
+	actions, err := h.Process(context.Background(), datamodel.Message{ID: "1", Body: "unfortunately no"})
+	assert.NoError(t, err)
+	if assert.Len(t, actions, 2) {
+		assert.Equal(t, &datamodel.Classification{
+			Classifier: "rejection",
+			Positive:   true,
+			Label:      "reject",
+			Confidence: 0.95,
+			Model:      "tfidf-lr@3",
+			Text:       "unfortunately no",
+		}, actions[0].Classification)
+	}
+	actions, err = h.Process(context.Background(), datamodel.Message{ID: "2", Body: "maybe no"})
+	assert.NoError(t, err)
+	assert.Empty(t, actions)
+}
@@ -0,0 +1,261 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/integration/classifierv2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errBatcherClosed is returned to the texts classified once the classifier is closed
+var errBatcherClosed = errors.New("the classifier is closed")
+
+// DefaultBatchSize is the most texts sent in one batch when no size is set
+const DefaultBatchSize = 32
+
+// DefaultBatchWindow is how long the first text of a batch waits for others when no window is set
+const DefaultBatchWindow = 20 * time.Millisecond
+
+// DefaultBatchTimeout bounds the call classifying a batch when no timeout is set
+const DefaultBatchTimeout = 30 * time.Second
+
+// Batching groups the texts classified concurrently, a batch is sent when it is full or when its window is over.
+// A batch takes a single connection of the pool.
+type Batching struct {
+	// MaxSize is the most texts of a batch, DefaultBatchSize if 0
+	MaxSize int
+	// Window is how long the first text of a batch waits for others, DefaultBatchWindow if 0
+	Window time.Duration
+	// Stream sends the batches on the ClassifyStream bidirectional stream instead of calling ClassifyBatch
+	Stream bool
+	// Timeout bounds the call classifying a batch, DefaultBatchTimeout if 0. The callers stop waiting when their
+	// own context is done.
+	Timeout time.Duration
+}
+
+func (b Batching) maxSize() int {
+	if b.MaxSize > 0 {
+		return b.MaxSize
+	}
+	return DefaultBatchSize
+}
+
+func (b Batching) window() time.Duration {
+	if b.Window > 0 {
+		return b.Window
+	}
+	return DefaultBatchWindow
+}
+
+func (b Batching) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return DefaultBatchTimeout
+}
+
+// classifyBatcher queues the requests of the callers and sends them in batches, then gives each caller its response
+type classifyBatcher struct {
+	pool   *integration.ConnectionPool
+	config Batching
+
+	mu      sync.Mutex
+	pending []*pendingClassification
+	timer   *time.Timer
+	closed  bool
+	// sending counts the batches being sent, which close waits for
+	sending sync.WaitGroup
+}
+
+// pendingClassification is a request waiting for its batch, done is closed once res or err is set
+type pendingClassification struct {
+	req  *classifierv2.ClassifyRequest
+	done chan struct{}
+	res  *classifierv2.ClassifyResponse
+	err  error
+}
+
+func newClassifyBatcher(pool *integration.ConnectionPool, config Batching) *classifyBatcher {
+	return &classifyBatcher{pool: pool, config: config}
+}
+
+// classify queues the request and waits for its response, or for the context to be done
+func (b *classifyBatcher) classify(ctx context.Context, req *classifierv2.ClassifyRequest) (*classifierv2.ClassifyResponse, error) {
+	p := &pendingClassification{req: req, done: make(chan struct{})}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, errBatcherClosed
+	}
+	b.pending = append(b.pending, p)
+	if len(b.pending) >= b.config.maxSize() {
+		batch := b.take()
+		b.sending.Add(1)
+		go func() {
+			defer b.sending.Done()
+			b.send(batch)
+		}()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.config.window(), b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.res, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take returns the pending requests and starts a new batch, b.mu must be held
+func (b *classifyBatcher) take() []*pendingClassification {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// flush sends the pending requests when the window of the batch is over, unless the batcher was closed
+func (b *classifyBatcher) flush() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.take()
+	if len(batch) > 0 {
+		b.sending.Add(1)
+		defer b.sending.Done()
+	}
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+}
+
+// close sends the pending requests and waits for the batches being sent, the requests classified afterwards
+// fail. The pool can be closed once it returns.
+func (b *classifyBatcher) close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+	b.sending.Wait()
+}
+
+// send classifies the batch and gives their response, or the error of the call, to the callers
+func (b *classifyBatcher) send(batch []*pendingClassification) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.timeout())
+	defer cancel()
+
+	requests := make([]*classifierv2.ClassifyRequest, len(batch))
+	for i, p := range batch {
+		p.req.Id = strconv.Itoa(i)
+		requests[i] = p.req
+	}
+	responses, err := b.call(ctx, requests)
+	for i, p := range batch {
+		res, ok := responses[p.req.Id]
+		switch {
+		case err != nil:
+			p.err = err
+		case !ok:
+			p.err = fmt.Errorf("no response from the classifier for text %d of the batch", i)
+		default:
+			p.res = res
+		}
+		close(p.done)
+	}
+}
+
+// call classifies the requests with a connection of the pool, it returns the responses by id of their request
+func (b *classifyBatcher) call(ctx context.Context, requests []*classifierv2.ClassifyRequest) (map[string]*classifierv2.ClassifyResponse, error) {
+	rc, err := b.pool.GetGRPCClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get classifier from pool %w", err)
+	}
+	defer b.pool.ReturnGRPCClient(rc)
+
+	if b.config.Stream {
+		return classifyStream(ctx, rc.V2, requests)
+	}
+	return classifyBatch(ctx, rc.V2, requests)
+}
+
+// classifyBatch classifies the requests in one ClassifyBatch call. The responses are in the order of the requests,
+// they are matched by position if the service does not echo the ids.
+func classifyBatch(ctx context.Context, client classifierv2.ClassifierClient, requests []*classifierv2.ClassifyRequest) (map[string]*classifierv2.ClassifyResponse, error) {
+	res, err := client.ClassifyBatch(ctx, &classifierv2.ClassifyBatchRequest{Requests: requests})
+	if err != nil {
+		return nil, callError("ClassifyBatch", err)
+	}
+	if len(res.Responses) != len(requests) {
+		return nil, fmt.Errorf("ClassifyBatch returned %d responses for %d requests", len(res.Responses), len(requests))
+	}
+	responses := make(map[string]*classifierv2.ClassifyResponse, len(requests))
+	for i, r := range res.Responses {
+		id := r.Id
+		if id == "" {
+			id = requests[i].Id
+		}
+		responses[id] = r
+	}
+	return responses, nil
+}
+
+// classifyStream sends the requests on a ClassifyStream while receiving the responses, which are matched by id
+func classifyStream(ctx context.Context, client classifierv2.ClassifierClient, requests []*classifierv2.ClassifyRequest) (map[string]*classifierv2.ClassifyResponse, error) {
+	stream, err := client.ClassifyStream(ctx)
+	if err != nil {
+		return nil, callError("ClassifyStream", err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		for _, req := range requests {
+			if err := stream.Send(req); err != nil {
+				// the error of the stream is returned by Recv
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+
+	responses := make(map[string]*classifierv2.ClassifyResponse, len(requests))
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return nil, callError("ClassifyStream", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error receiving from ClassifyStream gRPC: %w", err)
+		}
+		responses[res.Id] = res
+	}
+	if err := <-sent; err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error sending to ClassifyStream gRPC: %w", err)
+	}
+	return responses, nil
+}
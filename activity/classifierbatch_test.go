@@ -0,0 +1,143 @@
+package activity
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// classifyAll classifies the texts concurrently, it returns the predictions and errors in the order of the texts
+func classifyAll(c *Classifier, texts []string) ([]Prediction, []error) {
+	predictions := make([]Prediction, len(texts))
+	errs := make([]error, len(texts))
+	var wg sync.WaitGroup
+	for i, text := range texts {
+		wg.Add(1)
+		go func(i int, text string) {
+			defer wg.Done()
+			predictions[i], errs[i] = c.Classify(context.Background(), text)
+		}(i, text)
+	}
+	wg.Wait()
+	return predictions, errs
+}
+
+func TestClassifierBatching(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream %v", stream), func(t *testing.T) {
+			pool, mock := newMockClassifierV2Server(t)
+			// the batches are only sent when full
+			c := &Classifier{GRPCClientPool: pool, Batching: &Batching{MaxSize: 4, Window: time.Hour, Stream: stream}}
+
+			var texts []string
+			for i := 0; i < 8; i++ {
+				if i%2 == 0 {
+					texts = append(texts, fmt.Sprintf("unfortunately %d", i))
+				} else {
+					texts = append(texts, fmt.Sprintf("yes %d", i))
+				}
+			}
+			predictions, errs := classifyAll(c, texts)
+
+			// every caller gets the response to its own text
+			for i := range texts {
+				assert.NoError(t, errs[i])
+				if i%2 == 0 {
+					assert.Equal(t, "reject", predictions[i].Label, texts[i])
+				} else {
+					assert.Equal(t, "not_reject", predictions[i].Label, texts[i])
+				}
+				assert.Equal(t, "tfidf-lr@3", predictions[i].Model)
+			}
+			batches, streams := mock.calls()
+			if stream {
+				assert.Empty(t, batches)
+				assert.Equal(t, []int{4, 4}, streams)
+			} else {
+				assert.Equal(t, []int{4, 4}, batches)
+				assert.Empty(t, streams)
+			}
+		})
+	}
+}
+
+func TestClassifierBatchingWindow(t *testing.T) {
+	pool, mock := newMockClassifierV2Server(t)
+	window := 100 * time.Millisecond
+	c := &Classifier{GRPCClientPool: pool, Batching: &Batching{MaxSize: 10, Window: window}}
+
+	// a batch which is not full is sent when its window is over
+	start := time.Now()
+	_, errs := classifyAll(c, []string{"yes", "unfortunately", "maybe"})
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.GreaterOrEqual(t, time.Since(start), window)
+	batches, _ := mock.calls()
+	assert.Equal(t, []int{3}, batches)
+
+	// the rejection checker classifies through the batches too
+	isRejection, err := c.IsRejection(context.Background(), "unfortunately no")
+	assert.NoError(t, err)
+	assert.True(t, isRejection)
+	batches, _ = mock.calls()
+	assert.Equal(t, []int{3, 1}, batches)
+}
+
+func TestClassifierBatchingErrors(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream %v", stream), func(t *testing.T) {
+			pool, _ := newMockClassifierV2Server(t)
+			c := &Classifier{GRPCClientPool: pool, Batching: &Batching{MaxSize: 2, Window: time.Hour, Stream: stream}}
+
+			// the error of the call is given to all the callers of the batch
+			_, errs := classifyAll(c, []string{"yes", ""})
+			for _, err := range errs {
+				assert.ErrorContains(t, err, "empty text")
+			}
+
+			// a caller stops waiting when its context is done
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := c.Classify(ctx, "yes")
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+	}
+}
+
+func TestClassifierBatchingClose(t *testing.T) {
+	pool, mock := newMockClassifierV2Server(t)
+	c := &Classifier{GRPCClientPool: pool, Batching: &Batching{MaxSize: 10, Window: time.Hour}}
+	c.batcherOnce.Do(func() { c.batcher = newClassifyBatcher(pool, *c.Batching) })
+
+	// the pending batch is sent when the classifier stops batching, not when its window is over
+	var p Prediction
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p, err = c.Classify(context.Background(), "unfortunately")
+	}()
+	assert.Eventually(t, func() bool {
+		c.batcher.mu.Lock()
+		defer c.batcher.mu.Unlock()
+		return len(c.batcher.pending) == 1
+	}, time.Second, time.Millisecond)
+	c.stopBatching()
+	<-done
+	assert.NoError(t, err)
+	assert.Equal(t, "reject", p.Label)
+	batches, _ := mock.calls()
+	assert.Equal(t, []int{1}, batches)
+
+	// nothing is sent afterwards
+	_, err = c.Classify(context.Background(), "yes")
+	assert.ErrorIs(t, err, errBatcherClosed)
+	// a classifier closed before batching does not start
+	closed := &Classifier{GRPCClientPool: pool, Batching: &Batching{}}
+	closed.stopBatching()
+	_, err = closed.Classify(context.Background(), "yes")
+	assert.ErrorIs(t, err, errBatcherClosed)
+}
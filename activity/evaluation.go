@@ -0,0 +1,98 @@
+package activity
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+)
+
+// Evaluation is how a rejection checker scores on labeled examples
+type Evaluation struct {
+	// Backend names the rejection checker
+	Backend string `json:"backend"`
+	// Metrics score all the examples, the rejections being the positives. An example the checker failed on counts
+	// as a mistake, so a failing checker does not score better than a wrong one.
+	Metrics textmodel.Metrics `json:"metrics"`
+	Latency Latencies         `json:"latency"`
+	// Errors counts the examples the checker failed on
+	Errors int `json:"errors"`
+	// Misclassified are the examples the checker got wrong or failed on, in the order of the examples
+	Misclassified []EvaluatedExample `json:"misclassified"`
+}
+
+// EvaluatedExample is an example with what the checker told about it
+type EvaluatedExample struct {
+	// Index is the position of the example in the dataset, from 1
+	Index int    `json:"index"`
+	Text  string `json:"text"`
+	Label string `json:"label"`
+	// Rejection is whether the checker told a rejection, PredictedLabel and Confidence are set when it tells them
+	Rejection      bool    `json:"rejection"`
+	PredictedLabel string  `json:"predictedLabel,omitempty"`
+	Confidence     float64 `json:"confidence,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// Latencies are percentiles of the time the checker took on an example, failures included
+type Latencies struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// Evaluate runs the examples through the rejection checker, one at a time, the examples labeled rejectionLabel
+// are the rejections. It stops early when the context is done.
+func Evaluate(ctx context.Context, backend string, rc RejectionChecking, examples []textmodel.Example, rejectionLabel string) Evaluation {
+	e := Evaluation{Backend: backend}
+	h := &RejectionEmail{RejectionChecking: rc}
+	var confusion textmodel.Confusion
+	latencies := make([]time.Duration, 0, len(examples))
+	for i, example := range examples {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		classification, err := h.classify(ctx, example.Text)
+		latencies = append(latencies, time.Since(start))
+
+		rejection := example.Label == rejectionLabel
+		evaluated := EvaluatedExample{
+			Index:          i + 1,
+			Text:           example.Text,
+			Label:          example.Label,
+			Rejection:      classification.Positive,
+			PredictedLabel: classification.Label,
+			Confidence:     classification.Confidence,
+		}
+		if err != nil {
+			e.Errors++
+			evaluated.Error = err.Error()
+			confusion.Add(rejection, !rejection)
+		} else {
+			confusion.Add(rejection, classification.Positive)
+		}
+		if err != nil || classification.Positive != rejection {
+			e.Misclassified = append(e.Misclassified, evaluated)
+		}
+	}
+	e.Metrics = confusion.Metrics()
+	e.Latency = percentiles(latencies)
+	return e
+}
+
+// percentiles returns the nearest-rank percentiles of the latencies
+func percentiles(latencies []time.Duration) Latencies {
+	if len(latencies) == 0 {
+		return Latencies{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return Latencies{P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
@@ -0,0 +1,74 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+)
+
+// keywordChecker tells a rejection when the text has the keyword, and fails on empty texts
+type keywordChecker string
+
+func (k keywordChecker) IsRejection(ctx context.Context, text string) (bool, error) {
+	if text == "" {
+		return false, errors.New("empty text")
+	}
+	return strings.Contains(text, string(k)), nil
+}
+
+func TestEvaluate(t *testing.T) {
+	examples := []textmodel.Example{
+		{Text: "unfortunately no", Label: "reject"},
+		{Text: "we regret", Label: "reject"},
+		{Text: "interview unfortunately moved", Label: "not_reject"},
+		{Text: "offer", Label: "not_reject"},
+		{Text: "", Label: "reject"},
+	}
+	e := Evaluate(context.Background(), "keyword", keywordChecker("unfortunately"), examples, "reject")
+
+	assert.Equal(t, "keyword", e.Backend)
+	// the failure counts as a mistake, a missed rejection
+	assert.Equal(t, textmodel.Confusion{TruePositives: 1, FalseNegatives: 2, FalsePositives: 1, TrueNegatives: 1}, e.Metrics.Confusion)
+	assert.InDelta(t, 0.4, e.Metrics.F1, 1e-9)
+	assert.Equal(t, 1, e.Errors)
+	// the mistakes and failures are kept, in the order of the examples
+	if assert.Len(t, e.Misclassified, 3) {
+		assert.Equal(t, EvaluatedExample{Index: 2, Text: "we regret", Label: "reject"}, e.Misclassified[0])
+		assert.Equal(t, 3, e.Misclassified[1].Index)
+		assert.True(t, e.Misclassified[1].Rejection)
+		assert.Equal(t, 5, e.Misclassified[2].Index)
+		assert.Contains(t, e.Misclassified[2].Error, "empty text")
+	}
+	assert.LessOrEqual(t, e.Latency.P50, e.Latency.Max)
+
+	// the checkers telling their label and confidence have them kept
+	m, err := textmodel.Train(examples[:4], textmodel.Options{PositiveLabel: "reject"})
+	assert.NoError(t, err)
+	e = Evaluate(context.Background(), "local", &LocalClassifier{Model: m}, []textmodel.Example{{Text: "offer", Label: "reject"}}, "reject")
+	if assert.Len(t, e.Misclassified, 1) {
+		assert.Equal(t, "not_reject", e.Misclassified[0].PredictedLabel)
+		assert.Greater(t, e.Misclassified[0].Confidence, 0.5)
+	}
+
+	// nothing is evaluated once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e = Evaluate(ctx, "keyword", keywordChecker("unfortunately"), examples, "reject")
+	assert.Equal(t, 0, e.Metrics.Confusion.Total())
+}
+
+func TestPercentiles(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, Latencies{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}, percentiles(latencies))
+	assert.Equal(t, Latencies{P50: time.Second, P90: time.Second, P99: time.Second, Max: time.Second}, percentiles([]time.Duration{time.Second}))
+	assert.Equal(t, Latencies{}, percentiles(nil))
+}
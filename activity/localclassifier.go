@@ -0,0 +1,51 @@
+package activity
+
+import (
+	"context"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+)
+
+// LocalClassifier tells the rejections with a model file run in process, so no classifier service is needed.
+// The positive label of the model is the rejection label.
+type LocalClassifier struct {
+	Model *textmodel.Model
+	// Threshold is the probability of the positive label a rejection needs, DefaultThreshold if 0
+	Threshold float64
+}
+
+// NewLocalClassifier loads the model file
+func NewLocalClassifier(modelPath string, threshold float64) (*LocalClassifier, error) {
+	m, err := textmodel.LoadFile(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalClassifier{Model: m, Threshold: threshold}, nil
+}
+
+// IsRejection check whether the given text is rejection or not
+func (c *LocalClassifier) IsRejection(ctx context.Context, text string) (bool, error) {
+	classification, err := c.ClassifyRejection(ctx, text)
+	return classification.Positive, err
+}
+
+// ClassifyRejection classifies the text, the confidence is the probability of the label chosen
+func (c *LocalClassifier) ClassifyRejection(ctx context.Context, text string) (datamodel.Classification, error) {
+	if err := ctx.Err(); err != nil {
+		return datamodel.Classification{}, err
+	}
+	threshold := c.Threshold
+	if threshold == 0 {
+		threshold = DefaultThreshold
+	}
+	label, p := c.Model.Predict(text, threshold)
+	return datamodel.Classification{
+		Classifier: "rejection",
+		Positive:   label == c.Model.Options.PositiveLabel,
+		Label:      label,
+		Confidence: p,
+		Model:      c.Model.Name(),
+		Text:       text,
+	}, nil
+}
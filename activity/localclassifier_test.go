@@ -0,0 +1,42 @@
+package activity
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+)
+
+func TestLocalClassifier(t *testing.T) {
+	examples, err := textmodel.ReadExamplesFile("../classifier/job_application_rejections.csv")
+	assert.NoError(t, err)
+	m, err := textmodel.Train(examples, textmodel.Options{PositiveLabel: "reject"})
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "model.json")
+	assert.NoError(t, m.SaveFile(path))
+
+	c, err := NewLocalClassifier(path, 0)
+	assert.NoError(t, err)
+	classification, err := c.ClassifyRejection(context.Background(), "Unfortunately, we have decided to move forward with other candidates.")
+	assert.NoError(t, err)
+	assert.True(t, classification.Positive)
+	assert.Equal(t, "reject", classification.Label)
+	assert.Greater(t, classification.Confidence, 0.5)
+	assert.Equal(t, "tfidf-logistic", classification.Model)
+
+	isRejection, err := c.IsRejection(context.Background(), "We would like to invite you to an interview next week.")
+	assert.NoError(t, err)
+	assert.False(t, isRejection)
+
+	// a threshold no probability reaches tells no rejection
+	c.Threshold = 1.1
+	isRejection, err = c.IsRejection(context.Background(), "Unfortunately, we have decided to move forward with other candidates.")
+	assert.NoError(t, err)
+	assert.False(t, isRejection)
+
+	_, err = NewLocalClassifier(filepath.Join(t.TempDir(), "missing.json"), 0)
+	assert.Error(t, err)
+}
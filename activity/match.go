@@ -0,0 +1,150 @@
+package activity
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+)
+
+// Match lists the conditions a message must meet for a handler to run on it, the conditions not set are not checked
+type Match struct {
+	// SenderDomains matches the messages sent from one of the domains, or their subdomains
+	SenderDomains []string
+	// SubjectRegex matches the messages whose subject matches the regular expression
+	SubjectRegex string
+	// LabelsPresent matches the messages having all the labels, by name or id
+	LabelsPresent []string
+	// LabelsAbsent matches the messages having none of the labels, by name or id
+	LabelsAbsent []string
+	// HasAttachment, if set, matches the messages with or without attachments
+	HasAttachment *bool
+	// MinSize and MaxSize match the messages by size in bytes, 0 is no bound
+	MinSize int64
+	MaxSize int64
+}
+
+// LabelResolver finds the labels of the mailbox by name, the messages only carry the label ids
+type LabelResolver interface {
+	// LabelID returns the id of the label, "" if the mailbox has no such label
+	LabelID(ctx context.Context, name string) (string, error)
+}
+
+// matcher is a compiled Match
+type matcher struct {
+	match   Match
+	subject *regexp.Regexp
+	// labels resolves the label names of the match, they are compared as ids without it
+	labels LabelResolver
+}
+
+// compile checks the match and compiles its regular expression
+func (m Match) compile() (*matcher, error) {
+	c := &matcher{match: m}
+	if m.SubjectRegex != "" {
+		subject, err := regexp.Compile(m.SubjectRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject regex %q: %w", m.SubjectRegex, err)
+		}
+		c.subject = subject
+	}
+	if m.MaxSize > 0 && m.MinSize > m.MaxSize {
+		return nil, fmt.Errorf("min size %d is over max size %d", m.MinSize, m.MaxSize)
+	}
+	return c, nil
+}
+
+// matches reports whether the message meets all the conditions, and the first condition it does not meet. It
+// fails if the labels of the match could not be resolved.
+func (c *matcher) matches(ctx context.Context, msg datamodel.Message) (bool, string, error) {
+	m := c.match
+	if len(m.SenderDomains) > 0 && !fromDomain(msg.From.Email, m.SenderDomains) {
+		return false, "sender domain", nil
+	}
+	if c.subject != nil && !c.subject.MatchString(msg.Subject) {
+		return false, "subject", nil
+	}
+	for _, label := range m.LabelsPresent {
+		has, err := c.hasLabel(ctx, msg, label)
+		if err != nil {
+			return false, "", err
+		}
+		if !has {
+			return false, "label present", nil
+		}
+	}
+	for _, label := range m.LabelsAbsent {
+		has, err := c.hasLabel(ctx, msg, label)
+		if err != nil {
+			return false, "", err
+		}
+		if has {
+			return false, "label absent", nil
+		}
+	}
+	if m.HasAttachment != nil && msg.HasAttachments() != *m.HasAttachment {
+		return false, "attachment", nil
+	}
+	size := messageSize(msg)
+	if m.MinSize > 0 && size < m.MinSize {
+		return false, "min size", nil
+	}
+	if m.MaxSize > 0 && size > m.MaxSize {
+		return false, "max size", nil
+	}
+	return true, "", nil
+}
+
+// hasLabel reports whether the message has the label, given by name or by id
+func (c *matcher) hasLabel(ctx context.Context, msg datamodel.Message, label string) (bool, error) {
+	if hasLabel(msg, label) {
+		return true, nil
+	}
+	if c.labels == nil {
+		return false, nil
+	}
+	id, err := c.labels.LabelID(ctx, label)
+	if err != nil {
+		return false, fmt.Errorf("unable to find label %s: %w", label, err)
+	}
+	return id != "" && hasLabel(msg, id), nil
+}
+
+// fromDomain reports whether the email address is in one of the domains or their subdomains
+func fromDomain(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "@"))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLabel reports whether the message has the label, compared case-insensitively
+func hasLabel(msg datamodel.Message, label string) bool {
+	for _, l := range msg.LabelIDs {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageSize returns the size of the message as reported by the source, or the size of its content
+func messageSize(msg datamodel.Message) int64 {
+	if msg.SizeEstimate > 0 {
+		return msg.SizeEstimate
+	}
+	if len(msg.Payload) > 0 {
+		return int64(len(msg.Payload))
+	}
+	return int64(len(msg.Body))
+}
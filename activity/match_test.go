@@ -0,0 +1,103 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	yes, no := true, false
+	msg := datamodel.Message{
+		ID:           "1",
+		Subject:      "Your application to Acme",
+		From:         datamodel.Address{Name: "Acme Jobs", Email: "jobs@mail.acme.com"},
+		LabelIDs:     []string{"INBOX", "UNREAD"},
+		SizeEstimate: 2048,
+		Attachments:  []datamodel.Attachment{{Filename: "offer.pdf", Disposition: datamodel.DispositionAttachment}},
+	}
+	for _, tc := range []struct {
+		name      string
+		match     Match
+		matches   bool
+		condition string
+	}{
+		{"no condition", Match{}, true, ""},
+		{"sender subdomain", Match{SenderDomains: []string{"example.org", "ACME.com"}}, true, ""},
+		{"other sender", Match{SenderDomains: []string{"example.org"}}, false, "sender domain"},
+		{"domain suffix is not a subdomain", Match{SenderDomains: []string{"e.com"}}, false, "sender domain"},
+		{"subject", Match{SubjectRegex: `(?i)your application`}, true, ""},
+		{"other subject", Match{SubjectRegex: `^Offer`}, false, "subject"},
+		{"labels present", Match{LabelsPresent: []string{"inbox", "UNREAD"}}, true, ""},
+		{"label missing", Match{LabelsPresent: []string{"STARRED"}}, false, "label present"},
+		{"label absent", Match{LabelsAbsent: []string{"STARRED"}}, true, ""},
+		{"label not absent", Match{LabelsAbsent: []string{"UNREAD"}}, false, "label absent"},
+		{"has attachment", Match{HasAttachment: &yes}, true, ""},
+		{"without attachment", Match{HasAttachment: &no}, false, "attachment"},
+		{"size in bounds", Match{MinSize: 1024, MaxSize: 4096}, true, ""},
+		{"too small", Match{MinSize: 4096}, false, "min size"},
+		{"too big", Match{MaxSize: 1024}, false, "max size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := tc.match.compile()
+			assert.NoError(t, err)
+			matches, condition, err := m.matches(context.Background(), msg)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.matches, matches)
+			assert.Equal(t, tc.condition, condition)
+		})
+	}
+}
+
+// labelNames resolves the names of the labels, or fails
+type labelNames struct {
+	ids map[string]string
+	err error
+}
+
+func (l labelNames) LabelID(ctx context.Context, name string) (string, error) {
+	return l.ids[name], l.err
+}
+
+func TestMatchLabelNames(t *testing.T) {
+	msg := datamodel.Message{ID: "1", LabelIDs: []string{"INBOX", "Label_12"}}
+	labels := labelNames{ids: map[string]string{"Newsletters": "Label_12", "Jobs": "Label_34"}}
+	for _, tc := range []struct {
+		name      string
+		match     Match
+		matches   bool
+		condition string
+	}{
+		{"label name present", Match{LabelsPresent: []string{"Newsletters", "INBOX"}}, true, ""},
+		{"label name missing", Match{LabelsPresent: []string{"Jobs"}}, false, "label present"},
+		{"label name not absent", Match{LabelsAbsent: []string{"Newsletters"}}, false, "label absent"},
+		{"label not in the mailbox is absent", Match{LabelsAbsent: []string{"Unknown"}}, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := tc.match.compile()
+			assert.NoError(t, err)
+			m.labels = labels
+			matches, condition, err := m.matches(context.Background(), msg)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.matches, matches)
+			assert.Equal(t, tc.condition, condition)
+		})
+	}
+
+	// the message is retried when the labels can not be listed
+	m, err := Match{LabelsPresent: []string{"Jobs"}}.compile()
+	assert.NoError(t, err)
+	m.labels = labelNames{err: errors.New("labels unavailable")}
+	_, _, err = m.matches(context.Background(), msg)
+	assert.ErrorContains(t, err, "labels unavailable")
+}
+
+func TestMatchInvalid(t *testing.T) {
+	_, err := Match{SubjectRegex: "("}.compile()
+	assert.ErrorContains(t, err, "invalid subject regex")
+	_, err = Match{MinSize: 10, MaxSize: 5}.compile()
+	assert.Error(t, err)
+}
@@ -0,0 +1,185 @@
+package activity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"github.com/jyouturer/gmail-ai/polling"
+	"go.uber.org/zap"
+)
+
+// Dependencies are the services the handlers are built with
+type Dependencies struct {
+	RejectionChecking RejectionChecking
+	// Labels resolves the label names of the matches, they are compared as label ids when it is nil
+	Labels LabelResolver
+}
+
+// HandlerFactory builds a handler from its options, the JSON options of the config, which may be empty
+type HandlerFactory func(deps Dependencies, options json.RawMessage) (polling.MessageHandlerFunc, error)
+
+// HandlerSpec enables a handler of the registry
+type HandlerSpec struct {
+	// Name names the handler in the logs, it is also the handler of the registry when Type is not set
+	Name string
+	// Type is the name of the handler in the registry
+	Type string
+	// Match is checked before the handler runs, the messages not matching are skipped
+	Match Match
+	// Options are the handler-specific options, as JSON
+	Options json.RawMessage
+	// Middleware wraps the handler, the first one is the outermost. It only runs on the messages matching.
+	Middleware []polling.Middleware
+}
+
+// HandlerName returns the name of the handler in the logs: its name, or its type when it has none
+func (s HandlerSpec) HandlerName() string {
+	if s.Name == "" {
+		return s.Type
+	}
+	return s.Name
+}
+
+// Registry holds the handlers available, by name
+type Registry struct {
+	factories map[string]HandlerFactory
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{factories: map[string]HandlerFactory{}}
+}
+
+// DefaultRegistry returns a registry with all the handlers of this package
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("rejection", newRejectionHandler)
+	r.Register("label", newLabelHandler)
+	return r
+}
+
+// Register adds the handler to the registry, replacing the handler of the same name
+func (r *Registry) Register(name string, factory HandlerFactory) {
+	r.factories[name] = factory
+}
+
+// Names returns the names of the handlers of the registry, sorted
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Build creates the handlers enabled by the specs, each running only on the messages it matches, wrapped by its middleware
+func (r *Registry) Build(specs []HandlerSpec, deps Dependencies) ([]polling.MessageHandlerFunc, error) {
+	handlers := make([]polling.MessageHandlerFunc, 0, len(specs))
+	for _, spec := range specs {
+		kind := spec.Type
+		if kind == "" {
+			kind = spec.Name
+		}
+		factory, ok := r.factories[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown handler %q, the handlers are %v", kind, r.Names())
+		}
+		name := spec.HandlerName()
+		match, err := spec.Match.compile()
+		if err != nil {
+			return nil, fmt.Errorf("handler %q: %w", name, err)
+		}
+		match.labels = deps.Labels
+		handler, err := factory(deps, spec.Options)
+		if err != nil {
+			return nil, fmt.Errorf("handler %q: %w", name, err)
+		}
+		handlers = append(handlers, matching(name, match, polling.Chain(spec.Middleware...)(handler)))
+	}
+	return handlers, nil
+}
+
+// matching runs the handler only on the messages matching, its actions are named after it
+func matching(name string, match *matcher, handler polling.MessageHandlerFunc) polling.MessageHandlerFunc {
+	return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		ok, condition, err := match.matches(ctx, msg)
+		if err != nil {
+			return nil, fmt.Errorf("handler %s: %w", name, err)
+		}
+		if !ok {
+			logging.Logger.Debug("message skipped by handler", zap.String("handler", name), zap.String("message", msg.ID), zap.String("condition", condition))
+			return nil, nil
+		}
+		actions, err := handler(ctx, msg)
+		if err != nil {
+			return nil, fmt.Errorf("handler %s: %w", name, err)
+		}
+		// the actions are copied, a handler may return the same ones for every message
+		named := make([]datamodel.Action, len(actions))
+		for i, a := range actions {
+			if a.Handler == "" {
+				a.Handler = name
+			}
+			named[i] = a
+		}
+		return named, nil
+	}
+}
+
+// decodeOptions decodes the JSON options into the options struct, rejecting unknown options
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(bytes.TrimSpace(options)) == 0 || string(bytes.TrimSpace(options)) == "null" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(options))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
+
+// labelOptions are the options of the handlers setting a label
+type labelOptions struct {
+	Label      string `json:"label"`
+	MarkAsRead bool   `json:"markAsRead"`
+	Archive    bool   `json:"archive"`
+}
+
+// newRejectionHandler builds the rejection handler, its options default to the "Rejection" label, marking as read
+func newRejectionHandler(deps Dependencies, options json.RawMessage) (polling.MessageHandlerFunc, error) {
+	if deps.RejectionChecking == nil {
+		return nil, fmt.Errorf("the rejection handler needs a rejection checker")
+	}
+	opts := labelOptions{Label: DefaultRejectionLabel, MarkAsRead: true}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Label == "" {
+		return nil, fmt.Errorf("the label option is empty")
+	}
+	h := NewRejectionEmail(deps.RejectionChecking)
+	h.Label, h.MarkAsRead, h.Archive = opts.Label, opts.MarkAsRead, opts.Archive
+	return h.Process, nil
+}
+
+// newLabelHandler builds a handler setting the label on every message it matches
+func newLabelHandler(deps Dependencies, options json.RawMessage) (polling.MessageHandlerFunc, error) {
+	var opts labelOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.Label == "" {
+		return nil, fmt.Errorf("the label option is required")
+	}
+	actions := labelActions(opts.Label, opts.MarkAsRead, opts.Archive)
+	return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		return actions, nil
+	}, nil
+}
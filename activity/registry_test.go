@@ -0,0 +1,128 @@
+package activity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/polling"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRejectionChecking finds rejections by a keyword
+type fakeRejectionChecking struct{}
+
+func (fakeRejectionChecking) IsRejection(ctx context.Context, text string) (bool, error) {
+	return text == "we rejected you", nil
+}
+
+func TestRegistryBuild(t *testing.T) {
+	deps := Dependencies{RejectionChecking: fakeRejectionChecking{}}
+	specs := []HandlerSpec{
+		{Name: "rejection", Options: json.RawMessage(`{"label": "Jobs/Rejected", "archive": true}`)},
+		{
+			Name:    "newsletters",
+			Type:    "label",
+			Match:   Match{SenderDomains: []string{"news.example.org"}},
+			Options: json.RawMessage(`{"label": "Newsletters", "markAsRead": true}`),
+		},
+	}
+	handlers, err := DefaultRegistry().Build(specs, deps)
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 2)
+
+	messages := []datamodel.Message{
+		{ID: "1", Body: "we rejected you", From: datamodel.Address{Email: "jobs@acme.com"}},
+		{ID: "2", Body: "weekly news", From: datamodel.Address{Email: "digest@news.example.org"}},
+	}
+	planned := map[string][]datamodel.Action{}
+	for _, msg := range messages {
+		for _, handler := range handlers {
+			actions, err := handler(context.Background(), msg)
+			assert.NoError(t, err)
+			planned[msg.ID] = append(planned[msg.ID], actions...)
+		}
+	}
+	// the actions are named after their handler, the rejections carry the output of the classifier
+	named := func(handler string, classification *datamodel.Classification, actions ...datamodel.Action) []datamodel.Action {
+		for i := range actions {
+			actions[i].Handler, actions[i].Classification = handler, classification
+		}
+		return actions
+	}
+	rejected := &datamodel.Classification{Classifier: "rejection", Positive: true, Text: "we rejected you"}
+	assert.Equal(t, map[string][]datamodel.Action{
+		"1": named("rejection", rejected, datamodel.AddLabel("Jobs/Rejected"), datamodel.MarkRead(), datamodel.Archive()),
+		"2": named("newsletters", nil, datamodel.AddLabel("Newsletters"), datamodel.MarkRead()),
+	}, planned)
+}
+
+func TestRegistryBuildErrors(t *testing.T) {
+	deps := Dependencies{RejectionChecking: fakeRejectionChecking{}}
+	for _, tc := range []struct {
+		name string
+		spec HandlerSpec
+		err  string
+	}{
+		{"unknown handler", HandlerSpec{Name: "forward"}, `unknown handler "forward"`},
+		{"unknown option", HandlerSpec{Name: "rejection", Options: json.RawMessage(`{"labl": "x"}`)}, "invalid options"},
+		{"missing label", HandlerSpec{Name: "important", Type: "label"}, "label option is required"},
+		{"invalid match", HandlerSpec{Name: "rejection", Match: Match{SubjectRegex: "["}}, "invalid subject regex"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DefaultRegistry().Build([]HandlerSpec{tc.spec}, deps)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestRegistryRegister(t *testing.T) {
+	r := NewRegistry()
+	var handled []string
+	r.Register("custom", func(deps Dependencies, options json.RawMessage) (polling.MessageHandlerFunc, error) {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			handled = append(handled, msg.ID)
+			return []datamodel.Action{datamodel.Star()}, errors.New("custom failure")
+		}, nil
+	})
+	assert.Equal(t, []string{"custom"}, r.Names())
+
+	handlers, err := r.Build([]HandlerSpec{{Name: "mine", Type: "custom", Match: Match{SubjectRegex: "^keep"}}}, Dependencies{})
+	assert.NoError(t, err)
+	actions, err := handlers[0](context.Background(), datamodel.Message{ID: "1", Subject: "drop me"})
+	assert.NoError(t, err)
+	assert.Empty(t, actions)
+	// the errors are named after the handler, the actions of a failed handler are dropped
+	actions, err = handlers[0](context.Background(), datamodel.Message{ID: "2", Subject: "keep me"})
+	assert.EqualError(t, err, "handler mine: custom failure")
+	assert.Empty(t, actions)
+	assert.Equal(t, []string{"2"}, handled)
+}
+
+func TestRegistryBuildMiddleware(t *testing.T) {
+	r := NewRegistry()
+	r.Register("custom", func(deps Dependencies, options json.RawMessage) (polling.MessageHandlerFunc, error) {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			panic("custom bug")
+		}, nil
+	})
+	var observed []string
+	observe := func(handler string, latency time.Duration, err error) {
+		observed = append(observed, handler)
+	}
+	spec := HandlerSpec{Type: "custom", Match: Match{SubjectRegex: "^keep"}}
+	spec.Middleware = []polling.Middleware{polling.Latency(spec.HandlerName(), observe), polling.Recover(spec.HandlerName())}
+	handlers, err := r.Build([]HandlerSpec{spec}, Dependencies{})
+	assert.NoError(t, err)
+
+	// the middleware only runs on the messages matching
+	_, err = handlers[0](context.Background(), datamodel.Message{ID: "1", Subject: "drop me"})
+	assert.NoError(t, err)
+	_, err = handlers[0](context.Background(), datamodel.Message{ID: "2", Subject: "keep me"})
+	assert.EqualError(t, err, "handler custom: panic: custom bug")
+	assert.False(t, polling.IsRetryable(err))
+	assert.Equal(t, []string{"custom"}, observed)
+}
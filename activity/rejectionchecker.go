@@ -19,7 +19,7 @@ type RejectionChecker struct {
 // NewRejectionChecker creates a new RejectionChecker, it will initiate the gRPC connection pool, and return a function to close the connection pool
 func NewRejectionChecker(grpcUrl string, grpcConnectionNumber int, grpcTimeoutSeconds int) (*RejectionChecker, func() error, error) {
 	// Create a connection pool with 10 grpc connection objects
-	cp, err := integration.NewConnectionPool(grpcUrl, grpcConnectionNumber, time.Duration(grpcTimeoutSeconds))
+	cp, err := integration.NewConnectionPool(grpcUrl, grpcConnectionNumber, time.Duration(grpcTimeoutSeconds)*time.Second)
 	if err != nil {
 		logging.Logger.Error("Error creating connection pool: %v", zap.Error(err))
 		return nil, nil, err
@@ -39,7 +39,7 @@ func (h *RejectionChecker) IsRejection(ctx context.Context, text string) (bool,
 	res, err := h.checkRejectionGrpc(ctx, req)
 	//logging.Logger.Debug("IsRejection", zap.Bool("res", res.IsRejection))
 	if err != nil {
-		return false, fmt.Errorf("error calling IsRejection gRPC: %v", err)
+		return false, fmt.Errorf("error calling IsRejection gRPC: %w", err)
 	}
 	return res.IsRejection, nil
 }
@@ -48,13 +48,13 @@ func (h *RejectionChecker) IsRejection(ctx context.Context, text string) (bool,
 func (h *RejectionChecker) checkRejectionGrpc(ctx context.Context, req *integration.ClassifyRequest, opts ...grpc.CallOption) (*integration.ClassifyResponse, error) {
 	rc, err := h.GRPCClientPool.GetGRPCClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get rejection check from pool %v", err)
+		return nil, fmt.Errorf("failed to get rejection check from pool %w", err)
 	}
 	defer h.GRPCClientPool.ReturnGRPCClient(rc)
 
 	res, err := rc.Client.ClassifyEmail(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("error calling IsRejection gRPC: %v", err)
+		return nil, fmt.Errorf("error calling IsRejection gRPC: %w", err)
 	}
 	return res, nil
 }
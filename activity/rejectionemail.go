@@ -5,24 +5,30 @@ import (
 	"fmt"
 
 	"github.com/jyouturer/gmail-ai/datamodel"
-	"github.com/jyouturer/gmail-ai/integration"
 	"github.com/jyouturer/gmail-ai/internal/logging"
 	"github.com/jyouturer/gmail-ai/internal/nlp"
 	"go.uber.org/zap"
-	"google.golang.org/api/gmail/v1"
 )
 
-// Check whether a email is rejection, then label it
+// DefaultRejectionLabel is the label set on the rejection emails
+const DefaultRejectionLabel = "Rejection"
+
+// Check whether a email is rejection, then plan its label
 type RejectionEmail struct {
-	GmailService      *gmail.Service
 	RejectionChecking RejectionChecking
+	// Label is set on the rejections, which are also marked as read or archived if set
+	Label      string
+	MarkAsRead bool
+	Archive    bool
 }
 
-// NewRejectionEmail creates a new RejectionEmail, given gmail client and rejection checker implementation
-func NewRejectionEmail(gmailService *gmail.Service, rc RejectionChecking) *RejectionEmail {
+// NewRejectionEmail creates a new RejectionEmail, given the rejection checker implementation.
+// The rejections are labeled "Rejection" and marked as read.
+func NewRejectionEmail(rc RejectionChecking) *RejectionEmail {
 	return &RejectionEmail{
-		GmailService:      gmailService,
 		RejectionChecking: rc,
+		Label:             DefaultRejectionLabel,
+		MarkAsRead:        true,
 	}
 }
 
@@ -31,28 +37,60 @@ type RejectionChecking interface {
 	IsRejection(ctx context.Context, text string) (bool, error)
 }
 
-// HandleRejectionEmail implement the EmailRejectionEmailFunc interface, it will be called by Email Processor
-func (h *RejectionEmail) Process(ctx context.Context, msg datamodel.Message) error {
+// RejectionClassifying is implemented by the rejection checkers telling the label and probability they decided
+// with, like the v2 Classifier. The output is kept on the actions planned.
+type RejectionClassifying interface {
+	ClassifyRejection(ctx context.Context, text string) (datamodel.Classification, error)
+}
+
+// Process implements the MessageHandlerFunc, it returns the actions on the message if it is a rejection.
+// The actions are applied by the executor of the message source.
+func (h *RejectionEmail) Process(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
 	// Get the text of the email
 	text := msg.Body
 
 	// use NLP to extract the top 3 sentences of the email body
 	topSentencens, err := nlp.ExtractTopSentenseFrom(3, text)
 	if err != nil {
-		return fmt.Errorf("unable to exract top sentences from message %v: %v", msg.ID, err)
+		return nil, fmt.Errorf("unable to exract top sentences from message %v: %v", msg.ID, err)
 	}
 
-	res, err := h.RejectionChecking.IsRejection(ctx, topSentencens)
+	classification, err := h.classify(ctx, topSentencens)
 	if err != nil {
-		return fmt.Errorf("error calling IsRejection gRPC: %v", err)
+		return nil, err
+	}
+	logging.Logger.Debug("IsRejection", zap.Bool("res", classification.Positive), zap.String("label", classification.Label), zap.Float64("confidence", classification.Confidence))
+	// If the email is a rejection, plan the specified label
+	if !classification.Positive {
+		return nil, nil
+	}
+	actions := labelActions(h.Label, h.MarkAsRead, h.Archive)
+	for i := range actions {
+		actions[i].Classification = &classification
+	}
+	return actions, nil
+}
+
+// classify tells whether the text is a rejection, with the label and probability when the checker tells them
+func (h *RejectionEmail) classify(ctx context.Context, text string) (datamodel.Classification, error) {
+	if c, ok := h.RejectionChecking.(RejectionClassifying); ok {
+		return c.ClassifyRejection(ctx, text)
+	}
+	res, err := h.RejectionChecking.IsRejection(ctx, text)
+	if err != nil {
+		return datamodel.Classification{}, fmt.Errorf("error calling IsRejection gRPC: %w", err)
+	}
+	return datamodel.Classification{Classifier: "rejection", Positive: res, Text: text}, nil
+}
+
+// labelActions returns the actions setting the label, marking the message as read and archiving it if set
+func labelActions(label string, markAsRead, archive bool) []datamodel.Action {
+	actions := []datamodel.Action{datamodel.AddLabel(label)}
+	if markAsRead {
+		actions = append(actions, datamodel.MarkRead())
 	}
-	logging.Logger.Debug("IsRejection", zap.Bool("res", res))
-	// If the email is a rejection, apply the specified label
-	if res {
-		err := integration.SetLabel(h.GmailService, msg.ID, "Rejection", true, false)
-		if err != nil {
-			return fmt.Errorf("error setting label on message %v: %v", msg.ID, err)
-		}
+	if archive {
+		actions = append(actions, datamodel.Archive())
 	}
-	return nil
+	return actions
 }
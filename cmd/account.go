@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	activity "github.com/jyouturer/gmail-ai/activity"
+	config "github.com/jyouturer/gmail-ai/config"
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"github.com/jyouturer/gmail-ai/messagesource"
+	"github.com/jyouturer/gmail-ai/polling"
+	"go.uber.org/zap"
+)
+
+// Defaults of the poll schedule
+const (
+	defaultPollInterval   = 60 * time.Second
+	defaultPollMaxBackoff = 30 * time.Minute
+	defaultPollJitter     = 0.1
+)
+
+// pollSchedule sets when an account is polled: every interval, doubled at every failure in a row up to maxBackoff,
+// randomized by the jitter
+type pollSchedule struct {
+	interval   time.Duration
+	maxBackoff time.Duration
+	jitter     float64
+}
+
+// pollScheduleOf returns the poll schedule of the config
+func pollScheduleOf(cfg *config.Config) pollSchedule {
+	s := pollSchedule{
+		interval:   time.Duration(cfg.Poll.IntervalSeconds) * time.Second,
+		maxBackoff: time.Duration(cfg.Poll.MaxBackoffSeconds) * time.Second,
+		jitter:     defaultPollJitter,
+	}
+	if s.interval <= 0 {
+		s.interval = defaultPollInterval
+	}
+	if s.maxBackoff <= 0 {
+		s.maxBackoff = defaultPollMaxBackoff
+	}
+	if s.maxBackoff < s.interval {
+		s.maxBackoff = s.interval
+	}
+	if j := cfg.Poll.Jitter; j != nil && *j >= 0 && *j <= 1 {
+		s.jitter = *j
+	}
+	return s
+}
+
+// next returns the wait before the next poll, after the given number of failed polls in a row
+func (s pollSchedule) next(failures int) time.Duration {
+	backoff := polling.RetryPolicy{
+		InitialBackoff: s.interval,
+		MaxBackoff:     s.maxBackoff,
+		Multiplier:     2,
+		Jitter:         s.jitter,
+	}
+	return backoff.Backoff(failures + 1)
+}
+
+// syncHistory is the poll history, which also tells when the last poll moved it
+type syncHistory interface {
+	polling.PollHistory
+	LastWriteTime() (time.Time, error)
+}
+
+// dryRun runs the handlers without changing the mailboxes, their actions are written to the report instead
+type dryRun struct {
+	report *polling.ActionReport
+	// commitCursor moves the history on, otherwise the next run processes the same messages again
+	commitCursor bool
+}
+
+// account is a mailbox polled, with its own history, dedupe store, dead-letter queue and handlers
+type account struct {
+	name        string
+	history     syncHistory
+	lease       *polling.Lease
+	processed   *polling.DedupeStore
+	sideEffects *polling.SideEffectStore
+	deadLetters *polling.DeadLetterQueue
+	// gmail is the message source of the Gmail accounts, nil for the IMAP ones
+	gmail *messagesource.GmailService
+	// userID is the Gmail mailbox of the token, "me" by default
+	userID   string
+	handlers []polling.MessageHandlerFunc
+	provider *polling.MessageProvider
+	schedule pollSchedule
+	// latency records the latencies of the handlers, logged after every poll
+	latency *polling.LatencyRecorder
+	// dryRun is set when the actions are reported instead of applied
+	dryRun  *dryRun
+	closers []func()
+}
+
+// accountsOf returns the accounts of the config, the accounts without handlers get the ones of the config.
+// Without an accounts section, the Gmail or IMAP section is the only account, it has no name so its files
+// keep their names.
+func accountsOf(cfg *config.Config) []config.Account {
+	if len(cfg.Accounts) == 0 {
+		return []config.Account{{Gmail: cfg.Gmail, IMAP: cfg.IMAP, Handlers: cfg.Handlers}}
+	}
+	accounts := make([]config.Account, len(cfg.Accounts))
+	for i, acc := range cfg.Accounts {
+		if len(acc.Handlers) == 0 {
+			acc.Handlers = cfg.Handlers
+		}
+		accounts[i] = acc
+	}
+	return accounts
+}
+
+// findAccount returns the account of the name, the name can be empty when there is only one account
+func findAccount(cfg *config.Config, name string) (config.Account, error) {
+	accounts := accountsOf(cfg)
+	if name == "" {
+		if len(accounts) > 1 {
+			return config.Account{}, fmt.Errorf("there are %d accounts in the config, choose one with --account", len(accounts))
+		}
+		return accounts[0], nil
+	}
+	var names []string
+	for _, a := range accounts {
+		if a.Name == name {
+			return a, nil
+		}
+		names = append(names, a.Name)
+	}
+	return config.Account{}, fmt.Errorf("unknown account %q, the accounts are %s", name, strings.Join(names, ", "))
+}
+
+// validateAccounts checks the accounts have distinct names, since their files are named after them
+func validateAccounts(cfg *config.Config) error {
+	seen := map[string]bool{}
+	for _, a := range cfg.Accounts {
+		if a.Name == "" {
+			return fmt.Errorf("an account has no name")
+		}
+		if strings.ContainsAny(a.Name, `/\:`) {
+			return fmt.Errorf("account name %q can not contain '/', '\\' or ':'", a.Name)
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("account %q is listed twice", a.Name)
+		}
+		seen[a.Name] = true
+	}
+	return nil
+}
+
+// stateFile returns the name of the state file of the account, "history.txt" becomes "history-personal.txt"
+func stateFile(filename, accountName string) string {
+	if accountName == "" {
+		return filename
+	}
+	dot := strings.LastIndex(filename, ".")
+	return filename[:dot] + "-" + accountName + filename[dot:]
+}
+
+// openAccount opens the state of the account, and creates its message source, handlers and message provider.
+// With a dry run, the dedupe store is kept in memory and there is no dead-letter queue.
+func openAccount(cfg *config.Config, acc config.Account, rc activity.RejectionChecking, dry *dryRun) (*account, error) {
+	a := &account{name: acc.Name, userID: "me", dryRun: dry, schedule: pollScheduleOf(cfg), latency: polling.NewLatencyRecorder()}
+	if err := a.open(cfg, acc, rc); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// openAccountRetrying opens the account, trying again on the poll schedule until it opens or the context is done.
+// An account without a Gmail token is not tried again, it needs the auth command first.
+func openAccountRetrying(ctx context.Context, cfg *config.Config, acc config.Account, rc activity.RejectionChecking, dry *dryRun) (*account, error) {
+	schedule := pollScheduleOf(cfg)
+	for failures := 1; ; failures++ {
+		a, err := openAccount(cfg, acc, rc, dry)
+		if err == nil {
+			return a, nil
+		}
+		if errors.Is(err, integration.ErrNoToken) {
+			logging.Logger.Error("unable to open account, it is not polled", zap.String("account", acc.Name), zap.Error(err))
+			return nil, err
+		}
+		wait := schedule.next(failures)
+		logging.Logger.Error("unable to open account, trying again", zap.String("account", acc.Name), zap.Duration("wait", wait), zap.Error(err))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// open opens what the account needs, the closers of what was opened are kept even if it fails
+func (a *account) open(cfg *config.Config, acc config.Account, rc activity.RejectionChecking) (err error) {
+	a.openHistory(cfg)
+	if a.dryRun != nil {
+		a.processed = polling.NewDedupeStore(cfg.Dedupe.MaxMessages, time.Duration(cfg.Dedupe.TTLDays)*24*time.Hour)
+		a.sideEffects = polling.NewSideEffectStore()
+	} else if err = a.openState(cfg); err != nil {
+		return err
+	}
+
+	var service polling.MessageService
+	if acc.IMAP.Address != "" {
+		imapService := messagesource.NewIMAPService(messagesource.IMAPConfig{
+			Address:       acc.IMAP.Address,
+			Username:      acc.IMAP.Username,
+			Password:      acc.IMAP.Password,
+			TLS:           acc.IMAP.TLS,
+			Mailbox:       acc.IMAP.Mailbox,
+			LabelMode:     acc.IMAP.LabelMode,
+			ArchiveFolder: acc.IMAP.ArchiveFolder,
+			TrashFolder:   acc.IMAP.TrashFolder,
+			DraftsFolder:  acc.IMAP.DraftsFolder,
+		})
+		a.closers = append(a.closers, func() { imapService.Close() })
+		service = imapService
+	} else {
+		gmail := acc.Gmail
+		if gmail.Credentials == "" {
+			gmail.Credentials = cfg.Gmail.Credentials
+		}
+		if gmail.UserID != "" {
+			a.userID = gmail.UserID
+		}
+		if a.gmail, err = newGmailService(gmail, a.history, a.sideEffects); err != nil {
+			return err
+		}
+		service = a.gmail
+	}
+	// the label names of the matches are resolved in the mailbox
+	labels, _ := service.(activity.LabelResolver)
+	if a.handlers, err = newHandlers(acc.Handlers, cfg.Middleware, rc, labels, a.latency); err != nil {
+		return err
+	}
+	options := providerOptions(cfg, a.processed, a.deadLetters)
+	options = append(options, polling.WithUserID(a.userID))
+	if a.dryRun != nil {
+		options = append(options, polling.WithDryRun(a.dryRun.report.ForAccount(a.name)))
+	}
+	a.provider = polling.NewMessageProvider(service, options...)
+	return nil
+}
+
+// openState opens the dedupe store, the side effect store and the dead-letter queue of the account
+func (a *account) openState(cfg *config.Config) (err error) {
+	if a.processed, err = openDedupeStore(cfg, a.name); err != nil {
+		return err
+	}
+	processed := a.processed
+	a.closers = append(a.closers, func() { processed.Close() })
+	if a.sideEffects, err = polling.OpenSideEffectStore(stateFile(sideEffectFile, a.name)); err != nil {
+		return fmt.Errorf("error opening side effects: %w", err)
+	}
+	sideEffects := a.sideEffects
+	a.closers = append(a.closers, func() { sideEffects.Close() })
+	if a.deadLetters, err = openDeadLetterQueue(a.name); err != nil {
+		return err
+	}
+	deadLetters := a.deadLetters
+	a.closers = append(a.closers, func() { deadLetters.Close() })
+	return nil
+}
+
+// openHistory opens the poll history: in Redis when it is set in the config, shared by the instances polling
+// the same account with a lease, or in the history file otherwise
+func (a *account) openHistory(cfg *config.Config) {
+	if cfg.Redis.Address == "" {
+		a.history = polling.NewFileHistory(stateFile(historyFile, a.name))
+		return
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Address,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+	a.closers = append(a.closers, func() { client.Close() })
+	key := cfg.Redis.Key
+	if key == "" {
+		key = "gmail-ai"
+	}
+	if a.name != "" {
+		key += ":" + a.name
+	}
+	a.lease = polling.NewLease(client, key+":leader", time.Duration(cfg.Redis.LeaseSeconds)*time.Second)
+	a.history = polling.NewRedisHistory(client, key+":history", polling.WithHistoryLease(a.lease))
+}
+
+// Close closes the state and the message source of the account
+func (a *account) Close() {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i]()
+	}
+	a.closers = nil
+}
+
+// pollLoop polls the account on its schedule until the context is done. With a shared history, only the
+// instance holding the lease polls. Errors are logged and do not stop the loop, they delay the next poll.
+// A poll in progress when the context is done finishes its messages in flight before the loop returns.
+func (a *account) pollLoop(ctx context.Context) {
+	if a.lease != nil {
+		// the lease is kept until the last poll has committed its cursor, not just until the context is done
+		keepCtx, stopKeeping := context.WithCancel(context.Background())
+		kept := make(chan struct{})
+		go func() {
+			defer close(kept)
+			a.lease.Keep(keepCtx)
+		}()
+		defer func() {
+			stopKeeping()
+			<-kept
+		}()
+	}
+	failures := 0
+	for {
+		if a.lease == nil || a.lease.Held() {
+			if err := a.pollOnce(ctx); err != nil {
+				failures++
+			} else {
+				failures = 0
+			}
+		} else {
+			logging.Logger.Debug("another instance holds the lease, standing by", zap.String("account", a.name))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		wait := a.schedule.next(failures)
+		if failures > 0 {
+			logging.Logger.Info("backing off", zap.String("account", a.name), zap.Int("failures", failures), zap.Duration("wait", wait))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// pollLeased polls the account once, if this instance can take the lease of a shared history. The lease is
+// released afterwards.
+func (a *account) pollLeased(ctx context.Context) error {
+	if a.lease != nil {
+		held, err := a.lease.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		if !held {
+			logging.Logger.Info("another instance holds the lease, not polling", zap.String("account", a.name))
+			return nil
+		}
+		defer func() {
+			if err := a.lease.Release(context.Background()); err != nil {
+				logging.Logger.Warn("unable to release lease", zap.String("account", a.name), zap.Error(err))
+			}
+		}()
+	}
+	return a.pollOnce(ctx)
+}
+
+// pollOnce polls the account once, logging and returning the error
+func (a *account) pollOnce(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Logger.Error("poll panicked", zap.String("account", a.name), zap.Any("panic", r))
+			err = fmt.Errorf("poll panicked: %v", r)
+		}
+	}()
+	defer a.latency.Log(zap.String("account", a.name))
+	var history polling.PollHistory = a.history
+	if a.dryRun != nil && !a.dryRun.commitCursor {
+		history = polling.ReadOnlyHistory(history)
+	}
+	if err := a.provider.PollAndProcess(ctx, history, a.handlers); err != nil {
+		if ctx.Err() != nil {
+			logging.Logger.Info("poll interrupted", zap.String("account", a.name), zap.Error(err))
+			return nil
+		}
+		logging.Logger.Error("poll failed", zap.String("account", a.name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// newRejectionChecker creates the client of the classifier service of the config, and the function closing it.
+// A local model of the config is used instead of the service.
+// The v2 classifier applies the thresholds of the config to the probabilities of the labels, and batches the texts
+// if the config sets a batch size.
+func newRejectionChecker(cfg *config.Config) (activity.RejectionChecking, func() error, error) {
+	if local := cfg.LocalModel; local.Path != "" {
+		c, err := activity.NewLocalClassifier(local.Path, local.Threshold)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, func() error { return nil }, nil
+	}
+	grpc := cfg.GRPCService
+	switch grpc.Version {
+	case "", "v1":
+		if grpc.Batch.MaxSize > 0 {
+			return nil, nil, fmt.Errorf("batching needs the v2 classifier, set grpcService.version to v2")
+		}
+		return activity.NewRejectionChecker(grpc.URL, 10, 10)
+	case "v2":
+		c, closeFunc, err := activity.NewClassifier(grpc.URL, 10, 10, activity.Thresholds{Default: grpc.Threshold, Labels: grpc.Thresholds})
+		if err != nil {
+			return nil, nil, err
+		}
+		c.RejectionLabel = grpc.RejectionLabel
+		if grpc.Batch.MaxSize > 0 {
+			c.Batching = &activity.Batching{
+				MaxSize: grpc.Batch.MaxSize,
+				Window:  time.Duration(grpc.Batch.WindowMillis) * time.Millisecond,
+				Stream:  grpc.Batch.Stream,
+				Timeout: time.Duration(grpc.Batch.TimeoutSeconds) * time.Second,
+			}
+		}
+		return c, closeFunc, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown classifier version %q, it is v1 or v2", grpc.Version)
+	}
+}
+
+// newHandlers creates the handlers enabled in the config, only the rejection handler if none is. Each handler is
+// wrapped by the middleware of the config, the latencies are given to the recorder. The label names of the matches
+// are resolved by labels, they are compared as ids if it is nil.
+func newHandlers(handlers []config.Handler, middleware config.Middleware, rc activity.RejectionChecking, labels activity.LabelResolver, latency *polling.LatencyRecorder) ([]polling.MessageHandlerFunc, error) {
+	var specs []activity.HandlerSpec
+	for _, h := range handlers {
+		spec := activity.HandlerSpec{
+			Name: h.Name,
+			Type: h.Type,
+			Match: activity.Match{
+				SenderDomains: h.Match.SenderDomains,
+				SubjectRegex:  h.Match.SubjectRegex,
+				LabelsPresent: h.Match.LabelsPresent,
+				LabelsAbsent:  h.Match.LabelsAbsent,
+				HasAttachment: h.Match.HasAttachment,
+				MinSize:       h.Match.MinSizeBytes,
+				MaxSize:       h.Match.MaxSizeBytes,
+			},
+			Options: h.Options,
+		}
+		spec.Middleware = handlerMiddleware(spec.HandlerName(), overrideMiddleware(middleware, h.Middleware), latency)
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		specs = []activity.HandlerSpec{{Name: "rejection", Middleware: handlerMiddleware("rejection", middleware, latency)}}
+	}
+	deps := activity.Dependencies{RejectionChecking: rc, Labels: labels}
+	built, err := activity.DefaultRegistry().Build(specs, deps)
+	if err != nil {
+		return nil, fmt.Errorf("error creating handlers: %w", err)
+	}
+	return built, nil
+}
+
+// overrideMiddleware returns the middleware with the values set in the override replacing its own
+func overrideMiddleware(middleware, override config.Middleware) config.Middleware {
+	if override.TimeoutSeconds != 0 {
+		middleware.TimeoutSeconds = override.TimeoutSeconds
+	}
+	if override.MaxConcurrency != 0 {
+		middleware.MaxConcurrency = override.MaxConcurrency
+	}
+	if override.Logging != nil {
+		middleware.Logging = override.Logging
+	}
+	if override.Latency != nil {
+		middleware.Latency = override.Latency
+	}
+	return middleware
+}
+
+// handlerMiddleware returns the middleware chain of the handler: the panics are always recovered, then the runs
+// are logged, limited in concurrency, measured and bounded in time, as set in the config
+func handlerMiddleware(name string, cfg config.Middleware, latency *polling.LatencyRecorder) []polling.Middleware {
+	middleware := []polling.Middleware{polling.Recover(name)}
+	if cfg.Logging != nil && *cfg.Logging {
+		middleware = append(middleware, polling.Logging(name))
+	}
+	if cfg.MaxConcurrency > 0 {
+		middleware = append(middleware, polling.ConcurrencyLimit(cfg.MaxConcurrency))
+	}
+	if cfg.Latency != nil && *cfg.Latency && latency != nil {
+		middleware = append(middleware, polling.Latency(name, latency.Observe))
+	}
+	if cfg.TimeoutSeconds > 0 {
+		middleware = append(middleware, polling.Timeout(time.Duration(cfg.TimeoutSeconds)*time.Second))
+	}
+	return middleware
+}
+
+// providerOptions returns the options of the message provider from the config
+func providerOptions(cfg *config.Config, processed *polling.DedupeStore, deadLetters *polling.DeadLetterQueue) []polling.ProviderOption {
+	return []polling.ProviderOption{
+		polling.WithDedupeStore(processed),
+		polling.WithDeadLetterQueue(deadLetters),
+		polling.WithPipeline(pipelineConfig(cfg)),
+		polling.WithRetryPolicy(polling.RetryPolicy{
+			MaxAttempts:    cfg.Retry.MaxAttempts,
+			InitialBackoff: time.Duration(cfg.Retry.InitialBackoffMillis) * time.Millisecond,
+			MaxBackoff:     time.Duration(cfg.Retry.MaxBackoffMillis) * time.Millisecond,
+		}),
+		polling.WithDrainTimeout(drainTimeout(cfg)),
+	}
+}
+
+// drainTimeout returns how long the messages in flight may take to finish on shutdown
+func drainTimeout(cfg *config.Config) time.Duration {
+	if cfg.Poll.DrainSeconds <= 0 {
+		return polling.DefaultDrainTimeout
+	}
+	return time.Duration(cfg.Poll.DrainSeconds) * time.Second
+}
+
+// openDeadLetterQueue opens the queue of the messages of the account that failed to be processed
+func openDeadLetterQueue(accountName string) (*polling.DeadLetterQueue, error) {
+	queue, err := polling.OpenDeadLetterQueue(stateFile(deadLetterFile, accountName))
+	if err != nil {
+		return nil, fmt.Errorf("error opening dead-letter queue: %w", err)
+	}
+	return queue, nil
+}
+
+// openDedupeStore opens the store of the processed messages of the account
+func openDedupeStore(cfg *config.Config, accountName string) (*polling.DedupeStore, error) {
+	ttl := time.Duration(cfg.Dedupe.TTLDays) * 24 * time.Hour
+	store, err := polling.OpenDedupeStore(stateFile(dedupeFile, accountName), cfg.Dedupe.MaxMessages, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("error opening processed messages: %w", err)
+	}
+	return store, nil
+}
+
+// newGmailService creates the Gmail message service of the mailbox, the forwards and drafts done are recorded in the
+// side effect store so a retried plan does not do them twice
+func newGmailService(gmail config.Gmail, history syncHistory, sideEffects *polling.SideEffectStore) (*messagesource.GmailService, error) {
+	gmailService, err := integration.CreateGmailService(gmail.Credentials, gmail.Token)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Gmail service: %w", err)
+	}
+	// the last poll time bounds the messages listed if the stored history id has expired, it is saved with the
+	// history id, the time of the last write stands in for it in histories saved without it
+	lastSync, err := history.LastWriteTime()
+	if err != nil {
+		logging.Logger.Warn("unable to read last poll time", zap.Error(err))
+	}
+	return messagesource.NewGmailService(gmailService,
+		messagesource.WithLastSync(lastSync),
+		messagesource.WithBackfill(gmail.BackfillDays),
+		messagesource.WithUserID(gmail.UserID),
+		messagesource.WithSideEffectLog(sideEffects),
+	), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/activity"
+	config "github.com/jyouturer/gmail-ai/config"
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// evalCommand benchmarks rejection checkers on labeled examples
+func evalCommand(configFilePath *string) *cli.Command {
+	return &cli.Command{
+		Name:  "eval",
+		Usage: "run labeled examples through rejection checkers and report their scores, latencies and mistakes side by side",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "data",
+				Usage:    "path to the labeled examples, a CSV with text and label columns or JSON lines with text and label fields",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:  "backend",
+				Value: cli.NewStringSlice("config"),
+				Usage: "rejection checker to evaluate, repeat it to compare several: config (the one of the config file), " +
+					"v1:<address>, v2:<address>, local:<model file> or chatgpt:<url> (the key is read from CHATGPT_API_KEY)",
+			},
+			&cli.StringFlag{
+				Name:  "positive-label",
+				Value: "reject",
+				Usage: "label of the rejections, every other label is negative",
+			},
+			&cli.StringFlag{
+				Name:  "json",
+				Value: "eval.json",
+				Usage: "path to the JSON report, with all the misclassified examples, empty to write none",
+			},
+			&cli.IntFlag{
+				Name:  "show",
+				Value: 10,
+				Usage: "misclassified examples printed per backend",
+			},
+			&cli.BoolFlag{
+				Name:  "raw",
+				Usage: "give the texts as they are, when they were already prepared like the rejection handler does",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			return eval(*configFilePath, cCtx.String("data"), cCtx.StringSlice("backend"), cCtx.String("positive-label"), cCtx.String("json"), cCtx.Int("show"), !cCtx.Bool("raw"))
+		},
+	}
+}
+
+// evalReport is the JSON report of eval
+type evalReport struct {
+	Data           string                `json:"data"`
+	DataHash       string                `json:"dataHash"`
+	Examples       int                   `json:"examples"`
+	RejectionLabel string                `json:"rejectionLabel"`
+	Evaluations    []activity.Evaluation `json:"evaluations"`
+}
+
+// eval runs the examples of the data file through each backend, then prints the evaluations side by side and
+// writes them to the JSON report. The texts are prepared like the rejection handler prepares the bodies, unless
+// they already were.
+func eval(configFilePath, dataPath string, backends []string, rejectionLabel, jsonPath string, show int, preprocess bool) error {
+	examples, err := textmodel.ReadExamplesFile(dataPath)
+	if err != nil {
+		return err
+	}
+	if preprocess {
+		if examples, err = prepareExamples(examples); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	report := evalReport{Data: dataPath, DataHash: textmodel.Hash(examples), Examples: len(examples), RejectionLabel: rejectionLabel}
+	for _, backend := range backends {
+		rc, closeFunc, err := newBackend(configFilePath, backend)
+		if err != nil {
+			return fmt.Errorf("error creating backend %s: %w", backend, err)
+		}
+		evaluation := activity.Evaluate(ctx, backend, rc, examples, rejectionLabel)
+		if err := closeFunc(); err != nil {
+			logging.Logger.Warn("unable to close backend", zap.String("backend", backend), zap.Error(err))
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logging.Logger.Info("backend evaluated", zap.String("backend", backend), zap.Float64("f1", evaluation.Metrics.F1), zap.Int("errors", evaluation.Errors))
+		report.Evaluations = append(report.Evaluations, evaluation)
+	}
+
+	printEvaluations(os.Stdout, report.Evaluations, show)
+	if jsonPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("unable to write eval report: %w", err)
+		}
+	}
+	return nil
+}
+
+// newBackend creates the rejection checker of the backend spec, and the function closing it
+func newBackend(configFilePath, spec string) (activity.RejectionChecking, func() error, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	noClose := func() error { return nil }
+	switch {
+	case kind == "config" && arg == "":
+		cfg, err := config.NewConfigFromFile(configFilePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading config file: %w", err)
+		}
+		return newRejectionChecker(cfg)
+	case kind == "v1" && arg != "":
+		return activity.NewRejectionChecker(arg, 1, 10)
+	case kind == "v2" && arg != "":
+		return activity.NewClassifier(arg, 1, 10, activity.Thresholds{})
+	case kind == "local" && arg != "":
+		c, err := activity.NewLocalClassifier(arg, 0)
+		return c, noClose, err
+	case kind == "chatgpt" && arg != "":
+		key := os.Getenv("CHATGPT_API_KEY")
+		if key == "" {
+			return nil, nil, fmt.Errorf("CHATGPT_API_KEY is not set")
+		}
+		client := integration.NewChatGPTClient(arg, key, integration.WithRateLimit(), integration.WithTimeout(30*time.Second))
+		return &activity.ChatGPTChecker{Client: client}, noClose, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown backend %q, it is config, v1:<address>, v2:<address>, local:<model file> or chatgpt:<url>", spec)
+	}
+}
+
+// printEvaluations prints the scores and latencies of the backends side by side, then their first misclassified
+// examples
+func printEvaluations(out io.Writer, evaluations []activity.Evaluation, show int) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	row := func(name string, value func(e activity.Evaluation) string) {
+		fmt.Fprint(w, name)
+		for _, e := range evaluations {
+			fmt.Fprint(w, "\t", value(e))
+		}
+		fmt.Fprintln(w)
+	}
+	score := func(f func(m textmodel.Metrics) float64) func(e activity.Evaluation) string {
+		return func(e activity.Evaluation) string { return fmt.Sprintf("%.3f", f(e.Metrics)) }
+	}
+	count := func(f func(e activity.Evaluation) int) func(e activity.Evaluation) string {
+		return func(e activity.Evaluation) string { return fmt.Sprint(f(e)) }
+	}
+	latency := func(f func(l activity.Latencies) time.Duration) func(e activity.Evaluation) string {
+		return func(e activity.Evaluation) string { return f(e.Latency).Round(time.Microsecond).String() }
+	}
+
+	row("backend", func(e activity.Evaluation) string { return e.Backend })
+	row("scored", count(func(e activity.Evaluation) int { return e.Metrics.Confusion.Total() }))
+	row("errors", count(func(e activity.Evaluation) int { return e.Errors }))
+	row("accuracy", score(func(m textmodel.Metrics) float64 { return m.Accuracy }))
+	row("precision", score(func(m textmodel.Metrics) float64 { return m.Precision }))
+	row("recall", score(func(m textmodel.Metrics) float64 { return m.Recall }))
+	row("F1", score(func(m textmodel.Metrics) float64 { return m.F1 }))
+	row("true positives", count(func(e activity.Evaluation) int { return e.Metrics.Confusion.TruePositives }))
+	row("false positives", count(func(e activity.Evaluation) int { return e.Metrics.Confusion.FalsePositives }))
+	row("true negatives", count(func(e activity.Evaluation) int { return e.Metrics.Confusion.TrueNegatives }))
+	row("false negatives", count(func(e activity.Evaluation) int { return e.Metrics.Confusion.FalseNegatives }))
+	row("latency p50", latency(func(l activity.Latencies) time.Duration { return l.P50 }))
+	row("latency p90", latency(func(l activity.Latencies) time.Duration { return l.P90 }))
+	row("latency p99", latency(func(l activity.Latencies) time.Duration { return l.P99 }))
+	row("latency max", latency(func(l activity.Latencies) time.Duration { return l.Max }))
+	w.Flush()
+
+	for _, e := range evaluations {
+		if len(e.Misclassified) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\nmisclassified by %s: %d\n", e.Backend, len(e.Misclassified))
+		for i, m := range e.Misclassified {
+			if i == show {
+				fmt.Fprintf(out, "  ... %d more in the JSON report\n", len(e.Misclassified)-show)
+				break
+			}
+			fmt.Fprintf(out, "  #%d %s -> %s %q\n", m.Index, m.Label, predicted(m), truncate(m.Text, 100))
+		}
+	}
+}
+
+// predicted describes what the backend told about the example
+func predicted(m activity.EvaluatedExample) string {
+	switch {
+	case m.Error != "":
+		return "error: " + m.Error
+	case m.PredictedLabel != "":
+		return fmt.Sprintf("%s (%.2f)", m.PredictedLabel, m.Confidence)
+	case m.Rejection:
+		return "rejection"
+	default:
+		return "not a rejection"
+	}
+}
+
+// truncate cuts the text to n runes
+func truncate(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "..."
+}
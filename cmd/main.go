@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
-	activity "github.com/jyouturer/gmail-ai/activity"
 	config "github.com/jyouturer/gmail-ai/config"
 	integration "github.com/jyouturer/gmail-ai/integration"
 	"github.com/jyouturer/gmail-ai/internal/logging"
@@ -16,6 +19,14 @@ import (
 	"go.uber.org/zap"
 )
 
+// files the polling state is kept in, in the working directory
+const (
+	historyFile    = "history.txt"
+	dedupeFile     = "processed.txt"
+	sideEffectFile = "sideeffects.txt"
+	deadLetterFile = "deadletters.jsonl"
+)
+
 func init() {
 	logger, err := logging.NewLogger()
 	if err != nil {
@@ -35,20 +46,115 @@ func main() {
 		Commands: []*cli.Command{
 			{
 				Name:  "poll",
-				Usage: "poll new emails and process them",
+				Usage: "poll new emails and process them, until interrupted",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "once",
+						Usage: "poll every account once and exit, failing if an account failed, to run from cron",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "run the handlers without changing the mailboxes, writing the actions they plan to the report",
+					},
+					&cli.StringFlag{
+						Name:  "report",
+						Value: "dry-run.jsonl",
+						Usage: "path to the file the actions of a dry run are written to, as JSON lines",
+					},
+					&cli.BoolFlag{
+						Name:  "commit-cursor",
+						Usage: "move the history on in a dry run, so the messages are not processed again by the next run",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if !cCtx.Bool("dry-run") {
+						return poll(configFilePath, cCtx.Bool("once"), nil)
+					}
+					report, err := os.Create(cCtx.String("report"))
+					if err != nil {
+						return fmt.Errorf("unable to create report: %w", err)
+					}
+					defer report.Close()
+					dry := &dryRun{report: polling.NewActionReport(report), commitCursor: cCtx.Bool("commit-cursor")}
+					err = poll(configFilePath, cCtx.Bool("once"), dry)
+					logging.Logger.Info("dry run done", zap.String("report", report.Name()), zap.Int("actions", dry.report.Entries()))
+					return err
+				},
+			},
+			{
+				Name:  "auth",
+				Usage: "authorize the access to the Gmail mailbox of the account, saving its token",
+				Flags: []cli.Flag{accountFlag()},
+				Action: func(cCtx *cli.Context) error {
+					return authorize(configFilePath, cCtx.String("account"))
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "process new emails as soon as Gmail push notifications arrive, polling as a fallback",
+				Flags: []cli.Flag{accountFlag()},
+				Action: func(cCtx *cli.Context) error {
+					return serve(configFilePath, cCtx.String("account"))
+				},
+			},
+			{
+				Name:  "replay",
+				Usage: "run the handlers over an mbox file, a Maildir or a directory of .eml files, recording the actions instead of applying them",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "source",
+						Usage:    "path to the mbox file, Maildir or .eml directory",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "actions",
+						Value: "actions.jsonl",
+						Usage: "path to the file the recorded actions are written to, as JSON lines",
+					},
+					accountFlag(),
+				},
 				Action: func(cCtx *cli.Context) error {
-					poll(configFilePath)
-					return nil
+					return replay(configFilePath, cCtx.String("account"), cCtx.String("source"), cCtx.String("actions"))
+				},
+			},
+			{
+				Name:  "dlq",
+				Usage: "manage the dead-letter queue of the messages that failed to be processed",
+				Flags: []cli.Flag{accountFlag()},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "list the messages in the dead-letter queue",
+						Action: func(cCtx *cli.Context) error {
+							return dlqList(configFilePath, cCtx.String("account"))
+						},
+					},
+					{
+						Name:      "replay",
+						Usage:     "process again the messages in the dead-letter queue, all of them or the given message ids",
+						ArgsUsage: "[message id...]",
+						Action: func(cCtx *cli.Context) error {
+							return dlqReplay(configFilePath, cCtx.String("account"), cCtx.Args().Slice())
+						},
+					},
+					{
+						Name:  "purge",
+						Usage: "delete all the messages of the dead-letter queue",
+						Action: func(cCtx *cli.Context) error {
+							return dlqPurge(configFilePath, cCtx.String("account"))
+						},
+					},
 				},
 			},
+			trainCommand(),
+			evalCommand(&configFilePath),
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "config",
 				Value:       "config.json",
-				Usage:       "path to the config file",
+				Usage:       "path to the config file, not needed by the train command",
 				Destination: &configFilePath,
-				Required:    true,
 			},
 		},
 	}
@@ -59,35 +165,343 @@ func main() {
 
 }
 
-// poll polls new emails and processes them
-func poll(configFilePath string) {
+// accountFlag chooses the account a command runs on, when there are several in the config
+func accountFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "account",
+		Usage: "name of the account, required when there are several accounts in the config",
+	}
+}
+
+// shutdownContext returns a context done on SIGINT or SIGTERM. A second signal kills the process, without
+// waiting for the messages in flight.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logging.Logger.Info("shutting down, finishing the messages in flight", zap.Stringer("signal", sig))
+			cancel()
+		case <-ctx.Done():
+		}
+		// restore the default behavior of the signals
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// poll polls the new emails of all the accounts and processes them, each account in its own loop, until a
+// signal asks to stop. With once, every account is polled once instead. With a dry run, the actions are
+// reported instead of applied.
+func poll(configFilePath string, once bool, dry *dryRun) error {
 	// Load the configuration file
 	config, err := config.NewConfigFromFile(configFilePath)
 	if err != nil {
-		logging.Logger.Fatal("Error loading config file", zap.Error(err))
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	if err := validateAccounts(config); err != nil {
+		return err
 	}
 
-	gmailService, err := integration.CreateGmailService(config.Gmail.Credentials, config.Gmail.Token)
+	// create process to handle rejection email
+	rc, closeFunc, err := newRejectionChecker(config)
 	if err != nil {
-		log.Fatalf("Error creating Gmail service: %v", err)
+		return fmt.Errorf("error creating Rejection Checker: %w", err)
 	}
-	// create process to handle rejection email
-	rc, closeFunc, err := activity.NewRejectionChecker(config.GRPCService.URL, 10, 10)
+	defer closeFunc()
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	// an account failing to open does not stop the others, it is opened again on the poll schedule
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, acc := range accountsOf(config) {
+		acc := acc
+		if !once {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a, err := openAccountRetrying(ctx, config, acc, rc, dry)
+				if err != nil {
+					if ctx.Err() == nil {
+						mu.Lock()
+						failed = append(failed, acc.Name)
+						mu.Unlock()
+					}
+					return
+				}
+				defer a.Close()
+				a.pollLoop(ctx)
+			}()
+			continue
+		}
+		a, err := openAccount(config, acc, rc, dry)
+		if err != nil {
+			logging.Logger.Error("unable to open account, it is not polled", zap.String("account", acc.Name), zap.Error(err))
+			failed = append(failed, acc.Name)
+			continue
+		}
+		defer a.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.pollLeased(ctx); err != nil {
+				mu.Lock()
+				failed = append(failed, a.name)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) == len(accountsOf(config)) {
+		return fmt.Errorf("no account could be polled")
+	}
+	if once && len(failed) > 0 {
+		return fmt.Errorf("%d of %d accounts failed to poll", len(failed), len(accountsOf(config)))
+	}
+	return nil
+}
+
+// authorize asks the user to authorize the access to the Gmail mailbox of the account, and saves the token the
+// other commands use
+func authorize(configFilePath, accountName string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	if acc.IMAP.Address != "" {
+		return fmt.Errorf("account %q is an IMAP account, it has no token", acc.Name)
+	}
+	gmail := acc.Gmail
+	if gmail.Credentials == "" {
+		gmail.Credentials = config.Gmail.Credentials
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	if err := integration.AuthorizeGmail(ctx, gmail.Credentials, gmail.Token); err != nil {
+		return fmt.Errorf("error authorizing Gmail: %w", err)
+	}
+	logging.Logger.Info("token saved", zap.String("token", gmail.Token))
+	return nil
+}
+
+// pipelineConfig returns the parallelism of the message processing from the config
+func pipelineConfig(config *config.Config) polling.PipelineConfig {
+	return polling.PipelineConfig{
+		FetchWorkers:      config.Pipeline.FetchWorkers,
+		FetchBatchSize:    config.Pipeline.FetchBatchSize,
+		PreprocessWorkers: config.Pipeline.PreprocessWorkers,
+		HandlerWorkers:    config.Pipeline.HandlerWorkers,
+		QueueSize:         config.Pipeline.QueueSize,
+		MessageTimeout:    time.Duration(config.Pipeline.MessageTimeoutSeconds) * time.Second,
+	}
+}
+
+// serve runs the endpoint receiving the Gmail push notifications from Pub/Sub, and processes new emails when they arrive
+func serve(configFilePath, accountName string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
 	if err != nil {
-		logging.Logger.Fatal("Error creating Rejection Checker", zap.Error(err))
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	if config.Push.Topic == "" {
+		return fmt.Errorf("the push topic is not set in the config")
+	}
+	address := config.Push.Address
+	if address == "" {
+		address = ":8080"
+	}
+	path := config.Push.Path
+	if path == "" {
+		path = "/push"
+	}
+	fallback := time.Duration(config.Push.FallbackPollMinutes) * time.Minute
+	if fallback <= 0 {
+		fallback = 10 * time.Minute
+	}
+
+	rc, closeFunc, err := newRejectionChecker(config)
+	if err != nil {
+		return fmt.Errorf("error creating Rejection Checker: %w", err)
 	}
 	defer closeFunc()
-	// crate the gmail handler
-	hc := activity.NewRejectionEmail(gmailService, rc)
+	if config.Redis.Address != "" {
+		return fmt.Errorf("the redis history is only supported by the poll command")
+	}
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	a, err := openAccount(config, acc, rc, nil)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if a.gmail == nil {
+		return fmt.Errorf("push notifications are only supported by Gmail accounts")
+	}
+	defer a.latency.Log(zap.String("account", a.name))
+
+	shutdown, stop := shutdownContext()
+	defer stop()
+	ctx, cancel := context.WithCancel(shutdown)
+	defer cancel()
+	// the deliveries for another mailbox of the topic are refused
+	emailAddress, err := a.gmail.EmailAddress(a.userID)
+	if err != nil {
+		return err
+	}
+	go a.gmail.KeepWatching(ctx, a.userID, config.Push.Topic)
+
+	push := polling.NewPushHandler(config.Push.Token, emailAddress)
+	mux := http.NewServeMux()
+	mux.Handle(path, push)
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logging.Logger.Info("listening for push notifications", zap.String("address", address), zap.String("path", path))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Logger.Error("push endpoint stopped", zap.Error(err))
+			cancel()
+		}
+	}()
+	defer server.Close()
+
+	err = a.provider.Serve(ctx, a.history, a.handlers, push.Notifications(), fallback)
+	if shutdown.Err() != nil {
+		// stopped by a signal
+		return nil
+	}
+	return err
+}
+
+// replay processes all the messages of the file source once, the actions of the handlers are written to actionsPath
+func replay(configFilePath, accountName, source, actionsPath string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	actions, err := os.Create(actionsPath)
+	if err != nil {
+		return fmt.Errorf("error creating actions file: %w", err)
+	}
+	defer actions.Close()
+	fileService, err := messagesource.NewFileService(source, messagesource.WithActionLog(actions))
+	if err != nil {
+		return err
+	}
 
-	handlers := []polling.MessageHandlerFunc{
-		hc.Process,
+	rc, closeFunc, err := newRejectionChecker(config)
+	if err != nil {
+		return fmt.Errorf("error creating Rejection Checker: %w", err)
+	}
+	defer closeFunc()
+	// the handlers of the account run on the messages of the file
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	latency := polling.NewLatencyRecorder()
+	defer latency.Log()
+	handlers, err := newHandlers(acc.Handlers, config.Middleware, rc, nil, latency)
+	if err != nil {
+		return err
 	}
-	provider := polling.NewMessageProvider(messagesource.NewGmailService(gmailService))
-	history := polling.NewFileHistory("history.txt")
-	// Process new emails
+
+	// the file source returns the messages in batches, poll until the cursor stops moving
+	history := polling.NewMemoryHistory(0)
+	// failing messages are skipped right away, so the cursor always moves on
+	provider := polling.NewMessageProvider(fileService, polling.WithMaxAttempts(1), polling.WithPipeline(pipelineConfig(config)))
 	for {
-		provider.PollAndProcess(context.Background(), history, handlers)
-		time.Sleep(60 * time.Second)
+		before, _ := history.ReadHistory()
+		if err := provider.PollAndProcess(context.Background(), history, handlers); err != nil {
+			return err
+		}
+		after, _ := history.ReadHistory()
+		if after == before {
+			break
+		}
+	}
+	logging.Logger.Info("replay done", zap.String("source", source), zap.Int("actions", len(fileService.Actions())))
+	return nil
+}
+
+// dlqList prints the messages in the dead-letter queue of the account
+func dlqList(configFilePath, accountName string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	deadLetters, err := openDeadLetterQueue(acc.Name)
+	if err != nil {
+		return err
+	}
+	defer deadLetters.Close()
+	for _, letter := range deadLetters.List() {
+		fmt.Printf("%s\t%s\t%d attempts\t%q\t%s\n", letter.Time.Format(time.RFC3339), letter.Message.ID, letter.Attempts, letter.Message.Subject, letter.Error)
+	}
+	fmt.Printf("%d message(s) in the dead-letter queue\n", deadLetters.Len())
+	return nil
+}
+
+// dlqReplay processes again the messages of the dead-letter queue of the account, all of them or the given ones
+func dlqReplay(configFilePath, accountName string, messageIDs []string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	rc, closeFunc, err := newRejectionChecker(config)
+	if err != nil {
+		return fmt.Errorf("error creating Rejection Checker: %w", err)
+	}
+	defer closeFunc()
+
+	a, err := openAccount(config, acc, rc, nil)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	replayed, err := a.provider.ReplayDeadLetters(context.Background(), a.deadLetters, a.handlers, messageIDs...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d message(s) replayed, %d left in the dead-letter queue\n", replayed, a.deadLetters.Len())
+	return nil
+}
+
+// dlqPurge deletes all the messages of the dead-letter queue of the account
+func dlqPurge(configFilePath, accountName string) error {
+	config, err := config.NewConfigFromFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	acc, err := findAccount(config, accountName)
+	if err != nil {
+		return err
+	}
+	deadLetters, err := openDeadLetterQueue(acc.Name)
+	if err != nil {
+		return err
+	}
+	defer deadLetters.Close()
+	purged := deadLetters.Len()
+	if err := deadLetters.Purge(); err != nil {
+		return err
 	}
+	fmt.Printf("%d message(s) purged from the dead-letter queue\n", purged)
+	return nil
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"github.com/jyouturer/gmail-ai/internal/nlp"
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// rejectionPreprocessing names the preparation of the texts by prepareExamples in the model files
+const rejectionPreprocessing = "rejection-text"
+
+// trainCommand trains a local model from labeled examples, see the localModel section of the config
+func trainCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "train",
+		Usage: "train a local rejection model from labeled examples, cross-validating it, and write the model file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "data",
+				Usage:    "path to the labeled examples, a CSV with text and label columns or JSON lines with text and label fields",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Value: "rejection-model.json",
+				Usage: "path to the model file written",
+			},
+			&cli.StringFlag{
+				Name:  "positive-label",
+				Value: "reject",
+				Usage: "label of the rejections, every other label is negative",
+			},
+			&cli.StringFlag{
+				Name:  "negative-label",
+				Usage: "label the model gives the texts which are not rejections, \"not_\" followed by the positive label by default",
+			},
+			&cli.StringFlag{
+				Name:  "algorithm",
+				Value: textmodel.LogisticRegressionAlgorithm,
+				Usage: "classifier of the TF-IDF vectors: logistic or naivebayes",
+			},
+			&cli.IntFlag{
+				Name:  "ngrams",
+				Value: 1,
+				Usage: "2 to also use the pairs of consecutive words as terms",
+			},
+			&cli.IntFlag{
+				Name:  "min-df",
+				Value: 1,
+				Usage: "drop the terms found in fewer examples",
+			},
+			&cli.Float64Flag{
+				Name:  "c",
+				Value: 1,
+				Usage: "inverse of the regularization of the logistic regression",
+			},
+			&cli.IntFlag{
+				Name:  "iterations",
+				Value: 1000,
+				Usage: "iterations of the gradient descent of the logistic regression",
+			},
+			&cli.Float64Flag{
+				Name:  "learning-rate",
+				Value: 2,
+				Usage: "learning rate of the gradient descent of the logistic regression",
+			},
+			&cli.Float64Flag{
+				Name:  "alpha",
+				Value: 1,
+				Usage: "smoothing of the naive Bayes",
+			},
+			&cli.IntFlag{
+				Name:  "folds",
+				Value: 5,
+				Usage: "folds of the cross-validation, 0 to skip it",
+			},
+			&cli.Int64Flag{
+				Name:  "seed",
+				Value: 1,
+				Usage: "seed shuffling the examples into the folds, the same data and seed give the same model",
+			},
+			&cli.StringFlag{
+				Name:  "version",
+				Usage: "version of the model, derived from the data, hyperparameters and seed by default",
+			},
+			&cli.BoolFlag{
+				Name:  "raw",
+				Usage: "train on the texts as they are, when they were already prepared like the rejection handler does",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			options := textmodel.Options{
+				Algorithm:     cCtx.String("algorithm"),
+				PositiveLabel: cCtx.String("positive-label"),
+				NegativeLabel: cCtx.String("negative-label"),
+				NGrams:        cCtx.Int("ngrams"),
+				MinDF:         cCtx.Int("min-df"),
+			}
+			switch options.Algorithm {
+			case textmodel.LogisticRegressionAlgorithm:
+				options.C, options.Iterations, options.LearningRate = cCtx.Float64("c"), cCtx.Int("iterations"), cCtx.Float64("learning-rate")
+			case textmodel.NaiveBayesAlgorithm:
+				options.Alpha = cCtx.Float64("alpha")
+			}
+			fit := textmodel.FitOptions{Folds: cCtx.Int("folds"), Seed: cCtx.Int64("seed"), Version: cCtx.String("version")}
+			return train(cCtx.String("data"), cCtx.String("output"), options, fit, !cCtx.Bool("raw"))
+		},
+	}
+}
+
+// train fits a model on the examples of the data file and writes it to the output. The texts are prepared like
+// the rejection handler prepares the bodies, unless they already were.
+func train(dataPath, outputPath string, options textmodel.Options, fit textmodel.FitOptions, preprocess bool) error {
+	examples, err := textmodel.ReadExamplesFile(dataPath)
+	if err != nil {
+		return err
+	}
+	if preprocess {
+		if examples, err = prepareExamples(examples); err != nil {
+			return err
+		}
+		fit.Preprocessing = rejectionPreprocessing
+	}
+	m, err := textmodel.Fit(examples, options, fit)
+	if err != nil {
+		return fmt.Errorf("unable to train model: %w", err)
+	}
+	if err := m.SaveFile(outputPath); err != nil {
+		return err
+	}
+
+	meta := m.Metadata
+	fmt.Printf("model %s trained on %d examples (%d %s), written to %s\n", m.Name(), meta.Examples, meta.Positives, m.Options.PositiveLabel, outputPath)
+	printMetrics("training", meta.TrainingMetrics)
+	if cv := meta.CrossValidation; cv != nil {
+		printMetrics(fmt.Sprintf("%d-fold cross-validation", cv.Folds), cv.Metrics)
+	}
+	logging.Logger.Info("train done", zap.String("model", m.Name()), zap.String("dataHash", meta.DataHash), zap.String("output", outputPath))
+	return nil
+}
+
+// htmlBody matches the examples which are still HTML, like the bodies exported from a mail client
+var htmlBody = regexp.MustCompile(`(?i)<(html|body|div|p|br|table|span)\b`)
+
+// prepareExamples prepares the texts of the examples like the messages reach the rejection handler, the HTML
+// converted to text as the message sources do, then like the handler prepares the bodies: their 3 longest sentences
+func prepareExamples(examples []textmodel.Example) ([]textmodel.Example, error) {
+	prepared := make([]textmodel.Example, len(examples))
+	for i, e := range examples {
+		body := e.Text
+		if htmlBody.MatchString(body) {
+			body = integration.MessageBody{HTML: body}.Text()
+		}
+		text, err := nlp.ExtractTopSentenseFrom(3, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to prepare example %d: %w", i+1, err)
+		}
+		prepared[i] = textmodel.Example{Text: text, Label: e.Label}
+	}
+	return prepared, nil
+}
+
+// printMetrics prints the scores of a model
+func printMetrics(name string, m textmodel.Metrics) {
+	fmt.Printf("%s: accuracy %.3f, precision %.3f, recall %.3f, F1 %.3f\n", name, m.Accuracy, m.Precision, m.Recall, m.F1)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jyouturer/gmail-ai/internal/textmodel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareExamples(t *testing.T) {
+	examples := []textmodel.Example{
+		// an HTML body is converted to text before its sentences are extracted
+		{Text: "<html><body><p>Thank you for applying.</p><p>Unfortunately we have decided to move forward with other candidates.</p></body></html>", Label: "reject"},
+		// only the 3 longest sentences are kept, longest first
+		{Text: "Hi. We would like to schedule a call with you. Are you free on Monday morning? Best regards from the whole recruiting team. Thanks.", Label: "other"},
+	}
+	prepared, err := prepareExamples(examples)
+	assert.NoError(t, err)
+	if assert.Len(t, prepared, 2) {
+		assert.Equal(t, "Unfortunately we have decided to move forward with other candidates. Thank you for applying.", prepared[0].Text)
+		assert.Equal(t, "reject", prepared[0].Label)
+		assert.Equal(t, "Best regards from the whole recruiting team. We would like to schedule a call with you. Are you free on Monday morning?", prepared[1].Text)
+		assert.Equal(t, "other", prepared[1].Label)
+	}
+}
@@ -6,13 +6,183 @@ import (
 )
 
 type Config struct {
-	Gmail struct {
-		Credentials string `json:"credentials"`
-		Token       string `json:"token"`
-	} `json:"gmail"`
+	Gmail Gmail `json:"gmail"`
+	// IMAP is used instead of Gmail when its address is set
+	IMAP IMAP `json:"imap"`
+	// Accounts lists the mailboxes polled, each with its own token, history and handlers. Without it, the
+	// single mailbox of the Gmail or IMAP section is polled with the handlers of the Handlers section.
+	Accounts []Account `json:"accounts"`
+	// Push configures the serve command, which processes emails on Gmail push notifications
+	Push struct {
+		// Topic is the Pub/Sub topic Gmail publishes to, "projects/<project>/topics/<topic>"
+		Topic string `json:"topic"`
+		// Address is where the push endpoint listens, ":8080" by default
+		Address string `json:"address"`
+		// Path of the push endpoint, "/push" by default
+		Path string `json:"path"`
+		// Token, if set, must be in the "token" query parameter of the push subscription endpoint
+		Token string `json:"token"`
+		// FallbackPollMinutes is how long without notifications before polling anyway, 10 by default
+		FallbackPollMinutes int `json:"fallbackPollMinutes"`
+	} `json:"push"`
+	// Dedupe bounds the store of the processed messages, which are not processed again if they show up in the history
+	Dedupe struct {
+		// MaxMessages is how many processed messages are remembered, 10000 by default
+		MaxMessages int `json:"maxMessages"`
+		// TTLDays is how many days a processed message is remembered, 30 by default
+		TTLDays int `json:"ttlDays"`
+	} `json:"dedupe"`
+	// Pipeline sets the parallelism of the processing of the messages, the values not set keep their default
+	Pipeline struct {
+		FetchWorkers      int `json:"fetchWorkers"`
+		FetchBatchSize    int `json:"fetchBatchSize"`
+		PreprocessWorkers int `json:"preprocessWorkers"`
+		HandlerWorkers    int `json:"handlerWorkers"`
+		// QueueSize is how many messages wait between the stages, a full queue holds the stage before it back
+		QueueSize int `json:"queueSize"`
+		// MessageTimeoutSeconds is how long the processing of one message may take, 60 by default
+		MessageTimeoutSeconds int `json:"messageTimeoutSeconds"`
+	} `json:"pipeline"`
+	// Retry sets how handlers failing with a transient error, like an unavailable classifier, are retried
+	Retry struct {
+		// MaxAttempts is how many times a handler runs on a message, 4 by default
+		MaxAttempts int `json:"maxAttempts"`
+		// InitialBackoffMillis is the wait before the first retry, 500 by default, doubled at every retry
+		InitialBackoffMillis int `json:"initialBackoffMillis"`
+		// MaxBackoffMillis caps the wait between two retries, 10000 by default
+		MaxBackoffMillis int `json:"maxBackoffMillis"`
+	} `json:"retry"`
+	// Poll sets when the poll command polls the accounts
+	Poll struct {
+		// IntervalSeconds is the time between two polls of an account, 60 by default
+		IntervalSeconds int `json:"intervalSeconds"`
+		// MaxBackoffSeconds caps the time between two polls of an account failing to poll, the interval doubles
+		// at every failure in a row, 1800 by default
+		MaxBackoffSeconds int `json:"maxBackoffSeconds"`
+		// Jitter is the fraction of the interval randomized, so accounts and instances do not poll in lockstep,
+		// 0.1 by default
+		Jitter *float64 `json:"jitter"`
+		// DrainSeconds is how long the messages in flight may take to finish on shutdown, 30 by default
+		DrainSeconds int `json:"drainSeconds"`
+	} `json:"poll"`
+	// Redis, when its address is set, keeps the poll history in Redis instead of the history file, so several
+	// instances can poll the same account: only the one holding the lease polls, another takes over when it expires
+	Redis struct {
+		Address  string `json:"address"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+		// Key prefixes the keys of the history and the lease, "gmail-ai" by default
+		Key string `json:"key"`
+		// LeaseSeconds is how long the lease lasts without being renewed, 30 by default
+		LeaseSeconds int `json:"leaseSeconds"`
+	} `json:"redis"`
+	// Handlers lists the handlers enabled, in order, for the accounts not listing theirs. Without it, only
+	// the "rejection" handler runs.
+	Handlers []Handler `json:"handlers"`
+	// Middleware wraps all the handlers, a handler can override it with its own middleware section
+	Middleware  Middleware `json:"middleware"`
 	GRPCService struct {
 		URL string `json:"url"`
+		// Version is the protocol of the classifier: "v1" (the default) only tells rejections, "v2" ranks labels
+		// with their probabilities
+		Version string `json:"version"`
+		// RejectionLabel is the v2 label of the rejections, "reject" by default
+		RejectionLabel string `json:"rejectionLabel"`
+		// Threshold is the probability a v2 label needs when neither Thresholds nor the model set one for it
+		Threshold float64 `json:"threshold"`
+		// Thresholds are the probabilities the v2 labels need, overriding the thresholds advised by the model
+		Thresholds map[string]float64 `json:"thresholds"`
+		// Batch groups the texts classified concurrently by the v2 classifier into ClassifyBatch calls, or
+		// ClassifyStream calls if stream is set. It is enabled by maxSize.
+		Batch struct {
+			// MaxSize is the most texts of a batch
+			MaxSize int `json:"maxSize"`
+			// WindowMillis is how long the first text of a batch waits for others, 20 by default
+			WindowMillis int  `json:"windowMillis"`
+			Stream       bool `json:"stream"`
+			// TimeoutSeconds bounds the call classifying a batch, 30 by default
+			TimeoutSeconds int `json:"timeoutSeconds"`
+		} `json:"batch"`
 	} `json:"grpcService"`
+	// LocalModel runs a model file in process to tell the rejections, instead of calling the classifier service
+	LocalModel struct {
+		// Path is the model file, the classifier service is used when empty
+		Path string `json:"path"`
+		// Threshold is the probability of the positive label a rejection needs, 0.5 by default
+		Threshold float64 `json:"threshold"`
+	} `json:"localModel"`
+}
+
+// Gmail is a Gmail mailbox, accessed with the OAuth credentials and token
+type Gmail struct {
+	Credentials string `json:"credentials"`
+	Token       string `json:"token"`
+	// UserID is the mailbox of the token polled, "me" (the authenticated user) by default, another address
+	// needs a token with delegated access to it
+	UserID string `json:"userId"`
+	// BackfillDays is how many days of messages the first poll processes, when there is no history yet
+	BackfillDays int `json:"backfillDays"`
+}
+
+// IMAP is a mailbox of another mail provider, accessed over IMAP
+type IMAP struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TLS      bool   `json:"tls"`
+	Mailbox  string `json:"mailbox"`
+	// LabelMode is "keyword" to set labels as IMAP keywords, or "folder" to copy messages into a folder per label
+	LabelMode     string `json:"labelMode"`
+	ArchiveFolder string `json:"archiveFolder"`
+	TrashFolder   string `json:"trashFolder"`
+	DraftsFolder  string `json:"draftsFolder"`
+}
+
+// Account is one of the mailboxes polled
+type Account struct {
+	// Name identifies the account in the logs, and in the names of its history, dedupe and dead-letter files
+	Name string `json:"name"`
+	// Gmail is the mailbox, its credentials default to the ones of the Gmail section
+	Gmail Gmail `json:"gmail"`
+	// IMAP is used instead of Gmail when its address is set
+	IMAP IMAP `json:"imap"`
+	// Handlers run on the messages of the account, the ones of the Handlers section without it
+	Handlers []Handler `json:"handlers"`
+}
+
+// Handler enables a handler on the messages it matches
+type Handler struct {
+	// Name names the handler in the logs, it is also the handler type when Type is not set
+	Name string `json:"name"`
+	// Type is the handler: "rejection" or "label"
+	Type  string `json:"type"`
+	Match struct {
+		SenderDomains []string `json:"senderDomains"`
+		SubjectRegex  string   `json:"subjectRegex"`
+		// LabelsPresent and LabelsAbsent are label names, or ids like "INBOX" or "UNREAD"
+		LabelsPresent []string `json:"labelsPresent"`
+		LabelsAbsent  []string `json:"labelsAbsent"`
+		HasAttachment *bool    `json:"hasAttachment"`
+		MinSizeBytes  int64    `json:"minSizeBytes"`
+		MaxSizeBytes  int64    `json:"maxSizeBytes"`
+	} `json:"match"`
+	// Options are specific to the handler type
+	Options json.RawMessage `json:"options"`
+	// Middleware overrides the values set of the Middleware section, for this handler
+	Middleware Middleware `json:"middleware"`
+}
+
+// Middleware wraps the handlers. A panic of a handler always fails the message instead of crashing the program.
+type Middleware struct {
+	// TimeoutSeconds bounds each run of the handler on a message, a timeout is retried. Not set, only the message
+	// timeout of the pipeline applies.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+	// MaxConcurrency bounds how many messages the handler processes at the same time, not set it is unbounded
+	MaxConcurrency int `json:"maxConcurrency"`
+	// Logging logs every run of the handler with the message id
+	Logging *bool `json:"logging"`
+	// Latency logs the mean and max latency of the handler after every poll
+	Latency *bool `json:"latency"`
 }
 
 func NewConfigFromFile(path string) (*Config, error) {
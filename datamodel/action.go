@@ -0,0 +1,106 @@
+package datamodel
+
+// ActionType is what an action does to a message
+type ActionType string
+
+// Actions the handlers can plan on a message
+const (
+	ActionAddLabel    ActionType = "addLabel"
+	ActionRemoveLabel ActionType = "removeLabel"
+	ActionArchive     ActionType = "archive"
+	ActionMarkRead    ActionType = "markRead"
+	ActionStar        ActionType = "star"
+	ActionTrash       ActionType = "trash"
+	ActionForward     ActionType = "forward"
+	ActionReplyDraft  ActionType = "replyDraft"
+)
+
+// Action is a change a handler plans on a message, it is applied by the executor of the message source
+type Action struct {
+	Type ActionType `json:"type"`
+	// Label is the name of the label added or removed
+	Label string `json:"label,omitempty"`
+	// To is the address the message is forwarded to
+	To string `json:"to,omitempty"`
+	// Body is the text of the reply draft
+	Body string `json:"body,omitempty"`
+	// Handler is the name of the handler planning the action
+	Handler string `json:"handler,omitempty"`
+	// Classification is the output of the classifier the handler decided with, if any
+	Classification *Classification `json:"classification,omitempty"`
+}
+
+// Classification is the output of a classifier on a message
+type Classification struct {
+	// Classifier names the classifier, like "rejection"
+	Classifier string `json:"classifier"`
+	// Positive is whether the message is of the class
+	Positive bool `json:"positive"`
+	// Label is the label the classifier chose, "Uncertain" when no label was probable enough
+	Label string `json:"label,omitempty"`
+	// Confidence is the probability of the label
+	Confidence float64 `json:"confidence,omitempty"`
+	// Model is the name and version of the model
+	Model string `json:"model,omitempty"`
+	// Text is the text of the message given to the classifier
+	Text string `json:"text,omitempty"`
+}
+
+// AddLabel adds the label to the message, the label is created if it does not exist
+func AddLabel(name string) Action {
+	return Action{Type: ActionAddLabel, Label: name}
+}
+
+// RemoveLabel removes the label from the message
+func RemoveLabel(name string) Action {
+	return Action{Type: ActionRemoveLabel, Label: name}
+}
+
+// Archive takes the message out of the inbox
+func Archive() Action {
+	return Action{Type: ActionArchive}
+}
+
+// MarkRead marks the message as read
+func MarkRead() Action {
+	return Action{Type: ActionMarkRead}
+}
+
+// Star stars the message
+func Star() Action {
+	return Action{Type: ActionStar}
+}
+
+// Trash moves the message to the trash
+func Trash() Action {
+	return Action{Type: ActionTrash}
+}
+
+// Forward forwards the message to the address
+func Forward(to string) Action {
+	return Action{Type: ActionForward, To: to}
+}
+
+// ReplyDraft saves a draft replying to the sender of the message with the body, for a human to review and send
+func ReplyDraft(body string) Action {
+	return Action{Type: ActionReplyDraft, Body: body}
+}
+
+// Plan is what is done to a message: the actions planned by all its handlers, merged
+type Plan struct {
+	MessageID    string   `json:"messageId"`
+	AddLabels    []string `json:"addLabels,omitempty"`
+	RemoveLabels []string `json:"removeLabels,omitempty"`
+	MarkRead     bool     `json:"markRead,omitempty"`
+	Archive      bool     `json:"archive,omitempty"`
+	Star         bool     `json:"star,omitempty"`
+	Trash        bool     `json:"trash,omitempty"`
+	ForwardTo    []string `json:"forwardTo,omitempty"`
+	ReplyDraft   string   `json:"replyDraft,omitempty"`
+}
+
+// Empty reports whether the plan does nothing to the message
+func (p Plan) Empty() bool {
+	return len(p.AddLabels) == 0 && len(p.RemoveLabels) == 0 && !p.MarkRead && !p.Archive && !p.Star && !p.Trash &&
+		len(p.ForwardTo) == 0 && p.ReplyDraft == ""
+}
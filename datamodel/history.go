@@ -0,0 +1,8 @@
+package datamodel
+
+// HistoryRecord is one change of a mailbox and the messages it added. The poll cursor can move to
+// HistoryID once all the messages of the record, and of the records before it, are handled.
+type HistoryRecord struct {
+	HistoryID  uint64
+	MessageIDs []string
+}
@@ -1,10 +1,156 @@
 package datamodel
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"time"
+)
+
 type Message struct {
-	ID      string
-	Subject string
-	From    string
-	To      string
-	Body    string
-	Payload []byte
+	ID           string
+	ThreadID     string
+	LabelIDs     []string
+	Subject      string
+	From         Address
+	To           []Address
+	Cc           []Address
+	Bcc          []Address
+	ReplyTo      []Address
+	Date         time.Time
+	MessageID    string
+	InReplyTo    string
+	References   []string
+	InternalDate time.Time
+	SizeEstimate int64
+	Headers      Header
+	Body         string
+	PlainBody    string
+	HTMLBody     string
+	Attachments  []Attachment
+	Payload      []byte
+}
+
+// HasAttachments reports whether the message has any attachment that is not inline
+func (m Message) HasAttachments() bool {
+	for _, a := range m.Attachments {
+		if !a.Inline() {
+			return true
+		}
+	}
+	return false
+}
+
+// Content dispositions of an attachment
+const (
+	DispositionAttachment = "attachment"
+	DispositionInline     = "inline"
+)
+
+// ErrAttachmentTooLarge is returned when an attachment is bigger than the size cap given to Open
+var ErrAttachmentTooLarge = errors.New("attachment exceeds the size cap")
+
+// AttachmentOpener opens the content of an attachment on demand, it is read as it is downloaded or decoded
+type AttachmentOpener func(ctx context.Context) (io.ReadCloser, error)
+
+// Attachment describes a file attached to a message, its content is only downloaded when opened
+type Attachment struct {
+	ID          string
+	PartID      string
+	Filename    string
+	MimeType    string
+	Size        int64
+	ContentID   string
+	Disposition string
+	Opener      AttachmentOpener `json:"-"`
+}
+
+// Inline reports whether the attachment is meant to be displayed inside the body, for example an embedded image
+func (a Attachment) Inline() bool {
+	return a.Disposition == DispositionInline
+}
+
+// Open opens the attachment content, refusing attachments bigger than maxSize bytes (no cap if maxSize <= 0).
+// An attachment known to be too big fails right away, otherwise reading fails with ErrAttachmentTooLarge once
+// more than maxSize bytes come, so the size given by the source does not need to be right.
+func (a Attachment) Open(ctx context.Context, maxSize int64) (io.ReadCloser, error) {
+	if a.Opener == nil {
+		return nil, fmt.Errorf("attachment %q has no content source", a.Filename)
+	}
+	if maxSize > 0 && a.Size > maxSize {
+		return nil, fmt.Errorf("attachment %q is %d bytes: %w", a.Filename, a.Size, ErrAttachmentTooLarge)
+	}
+	r, err := a.Opener(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download attachment %q: %w", a.Filename, err)
+	}
+	if maxSize <= 0 {
+		return r, nil
+	}
+	return &cappedReader{Reader: io.LimitReader(r, maxSize+1), closer: r, remaining: maxSize, filename: a.Filename}, nil
+}
+
+// cappedReader reads at most remaining bytes of the attachment, one more byte fails with ErrAttachmentTooLarge
+type cappedReader struct {
+	io.Reader
+	closer    io.Closer
+	remaining int64
+	filename  string
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		return n, fmt.Errorf("attachment %q is bigger than the cap: %w", c.filename, ErrAttachmentTooLarge)
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *cappedReader) Close() error {
+	return c.closer.Close()
+}
+
+// Address is a single mailbox from an address header, with any encoded-words decoded
+type Address struct {
+	Name  string
+	Email string
+}
+
+// String returns the address in the "Name <email>" form, or just the email when there is no name
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Email
+	}
+	return a.Name + " <" + a.Email + ">"
+}
+
+// Header holds all the message headers, keyed by the canonical header name
+type Header map[string][]string
+
+// Add appends the value to the header, the name is case-insensitive
+func (h Header) Add(name, value string) {
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	h[key] = append(h[key], value)
+}
+
+// Get returns the first value of the header, the name is case-insensitive
+func (h Header) Get(name string) string {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns all the values of the header, the name is case-insensitive
+func (h Header) Values(name string) []string {
+	if h == nil {
+		return nil
+	}
+	return h[textproto.CanonicalMIMEHeaderKey(name)]
 }
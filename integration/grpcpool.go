@@ -5,6 +5,7 @@ import (
 	sync "sync"
 	"time"
 
+	"github.com/jyouturer/gmail-ai/integration/classifierv2"
 	"github.com/jyouturer/gmail-ai/internal/logging"
 	"go.uber.org/zap"
 	grpc "google.golang.org/grpc"
@@ -12,6 +13,8 @@ import (
 
 type GRPCClient struct {
 	Client ClassifierClient
+	// V2 is the client of the classifier.v2 service, on the same connection
+	V2 classifierv2.ClassifierClient
 }
 
 type ConnectionPool struct {
@@ -36,6 +39,7 @@ func NewConnectionPool(address string, size int, timeout time.Duration) (*Connec
 
 		rc := &GRPCClient{
 			Client: client,
+			V2:     classifierv2.NewClassifierClient(conn),
 		}
 		logging.Logger.Info("Adding GRPCClient object to pool", zap.String("address", address), zap.Int("size", size), zap.Int("number", i))
 		pool <- rc
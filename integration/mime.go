@@ -0,0 +1,241 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// MessageBody is the text content of a message, the plain text and HTML alternatives are kept apart
+type MessageBody struct {
+	Plain string
+	HTML  string
+}
+
+// Text returns the readable text of the body, it prefers the plain text and falls back to the HTML converted to text
+func (b MessageBody) Text() string {
+	if strings.TrimSpace(b.Plain) != "" {
+		return b.Plain
+	}
+	if b.HTML != "" {
+		return HTMLToText(b.HTML)
+	}
+	return ""
+}
+
+// ExtractMessageBody walks the MIME tree of the message and returns its plain text and HTML bodies.
+// Attachments are skipped, multipart/alternative prefers its first plain text and HTML alternatives,
+// and the text parts of other multipart types are joined in order.
+func ExtractMessageBody(msg *gmail.Message) (MessageBody, error) {
+	if msg == nil || msg.Payload == nil {
+		return MessageBody{}, nil
+	}
+	return walkPart(msg.Payload, 0)
+}
+
+// MaxPartDepth guards against malformed messages with absurdly nested parts, the messages parsed from raw
+// RFC 822 are held to the same limit
+const MaxPartDepth = 32
+
+func walkPart(part *gmail.MessagePart, depth int) (MessageBody, error) {
+	if depth > MaxPartDepth {
+		return MessageBody{}, fmt.Errorf("MIME parts nested deeper than %d", MaxPartDepth)
+	}
+	mimeType := strings.ToLower(part.MimeType)
+	switch {
+	case mimeType == "multipart/alternative":
+		var body MessageBody
+		for _, p := range part.Parts {
+			alternative, err := walkPart(p, depth+1)
+			if err != nil {
+				return MessageBody{}, err
+			}
+			if body.Plain == "" {
+				body.Plain = alternative.Plain
+			}
+			if body.HTML == "" {
+				body.HTML = alternative.HTML
+			}
+		}
+		return body, nil
+	case strings.HasPrefix(mimeType, "multipart/"):
+		var plain, htmls []string
+		for _, p := range part.Parts {
+			child, err := walkPart(p, depth+1)
+			if err != nil {
+				return MessageBody{}, err
+			}
+			if child.Plain != "" {
+				plain = append(plain, child.Plain)
+			}
+			if child.HTML != "" {
+				htmls = append(htmls, child.HTML)
+			}
+		}
+		return MessageBody{Plain: strings.Join(plain, "\n\n"), HTML: strings.Join(htmls, "\n")}, nil
+	case IsAttachment(part):
+		return MessageBody{}, nil
+	case mimeType == "text/plain" || mimeType == "":
+		text, err := DecodePartText(part)
+		return MessageBody{Plain: text}, err
+	case mimeType == "text/html":
+		text, err := DecodePartText(part)
+		return MessageBody{HTML: text}, err
+	default:
+		logging.Logger.Debug("skipping non text part", zap.String("mimetype", part.MimeType))
+		return MessageBody{}, nil
+	}
+}
+
+// IsAttachment reports whether the part is an attachment rather than a body part
+func IsAttachment(part *gmail.MessagePart) bool {
+	if part.Filename != "" {
+		return true
+	}
+	disposition, _, err := mime.ParseMediaType(PartHeader(part, "Content-Disposition"))
+	return err == nil && disposition == "attachment"
+}
+
+// PartHeader returns the value of the named header of the part, the name is case-insensitive
+func PartHeader(part *gmail.MessagePart, name string) string {
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// DecodePartText decodes the body of a text part into a UTF-8 string. The Gmail API hands out the bodies with their
+// transfer encoding removed, even when the part still has its Content-Transfer-Encoding header, and the raw
+// messages are decoded the same way when they are parsed, so only the charset is left to decode.
+func DecodePartText(part *gmail.MessagePart) (string, error) {
+	if part.Body == nil || part.Body.Data == "" {
+		return "", nil
+	}
+	data, err := DecodeBase64URL(part.Body.Data)
+	if err != nil {
+		return "", err
+	}
+	_, params, _ := mime.ParseMediaType(PartHeader(part, "Content-Type"))
+	return DecodeCharset(params["charset"], data)
+}
+
+// DecodeBase64URL decodes the base64url data of the Gmail API, with or without padding
+func DecodeBase64URL(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// Base64URLReader decodes the base64url data of the Gmail API as it is read, with or without padding
+func Base64URLReader(data string) io.Reader {
+	return base64.NewDecoder(base64.RawURLEncoding, strings.NewReader(strings.TrimRight(data, "=")))
+}
+
+// DecodeCharset converts the data in the given charset to a UTF-8 string
+func DecodeCharset(charset string, data []byte) (string, error) {
+	r, err := CharsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		logging.Logger.Warn("unknown charset, keeping the text as is", zap.String("charset", charset))
+		return string(data), nil
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode %s text: %w", charset, err)
+	}
+	return string(decoded), nil
+}
+
+// CharsetReader returns a reader converting the input from the given charset to UTF-8.
+// It can be used as the CharsetReader of mime.WordDecoder.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	charset = strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"`))
+	if charset == "" || charset == "utf-8" || charset == "utf8" || charset == "us-ascii" {
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q: %w", charset, err)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// blockElements are the HTML elements that start a new line in the text
+var blockElements = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true, "div": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "li": true, "ol": true, "p": true, "pre": true, "section": true, "table": true,
+	"tr": true, "ul": true,
+}
+
+// skippedElements are the HTML elements whose content is not readable text
+var skippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true,
+}
+
+// HTMLToText converts HTML into readable text, keeping the paragraph breaks
+func HTMLToText(source string) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(strings.NewReader(source))
+	skipping := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return collapseBlankLines(sb.String())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if skippedElements[tag] {
+				skipping++
+			}
+			if blockElements[tag] {
+				sb.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if skippedElements[tag] && skipping > 0 {
+				skipping--
+			}
+			if blockElements[tag] {
+				sb.WriteString("\n")
+			}
+		case html.TextToken:
+			if skipping == 0 {
+				sb.WriteString(whitespace.ReplaceAllString(string(z.Text()), " "))
+			}
+		}
+	}
+}
+
+// whitespace matches runs of white space inside an HTML text node
+var whitespace = regexp.MustCompile(`\s+`)
+
+// collapseBlankLines trims every line and keeps at most one blank line between paragraphs
+func collapseBlankLines(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
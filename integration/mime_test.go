@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/japanese"
+	"google.golang.org/api/gmail/v1"
+)
+
+func textPart(mimeType, charset, transferEncoding string, data []byte) *gmail.MessagePart {
+	part := &gmail.MessagePart{
+		MimeType: mimeType,
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-Type", Value: mimeType + "; charset=\"" + charset + "\""},
+		},
+		Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(data)},
+	}
+	if transferEncoding != "" {
+		part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: "content-transfer-encoding", Value: transferEncoding})
+	}
+	return part
+}
+
+func TestExtractMessageBodyNested(t *testing.T) {
+	// mixed[related[alternative[plain, html], image], pdf attachment]
+	msg := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{
+					MimeType: "multipart/related",
+					Parts: []*gmail.MessagePart{
+						{
+							MimeType: "multipart/alternative",
+							Parts: []*gmail.MessagePart{
+								textPart("text/plain", "utf-8", "", []byte("We have decided to move forward with other candidates.")),
+								textPart("text/html", "utf-8", "", []byte("<p>We have decided to move forward with <b>other</b> candidates.</p>")),
+							},
+						},
+						{
+							MimeType: "image/png",
+							Filename: "logo.png",
+							Headers:  []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: "inline; filename=logo.png"}},
+							Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte{0x89, 'P', 'N', 'G'})},
+						},
+					},
+				},
+				{
+					MimeType: "application/pdf",
+					Filename: "offer.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "att1"},
+				},
+			},
+		},
+	}
+
+	body, err := ExtractMessageBody(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "We have decided to move forward with other candidates.", body.Plain)
+	assert.Equal(t, "<p>We have decided to move forward with <b>other</b> candidates.</p>", body.HTML)
+	assert.Equal(t, body.Plain, body.Text())
+}
+
+func TestExtractMessageBodyHTMLFallback(t *testing.T) {
+	html := `<html><head><title>ignored</title><style>p { color: red; }</style></head>
+<body><div>Dear Jane,</div><p>Unfortunately we&#39;ve  decided
+ to move forward &amp; wish you luck.</p><script>var x = 1;</script>Regards<br>Talent Team</body></html>`
+	msg := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/alternative",
+			Parts:    []*gmail.MessagePart{textPart("text/html", "utf-8", "", []byte(html))},
+		},
+	}
+
+	body, err := ExtractMessageBody(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "", body.Plain)
+	assert.Equal(t, "Dear Jane,\n\nUnfortunately we've decided to move forward & wish you luck.\nRegards\nTalent Team", body.Text())
+}
+
+func TestExtractMessageBodyEncodings(t *testing.T) {
+	sjis, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("選考結果のお知らせ"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		part *gmail.MessagePart
+		want string
+	}{
+		{
+			// the API removes the transfer encoding but keeps its header
+			name: "decoded quoted-printable windows-1252",
+			part: textPart("text/plain", "windows-1252", "quoted-printable", []byte("Caf\xe9 na\xefve \x93quoted\x94")),
+			want: "Café naïve “quoted”",
+		},
+		{
+			name: "decoded quoted-printable with escapes in the text",
+			part: textPart("text/plain", "utf-8", "quoted-printable", []byte("See https://jobs.example/status?a=3Db&x=20 for a literal =20")),
+			want: "See https://jobs.example/status?a=3Db&x=20 for a literal =20",
+		},
+		{
+			name: "iso-8859-1",
+			part: textPart("text/plain", "ISO-8859-1", "8bit", []byte("Se\xf1or")),
+			want: "Señor",
+		},
+		{
+			name: "shift_jis",
+			part: textPart("text/plain", "Shift_JIS", "base64", sjis),
+			want: "選考結果のお知らせ",
+		},
+		{
+			name: "already decoded quoted-printable",
+			part: textPart("text/plain", "utf-8", "quoted-printable", []byte("a = b")),
+			want: "a = b",
+		},
+		{
+			name: "unknown charset",
+			part: textPart("text/plain", "x-unknown", "", []byte("plain text")),
+			want: "plain text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := ExtractMessageBody(&gmail.Message{Payload: tt.part})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, body.Text())
+		})
+	}
+}
+
+func TestDecodeBase64URLWithoutPadding(t *testing.T) {
+	data, err := DecodeBase64URL(base64.RawURLEncoding.EncodeToString([]byte("no padding?>")))
+	assert.NoError(t, err)
+	assert.Equal(t, "no padding?>", string(data))
+}
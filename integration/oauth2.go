@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 
 	"golang.org/x/oauth2"
@@ -24,29 +23,35 @@ func GetTokenFromJSON(path string, config *oauth2.Config) (*oauth2.Token, error)
 }
 
 // SaveTokenToJSON saves a token to a file path
-func SaveTokenToJSON(path string, token *oauth2.Token) {
+func SaveTokenToJSON(path string, token *oauth2.Token) error {
 	tokenFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache OAuth token: %v", err)
+		return fmt.Errorf("unable to cache OAuth token: %w", err)
 	}
-	defer tokenFile.Close()
-
-	json.NewEncoder(tokenFile).Encode(token)
+	if err := json.NewEncoder(tokenFile).Encode(token); err != nil {
+		tokenFile.Close()
+		return fmt.Errorf("unable to cache OAuth token: %w", err)
+	}
+	if err := tokenFile.Close(); err != nil {
+		return fmt.Errorf("unable to cache OAuth token: %w", err)
+	}
+	return nil
 }
 
-// RequestNewToken requests a new token from the user
-func RequestNewToken(config *oauth2.Config) *oauth2.Token {
+// RequestNewToken requests a new token from the user, who is asked to open the authorization link and type the
+// code it gives
+func RequestNewToken(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
 
 	var authCode string
 	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+		return nil, fmt.Errorf("unable to read authorization code: %w", err)
 	}
 
-	token, err := config.Exchange(context.Background(), authCode)
+	token, err := config.Exchange(ctx, authCode)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
 	}
-	return token
+	return token, nil
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/jyouturer/gmail-ai/activity"
 	"github.com/jyouturer/gmail-ai/integration"
 	"github.com/jyouturer/gmail-ai/messagesource"
+	"github.com/jyouturer/gmail-ai/polling"
 )
 
 func TestRejection(t *testing.T) {
@@ -68,11 +69,15 @@ func TestHandleRejection(t *testing.T) {
 	}
 
 	// Create the client to call gRPC of the rejection classifier
-	h := activity.NewRejectionEmail(gmailService.Gmail, &rc)
+	h := activity.NewRejectionEmail(&rc)
 
 	// Implement the HandleRejection method of the EmailHandlerFunc interface
-	err = h.Process(context.Background(), msg)
+	actions, err := h.Process(context.Background(), msg)
 	if err != nil {
 		t.Errorf("Error handling rejection: %v", err)
 	}
+	// apply the actions planned, as the poll does
+	if err := gmailService.Execute(context.Background(), polling.MergeActions(msg.ID, actions)); err != nil {
+		t.Errorf("Error applying actions: %v", err)
+	}
 }
@@ -0,0 +1,95 @@
+package textmodel
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Example is a text with its label
+type Example struct {
+	Text  string `json:"text"`
+	Label string `json:"label"`
+}
+
+// ReadCSV reads the examples of a CSV with a header, the columns "text" and "label" are used
+func ReadCSV(r io.Reader) ([]Example, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CSV: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("CSV has no header")
+	}
+	text, label := -1, -1
+	for i, name := range rows[0] {
+		switch name {
+		case "text":
+			text = i
+		case "label":
+			label = i
+		}
+	}
+	if text < 0 || label < 0 {
+		return nil, fmt.Errorf("CSV has no text or label column: %v", rows[0])
+	}
+	examples := make([]Example, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		examples = append(examples, Example{Text: row[text], Label: row[label]})
+	}
+	return examples, nil
+}
+
+// ReadJSONL reads the examples of JSON lines like {"text": "...", "label": "..."}, the blank lines are skipped
+func ReadJSONL(r io.Reader) ([]Example, error) {
+	var examples []Example
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var e Example
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("unable to read example at line %d: %w", n, err)
+		}
+		examples = append(examples, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read JSON lines: %w", err)
+	}
+	return examples, nil
+}
+
+// ReadExamplesFile reads the examples of the file, as JSON lines if it ends with .jsonl or .json, else as CSV
+func ReadExamplesFile(path string) ([]Example, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open examples: %w", err)
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return ReadJSONL(f)
+	default:
+		return ReadCSV(f)
+	}
+}
+
+// Hash returns the SHA-256 of the examples, in their order, to tell which data a model was trained on
+func Hash(examples []Example) string {
+	h := sha256.New()
+	for _, e := range examples {
+		// the lengths keep the texts and labels apart whatever they contain
+		fmt.Fprintf(h, "%d:%s%d:%s", len(e.Text), e.Text, len(e.Label), e.Label)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,47 @@
+package textmodel
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// LogisticRegression gives the probability of the positive label from the TF-IDF vector of a text
+type LogisticRegression struct {
+	Weights []float64 `json:"weights"`
+	Bias    float64   `json:"bias"`
+}
+
+// fitLogisticRegression fits the regression by gradient descent on the rows of x, y is 1 for the positive rows.
+// The weights are penalized by 1/(c*n), like scikit-learn does with the inverse regularization strength c.
+func fitLogisticRegression(x *mat.Dense, y []float64, c float64, iterations int, learningRate float64) *LogisticRegression {
+	n, d := x.Dims()
+	lambda := 1 / (c * float64(n))
+	w := mat.NewVecDense(d, nil)
+	var b float64
+	z := mat.NewVecDense(n, nil)
+	residual := make([]float64, n)
+	grad := mat.NewVecDense(d, nil)
+	for it := 0; it < iterations; it++ {
+		z.MulVec(x, w)
+		for i := range residual {
+			residual[i] = sigmoid(z.AtVec(i)+b) - y[i]
+		}
+		grad.MulVec(x.T(), mat.NewVecDense(n, residual))
+		// the gradient of the mean loss, plus the penalty
+		grad.AddScaledVec(grad, lambda*float64(n), w)
+		w.AddScaledVec(w, -learningRate/float64(n), grad)
+		b -= learningRate * floats.Sum(residual) / float64(n)
+	}
+	return &LogisticRegression{Weights: w.RawVector().Data, Bias: b}
+}
+
+// probability returns the probability of the positive label
+func (l *LogisticRegression) probability(x *mat.VecDense) float64 {
+	return sigmoid(floats.Dot(l.Weights, x.RawVector().Data) + l.Bias)
+}
+
+func sigmoid(z float64) float64 {
+	return 1 / (1 + math.Exp(-z))
+}
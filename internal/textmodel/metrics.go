@@ -0,0 +1,117 @@
+package textmodel
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Confusion counts the predictions of a classifier by whether they were right
+type Confusion struct {
+	TruePositives  int `json:"truePositives"`
+	FalsePositives int `json:"falsePositives"`
+	TrueNegatives  int `json:"trueNegatives"`
+	FalseNegatives int `json:"falseNegatives"`
+}
+
+// Add counts a prediction
+func (c *Confusion) Add(actual, predicted bool) {
+	switch {
+	case actual && predicted:
+		c.TruePositives++
+	case actual:
+		c.FalseNegatives++
+	case predicted:
+		c.FalsePositives++
+	default:
+		c.TrueNegatives++
+	}
+}
+
+// Merge adds the counts of other
+func (c *Confusion) Merge(other Confusion) {
+	c.TruePositives += other.TruePositives
+	c.FalsePositives += other.FalsePositives
+	c.TrueNegatives += other.TrueNegatives
+	c.FalseNegatives += other.FalseNegatives
+}
+
+// Total is the number of predictions
+func (c Confusion) Total() int {
+	return c.TruePositives + c.FalsePositives + c.TrueNegatives + c.FalseNegatives
+}
+
+// Metrics are the scores of a classifier on labeled examples
+type Metrics struct {
+	Accuracy  float64   `json:"accuracy"`
+	Precision float64   `json:"precision"`
+	Recall    float64   `json:"recall"`
+	F1        float64   `json:"f1"`
+	Confusion Confusion `json:"confusion"`
+}
+
+// Metrics returns the scores of the predictions counted, a score without prediction to tell it is 0
+func (c Confusion) Metrics() Metrics {
+	m := Metrics{Confusion: c}
+	m.Accuracy = ratio(c.TruePositives+c.TrueNegatives, c.Total())
+	m.Precision = ratio(c.TruePositives, c.TruePositives+c.FalsePositives)
+	m.Recall = ratio(c.TruePositives, c.TruePositives+c.FalseNegatives)
+	if m.Precision+m.Recall > 0 {
+		m.F1 = 2 * m.Precision * m.Recall / (m.Precision + m.Recall)
+	}
+	return m
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Evaluate scores the model on the examples, a text is positive when its probability reaches the threshold
+func (m *Model) Evaluate(examples []Example, threshold float64) Metrics {
+	var c Confusion
+	for _, e := range examples {
+		c.Add(e.Label == m.Options.PositiveLabel, m.Probability(e.Text) >= threshold)
+	}
+	return c.Metrics()
+}
+
+// CrossValidation is how models trained with the same options score on the examples they were not trained on
+type CrossValidation struct {
+	Folds int   `json:"folds"`
+	Seed  int64 `json:"seed"`
+	// Metrics are the scores of all the folds together, FoldMetrics the scores of each fold
+	Metrics     Metrics   `json:"metrics"`
+	FoldMetrics []Metrics `json:"foldMetrics"`
+}
+
+// CrossValidate shuffles the examples with the seed and splits them into folds, then scores a model trained on the
+// other folds on each fold, at a threshold of 0.5. The same examples, options and seed give the same scores.
+func CrossValidate(examples []Example, options Options, folds int, seed int64) (*CrossValidation, error) {
+	if folds < 2 || folds > len(examples) {
+		return nil, fmt.Errorf("cannot split %d examples into %d folds", len(examples), folds)
+	}
+	order := rand.New(rand.NewSource(seed)).Perm(len(examples))
+	cv := &CrossValidation{Folds: folds, Seed: seed}
+	var all Confusion
+	for k := 0; k < folds; k++ {
+		var train, test []Example
+		for i, j := range order {
+			if i%folds == k {
+				test = append(test, examples[j])
+			} else {
+				train = append(train, examples[j])
+			}
+		}
+		m, err := Train(train, options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to train fold %d: %w", k+1, err)
+		}
+		metrics := m.Evaluate(test, 0.5)
+		cv.FoldMetrics = append(cv.FoldMetrics, metrics)
+		all.Merge(metrics.Confusion)
+	}
+	cv.Metrics = all.Metrics()
+	return cv, nil
+}
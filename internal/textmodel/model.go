@@ -0,0 +1,269 @@
+// Package textmodel trains and runs the text classifiers telling whether a text has the positive label, like the
+// rejections: a TF-IDF vectorizer followed by a logistic regression or a naive Bayes.
+package textmodel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FormatVersion is the version of the model files written, a newer version cannot be loaded
+const FormatVersion = 1
+
+// The algorithms classifying the TF-IDF vectors
+const (
+	LogisticRegressionAlgorithm = "logistic"
+	NaiveBayesAlgorithm         = "naivebayes"
+)
+
+// Options are the hyperparameters of a model
+type Options struct {
+	// Algorithm is LogisticRegressionAlgorithm (the default) or NaiveBayesAlgorithm
+	Algorithm string `json:"algorithm"`
+	// PositiveLabel is the label the model gives the probability of, every other label is negative
+	PositiveLabel string `json:"positiveLabel"`
+	// NegativeLabel is the label of the texts which are not positive, "not_" + PositiveLabel if empty
+	NegativeLabel string `json:"negativeLabel"`
+	// NGrams is 2 to also use the pairs of consecutive words as terms, 1 by default
+	NGrams int `json:"ngrams"`
+	// MinDF drops the terms found in fewer texts, 1 by default
+	MinDF int `json:"minDF"`
+	// C is the inverse of the regularization of the logistic regression, 1 by default
+	C float64 `json:"c,omitempty"`
+	// Iterations of the gradient descent of the logistic regression, 1000 by default
+	Iterations int `json:"iterations,omitempty"`
+	// LearningRate of the gradient descent of the logistic regression, 2 by default
+	LearningRate float64 `json:"learningRate,omitempty"`
+	// Alpha smooths the naive Bayes, 1 by default
+	Alpha float64 `json:"alpha,omitempty"`
+}
+
+// withDefaults returns the options with the defaults set
+func (o Options) withDefaults() Options {
+	if o.Algorithm == "" {
+		o.Algorithm = LogisticRegressionAlgorithm
+	}
+	if o.NegativeLabel == "" {
+		o.NegativeLabel = "not_" + o.PositiveLabel
+	}
+	if o.NGrams == 0 {
+		o.NGrams = 1
+	}
+	if o.MinDF == 0 {
+		o.MinDF = 1
+	}
+	switch o.Algorithm {
+	case LogisticRegressionAlgorithm:
+		if o.C == 0 {
+			o.C = 1
+		}
+		if o.Iterations == 0 {
+			o.Iterations = 1000
+		}
+		if o.LearningRate == 0 {
+			o.LearningRate = 2
+		}
+	case NaiveBayesAlgorithm:
+		if o.Alpha == 0 {
+			o.Alpha = 1
+		}
+	}
+	return o
+}
+
+// Model is a trained classifier, as saved in a model file
+type Model struct {
+	FormatVersion int        `json:"formatVersion"`
+	Options       Options    `json:"options"`
+	Vectorizer    Vectorizer `json:"vectorizer"`
+	// one of the classifiers is set, the one of the algorithm of the options
+	LogisticRegression *LogisticRegression `json:"logisticRegression,omitempty"`
+	NaiveBayes         *NaiveBayes         `json:"naiveBayes,omitempty"`
+	Metadata           Metadata            `json:"metadata"`
+}
+
+// Metadata tells how a model was trained, and how well it scored
+type Metadata struct {
+	// Version is given when training, or derived from the examples and the options
+	Version string `json:"version,omitempty"`
+	// DataHash is the Hash of the examples the model was trained on, after their preprocessing
+	DataHash  string `json:"dataHash,omitempty"`
+	Examples  int    `json:"examples"`
+	Positives int    `json:"positives"`
+	// Preprocessing names how the texts were prepared before training, they should be prepared the same way
+	// before being classified
+	Preprocessing string `json:"preprocessing,omitempty"`
+	// TrainingMetrics are the scores of the model on the examples it was trained on
+	TrainingMetrics Metrics          `json:"trainingMetrics"`
+	CrossValidation *CrossValidation `json:"crossValidation,omitempty"`
+}
+
+// FitOptions are how a model is validated and versioned
+type FitOptions struct {
+	// Folds of the cross-validation, none is done if 0
+	Folds int
+	// Seed shuffles the examples before they are split into folds
+	Seed int64
+	// Version of the model, derived from the examples, options and seed if empty
+	Version string
+	// Preprocessing is kept in the metadata
+	Preprocessing string
+}
+
+// Train fits a model on the examples, the examples with the positive label of the options are positive, all the
+// others are negative. The same examples and options give the same model.
+func Train(examples []Example, options Options) (*Model, error) {
+	options = options.withDefaults()
+	if options.PositiveLabel == "" {
+		return nil, fmt.Errorf("the positive label is not set")
+	}
+	texts := make([]string, len(examples))
+	y := make([]float64, len(examples))
+	var positives int
+	for i, e := range examples {
+		texts[i] = e.Text
+		if e.Label == options.PositiveLabel {
+			y[i] = 1
+			positives++
+		}
+	}
+	if positives == 0 || positives == len(examples) {
+		return nil, fmt.Errorf("training needs examples with and without the label %q, got %d of %d", options.PositiveLabel, positives, len(examples))
+	}
+
+	m := &Model{FormatVersion: FormatVersion, Options: options}
+	m.Vectorizer = *FitVectorizer(texts, options.NGrams, options.MinDF)
+	if len(m.Vectorizer.IDF) == 0 {
+		return nil, fmt.Errorf("no term is found in at least %d examples", options.MinDF)
+	}
+	x := m.Vectorizer.TransformAll(texts)
+	switch options.Algorithm {
+	case LogisticRegressionAlgorithm:
+		m.LogisticRegression = fitLogisticRegression(x, y, options.C, options.Iterations, options.LearningRate)
+	case NaiveBayesAlgorithm:
+		m.NaiveBayes = fitNaiveBayes(x, y, options.Alpha)
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q, it is %s or %s", options.Algorithm, LogisticRegressionAlgorithm, NaiveBayesAlgorithm)
+	}
+	return m, nil
+}
+
+// Fit cross-validates the options on the examples, then trains the model on all of them and records its metadata.
+// The same examples, options and fit options give the same model.
+func Fit(examples []Example, options Options, fit FitOptions) (*Model, error) {
+	m, err := Train(examples, options)
+	if err != nil {
+		return nil, err
+	}
+	m.Metadata = Metadata{
+		Version:         fit.Version,
+		DataHash:        Hash(examples),
+		Examples:        len(examples),
+		Preprocessing:   fit.Preprocessing,
+		TrainingMetrics: m.Evaluate(examples, 0.5),
+	}
+	for _, e := range examples {
+		if e.Label == m.Options.PositiveLabel {
+			m.Metadata.Positives++
+		}
+	}
+	if fit.Folds > 0 {
+		if m.Metadata.CrossValidation, err = CrossValidate(examples, options, fit.Folds, fit.Seed); err != nil {
+			return nil, err
+		}
+	}
+	if m.Metadata.Version == "" {
+		options, err := json.Marshal(m.Options)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s %s %d", m.Metadata.DataHash, options, fit.Seed)))
+		m.Metadata.Version = hex.EncodeToString(sum[:6])
+	}
+	return m, nil
+}
+
+// Probability returns the probability that the text has the positive label
+func (m *Model) Probability(text string) float64 {
+	x := m.Vectorizer.Transform(text)
+	if m.NaiveBayes != nil {
+		return m.NaiveBayes.probability(x)
+	}
+	return m.LogisticRegression.probability(x)
+}
+
+// Predict returns the label of the text, positive when its probability reaches the threshold, and the probability
+// of the label
+func (m *Model) Predict(text string, threshold float64) (string, float64) {
+	p := m.Probability(text)
+	if p >= threshold {
+		return m.Options.PositiveLabel, p
+	}
+	return m.Options.NegativeLabel, 1 - p
+}
+
+// Name is the name of the algorithm of the model and its version if any, like "tfidf-logistic@3f2a9c1b0d4e"
+func (m *Model) Name() string {
+	name := "tfidf-" + m.Options.Algorithm
+	if m.Metadata.Version != "" {
+		name += "@" + m.Metadata.Version
+	}
+	return name
+}
+
+// Save writes the model as JSON
+func (m *Model) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(m); err != nil {
+		return fmt.Errorf("unable to write model: %w", err)
+	}
+	return nil
+}
+
+// SaveFile writes the model to the file
+func (m *Model) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create model file: %w", err)
+	}
+	if err := m.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load reads a model written by Save
+func Load(r io.Reader) (*Model, error) {
+	var m Model
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("unable to read model: %w", err)
+	}
+	if m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("model format %d is newer than the supported format %d", m.FormatVersion, FormatVersion)
+	}
+	if (m.LogisticRegression == nil) == (m.NaiveBayes == nil) {
+		return nil, fmt.Errorf("model has no classifier, or more than one")
+	}
+	d := len(m.Vectorizer.IDF)
+	if d == 0 || len(m.Vectorizer.Vocabulary) != d ||
+		(m.LogisticRegression != nil && len(m.LogisticRegression.Weights) != d) ||
+		(m.NaiveBayes != nil && (len(m.NaiveBayes.LogLikelihoods[0]) != d || len(m.NaiveBayes.LogLikelihoods[1]) != d)) {
+		return nil, fmt.Errorf("model has %d terms but its classifier does not match them", d)
+	}
+	return &m, nil
+}
+
+// LoadFile reads the model file
+func LoadFile(path string) (*Model, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open model file: %w", err)
+	}
+	defer f.Close()
+	return Load(f)
+}
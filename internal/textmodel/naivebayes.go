@@ -0,0 +1,47 @@
+package textmodel
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// NaiveBayes is a multinomial naive Bayes on the TF-IDF vectors, index 0 is the negative label and 1 the positive
+type NaiveBayes struct {
+	LogPriors      [2]float64   `json:"logPriors"`
+	LogLikelihoods [2][]float64 `json:"logLikelihoods"`
+}
+
+// fitNaiveBayes counts the weight of the terms in the rows of each label, smoothed by alpha
+func fitNaiveBayes(x *mat.Dense, y []float64, alpha float64) *NaiveBayes {
+	n, d := x.Dims()
+	nb := &NaiveBayes{}
+	var counts [2][]float64
+	var rows [2]float64
+	for c := range counts {
+		counts[c] = make([]float64, d)
+	}
+	for i := 0; i < n; i++ {
+		c := int(y[i])
+		rows[c]++
+		floats.Add(counts[c], x.RawRowView(i))
+	}
+	for c := range counts {
+		// a label without rows is never chosen
+		nb.LogPriors[c] = math.Log(rows[c] / float64(n))
+		total := floats.Sum(counts[c]) + alpha*float64(d)
+		nb.LogLikelihoods[c] = make([]float64, d)
+		for j, count := range counts[c] {
+			nb.LogLikelihoods[c][j] = math.Log((count + alpha) / total)
+		}
+	}
+	return nb
+}
+
+// probability returns the probability of the positive label
+func (nb *NaiveBayes) probability(x *mat.VecDense) float64 {
+	negative := nb.LogPriors[0] + floats.Dot(nb.LogLikelihoods[0], x.RawVector().Data)
+	positive := nb.LogPriors[1] + floats.Dot(nb.LogLikelihoods[1], x.RawVector().Data)
+	return 1 / (1 + math.Exp(negative-positive))
+}
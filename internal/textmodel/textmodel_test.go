@@ -0,0 +1,186 @@
+package textmodel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const rejectionsCSV = "../../classifier/job_application_rejections.csv"
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"we", "regret", "to", "inform", "you", "2nd", "café"}, Tokenize("We regret to inform you: a 2nd café!"))
+}
+
+func TestVectorizer(t *testing.T) {
+	v := FitVectorizer([]string{"no thanks", "thanks a lot", "thanks"}, 2, 1)
+	assert.Equal(t, map[string]int{"lot": 0, "no": 1, "no thanks": 2, "thanks": 3, "thanks lot": 4}, v.Vocabulary)
+
+	x := v.Transform("thanks, thanks and thanks")
+	// the terms out of the vocabulary are ignored, the vector has a length of 1
+	assert.Equal(t, []float64{0, 0, 0, 1, 0}, x.RawVector().Data)
+	// the rare terms weigh more
+	x = v.Transform("no thanks")
+	assert.Greater(t, x.AtVec(1), x.AtVec(3))
+}
+
+// accuracy returns the share of the examples the model gives the right label, the labels other than the positive
+// one are all negative
+func accuracy(m *Model, examples []Example) float64 {
+	correct := 0
+	for _, e := range examples {
+		label, _ := m.Predict(e.Text, 0.5)
+		if (label == m.Options.PositiveLabel) == (e.Label == m.Options.PositiveLabel) {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(examples))
+}
+
+func TestTrainAccuracy(t *testing.T) {
+	examples, err := ReadExamplesFile(rejectionsCSV)
+	assert.NoError(t, err)
+	assert.Len(t, examples, 77)
+
+	for _, algorithm := range []string{LogisticRegressionAlgorithm, NaiveBayesAlgorithm} {
+		t.Run(algorithm, func(t *testing.T) {
+			options := Options{Algorithm: algorithm, PositiveLabel: "reject"}
+			// every example is predicted by a model which was not trained on it
+			const folds = 5
+			correct := 0.0
+			for k := 0; k < folds; k++ {
+				var train, test []Example
+				for i, e := range examples {
+					if i%folds == k {
+						test = append(test, e)
+					} else {
+						train = append(train, e)
+					}
+				}
+				m, err := Train(train, options)
+				assert.NoError(t, err)
+				correct += accuracy(m, test) * float64(len(test))
+			}
+			assert.GreaterOrEqual(t, correct/float64(len(examples)), 0.9)
+
+			m, err := Train(examples, options)
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, accuracy(m, examples), 0.95)
+			label, p := m.Predict("Unfortunately, we have decided to move forward with other candidates.", 0.5)
+			assert.Equal(t, "reject", label)
+			assert.Greater(t, p, 0.5)
+			assert.Equal(t, "tfidf-"+algorithm, m.Name())
+
+			// the same examples give the same model
+			again, err := Train(examples, options)
+			assert.NoError(t, err)
+			assert.Equal(t, m, again)
+		})
+	}
+}
+
+func TestTrainErrors(t *testing.T) {
+	_, err := Train([]Example{{"no", "reject"}}, Options{})
+	assert.ErrorContains(t, err, "positive label")
+	_, err = Train([]Example{{"no", "reject"}, {"no way", "reject"}}, Options{PositiveLabel: "reject"})
+	assert.ErrorContains(t, err, "with and without")
+	_, err = Train([]Example{{"no", "reject"}, {"ok", "accept"}}, Options{PositiveLabel: "reject", Algorithm: "svm"})
+	assert.ErrorContains(t, err, "unknown algorithm")
+}
+
+func TestSaveLoad(t *testing.T) {
+	examples, err := ReadExamplesFile(rejectionsCSV)
+	assert.NoError(t, err)
+	for _, algorithm := range []string{LogisticRegressionAlgorithm, NaiveBayesAlgorithm} {
+		m, err := Train(examples, Options{Algorithm: algorithm, PositiveLabel: "reject"})
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		assert.NoError(t, m.Save(&buf))
+
+		loaded, err := Load(&buf)
+		assert.NoError(t, err)
+		for _, e := range examples {
+			assert.InDelta(t, m.Probability(e.Text), loaded.Probability(e.Text), 1e-12)
+		}
+	}
+
+	_, err = Load(strings.NewReader(`{"formatVersion": 99}`))
+	assert.ErrorContains(t, err, "newer")
+	_, err = Load(strings.NewReader(`{"formatVersion": 1}`))
+	assert.ErrorContains(t, err, "no classifier")
+	_, err = Load(strings.NewReader(`{"formatVersion": 1, "vectorizer": {"vocabulary": {"no": 0}, "idf": [1]}, "logisticRegression": {"weights": [1, 2]}}`))
+	assert.ErrorContains(t, err, "does not match")
+}
+
+func TestReadJSONL(t *testing.T) {
+	examples, err := ReadJSONL(strings.NewReader("{\"text\": \"no\", \"label\": \"reject\"}\n\n{\"text\": \"yes\", \"label\": \"accept\"}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Example{{"no", "reject"}, {"yes", "accept"}}, examples)
+	_, err = ReadJSONL(strings.NewReader("{\"text\": \"no\"}\nnot json\n"))
+	assert.ErrorContains(t, err, "line 2")
+
+	// the hash tells the texts and labels apart
+	assert.NotEqual(t, Hash([]Example{{"ab", "c"}}), Hash([]Example{{"a", "bc"}}))
+	assert.Equal(t, Hash(examples), Hash([]Example{{"no", "reject"}, {"yes", "accept"}}))
+}
+
+func TestMetrics(t *testing.T) {
+	var c Confusion
+	for _, p := range [][2]bool{{true, true}, {true, true}, {true, false}, {false, true}, {false, false}} {
+		c.Add(p[0], p[1])
+	}
+	m := c.Metrics()
+	assert.Equal(t, Confusion{TruePositives: 2, FalseNegatives: 1, FalsePositives: 1, TrueNegatives: 1}, m.Confusion)
+	assert.InDelta(t, 0.6, m.Accuracy, 1e-9)
+	assert.InDelta(t, 2.0/3, m.Precision, 1e-9)
+	assert.InDelta(t, 2.0/3, m.Recall, 1e-9)
+	assert.InDelta(t, 2.0/3, m.F1, 1e-9)
+	// nothing predicted scores 0 instead of NaN
+	assert.Equal(t, Metrics{}, Confusion{}.Metrics())
+}
+
+func TestFit(t *testing.T) {
+	examples, err := ReadExamplesFile(rejectionsCSV)
+	assert.NoError(t, err)
+	options := Options{PositiveLabel: "reject"}
+
+	m, err := Fit(examples, options, FitOptions{Folds: 5, Seed: 1, Preprocessing: "none"})
+	assert.NoError(t, err)
+	meta := m.Metadata
+	assert.Equal(t, 77, meta.Examples)
+	assert.Equal(t, 53, meta.Positives)
+	assert.Equal(t, Hash(examples), meta.DataHash)
+	assert.Equal(t, "none", meta.Preprocessing)
+	assert.Len(t, meta.Version, 12)
+	assert.Equal(t, "tfidf-logistic@"+meta.Version, m.Name())
+	assert.GreaterOrEqual(t, meta.TrainingMetrics.Accuracy, 0.95)
+	if assert.NotNil(t, meta.CrossValidation) {
+		assert.Len(t, meta.CrossValidation.FoldMetrics, 5)
+		assert.Equal(t, 77, meta.CrossValidation.Metrics.Confusion.Total())
+		assert.GreaterOrEqual(t, meta.CrossValidation.Metrics.Accuracy, 0.85)
+	}
+
+	// the same seed gives the same model, file included
+	again, err := Fit(examples, options, FitOptions{Folds: 5, Seed: 1, Preprocessing: "none"})
+	assert.NoError(t, err)
+	var first, second bytes.Buffer
+	assert.NoError(t, m.Save(&first))
+	assert.NoError(t, again.Save(&second))
+	assert.Equal(t, first.String(), second.String())
+
+	// another seed splits the folds differently, and versions the model differently
+	other, err := Fit(examples, options, FitOptions{Folds: 5, Seed: 2})
+	assert.NoError(t, err)
+	assert.NotEqual(t, meta.Version, other.Metadata.Version)
+	assert.NotEqual(t, meta.CrossValidation.FoldMetrics, other.Metadata.CrossValidation.FoldMetrics)
+
+	versioned, err := Fit(examples, options, FitOptions{Version: "2023-05"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-05", versioned.Metadata.Version)
+	assert.Nil(t, versioned.Metadata.CrossValidation)
+
+	_, err = Fit(examples, options, FitOptions{Folds: 1})
+	assert.ErrorContains(t, err, "folds")
+}
@@ -0,0 +1,108 @@
+package textmodel
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Tokenize lowercases the text and splits it into the words of at least two letters or digits
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if len([]rune(w)) >= 2 {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// Vectorizer turns texts into TF-IDF vectors, normalized to a length of 1. Its terms are the words of the texts
+// it was fitted on, and the pairs of consecutive words if NGrams is 2.
+type Vectorizer struct {
+	// Vocabulary is the column of each term
+	Vocabulary map[string]int `json:"vocabulary"`
+	// IDF is the inverse document frequency of each term, by column
+	IDF []float64 `json:"idf"`
+	// NGrams is the longest sequence of words making a term, 1 or 2
+	NGrams int `json:"ngrams"`
+}
+
+// terms returns the terms of the text
+func (v *Vectorizer) terms(text string) []string {
+	tokens := Tokenize(text)
+	terms := append([]string(nil), tokens...)
+	if v.NGrams > 1 {
+		for i := 1; i < len(tokens); i++ {
+			terms = append(terms, tokens[i-1]+" "+tokens[i])
+		}
+	}
+	return terms
+}
+
+// FitVectorizer learns the vocabulary of the texts and the IDF of its terms, dropping the terms found in less
+// than minDF texts. The columns are in the alphabetical order of the terms, so the same texts give the same
+// vectorizer.
+func FitVectorizer(texts []string, ngrams, minDF int) *Vectorizer {
+	v := &Vectorizer{Vocabulary: map[string]int{}, NGrams: ngrams}
+	df := map[string]int{}
+	for _, text := range texts {
+		seen := map[string]bool{}
+		for _, term := range v.terms(text) {
+			if !seen[term] {
+				seen[term] = true
+				df[term]++
+			}
+		}
+	}
+	var terms []string
+	for term, n := range df {
+		if n >= minDF {
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+	n := float64(len(texts))
+	v.IDF = make([]float64, len(terms))
+	for i, term := range terms {
+		v.Vocabulary[term] = i
+		// smoothed, as if a text had every term, so no term is ignored
+		v.IDF[i] = math.Log((1+n)/(1+float64(df[term]))) + 1
+	}
+	return v
+}
+
+// Transform returns the TF-IDF vector of the text, the terms out of the vocabulary are ignored
+func (v *Vectorizer) Transform(text string) *mat.VecDense {
+	x := make([]float64, len(v.IDF))
+	v.fill(x, text)
+	return mat.NewVecDense(len(x), x)
+}
+
+// TransformAll returns the TF-IDF vectors of the texts, one row per text
+func (v *Vectorizer) TransformAll(texts []string) *mat.Dense {
+	x := mat.NewDense(len(texts), len(v.IDF), nil)
+	for i, text := range texts {
+		v.fill(x.RawRowView(i), text)
+	}
+	return x
+}
+
+// fill sets x to the TF-IDF vector of the text
+func (v *Vectorizer) fill(x []float64, text string) {
+	for _, term := range v.terms(text) {
+		if j, ok := v.Vocabulary[term]; ok {
+			x[j] += v.IDF[j]
+		}
+	}
+	if norm := floats.Norm(x, 2); norm > 0 {
+		floats.Scale(1/norm, x)
+	}
+}
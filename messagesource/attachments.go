@@ -0,0 +1,114 @@
+package messagesource
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/integration"
+	"google.golang.org/api/gmail/v1"
+)
+
+// attachmentDownloader opens the content of an attachment that is not included in the message
+type attachmentDownloader func(ctx context.Context, attachmentID string) (io.ReadCloser, error)
+
+// attachmentsFrom collects the attachment metadata of the message, the content is downloaded when the attachment is opened
+func attachmentsFrom(m *gmail.Message, download attachmentDownloader) []datamodel.Attachment {
+	var attachments []datamodel.Attachment
+	var walk func(part *gmail.MessagePart)
+	walk = func(part *gmail.MessagePart) {
+		if part == nil {
+			return
+		}
+		if len(part.Parts) > 0 || strings.HasPrefix(strings.ToLower(part.MimeType), "multipart/") {
+			for _, p := range part.Parts {
+				walk(p)
+			}
+			return
+		}
+		if !isAttachmentPart(part) {
+			return
+		}
+		attachments = append(attachments, attachmentFrom(part, download))
+	}
+	walk(m.Payload)
+	return attachments
+}
+
+// isAttachmentPart reports whether a leaf part is an attachment, inline images included, rather than body text
+func isAttachmentPart(part *gmail.MessagePart) bool {
+	if integration.IsAttachment(part) {
+		return true
+	}
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		return true
+	}
+	mimeType := strings.ToLower(part.MimeType)
+	return mimeType != "" && !strings.HasPrefix(mimeType, "text/")
+}
+
+func attachmentFrom(part *gmail.MessagePart, download attachmentDownloader) datamodel.Attachment {
+	a := datamodel.Attachment{
+		PartID:      part.PartId,
+		Filename:    part.Filename,
+		MimeType:    part.MimeType,
+		ContentID:   strings.Trim(integration.PartHeader(part, "Content-ID"), "<> "),
+		Disposition: datamodel.DispositionAttachment,
+	}
+	disposition, params, err := mime.ParseMediaType(integration.PartHeader(part, "Content-Disposition"))
+	if err == nil {
+		if disposition == datamodel.DispositionInline {
+			a.Disposition = datamodel.DispositionInline
+		}
+		if a.Filename == "" {
+			a.Filename = params["filename"]
+		}
+	} else if a.ContentID != "" {
+		// parts referenced by a Content-ID without a disposition are embedded in the HTML body
+		a.Disposition = datamodel.DispositionInline
+	}
+	if part.Body == nil {
+		return a
+	}
+	a.ID = part.Body.AttachmentId
+	a.Size = part.Body.Size
+	if part.Body.AttachmentId == "" {
+		// small attachments come inline with the message
+		data := part.Body.Data
+		a.Opener = func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(integration.Base64URLReader(data)), nil
+		}
+		return a
+	}
+	if download != nil {
+		attachmentID := part.Body.AttachmentId
+		a.Opener = func(ctx context.Context) (io.ReadCloser, error) {
+			return download(ctx, attachmentID)
+		}
+	}
+	return a
+}
+
+// GetAttachment downloads the content of an attachment through the Gmail API
+func (s *GmailService) GetAttachment(ctx context.Context, userId, messageID, attachmentID string) ([]byte, error) {
+	r, err := s.openAttachment(ctx, userId, messageID, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// openAttachment downloads an attachment through the Gmail API, its content is decoded as it is read. The API
+// only returns the content base64 encoded in a JSON response, which the Gmail client reads whole.
+func (s *GmailService) openAttachment(ctx context.Context, userId, messageID, attachmentID string) (io.ReadCloser, error) {
+	body, err := s.Gmail.Users.Messages.Attachments.Get(userId, messageID, attachmentID).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+	return io.NopCloser(integration.Base64URLReader(body.Data)), nil
+}
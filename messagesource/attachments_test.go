@@ -0,0 +1,98 @@
+package messagesource
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestGetMessageAttachments(t *testing.T) {
+	fake := newFakeGmail()
+	fake.messages["m1"] = &gmail.Message{
+		Id: "m1",
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{
+					MimeType: "multipart/related",
+					Parts: []*gmail.MessagePart{
+						{PartId: "0.0", MimeType: "text/html", Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(`<img src="cid:logo">`))}},
+						{
+							PartId:   "0.1",
+							MimeType: "image/png",
+							Headers:  []*gmail.MessagePartHeader{{Name: "Content-ID", Value: "<logo>"}},
+							Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("png")), Size: 3},
+						},
+					},
+				},
+				{
+					PartId:   "1",
+					MimeType: "text/calendar",
+					Filename: "invite.ics",
+					Headers:  []*gmail.MessagePartHeader{{Name: "Content-Disposition", Value: "attachment; filename=\"invite.ics\""}},
+					Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("BEGIN:VCALENDAR")), Size: 15},
+				},
+				{
+					PartId:   "2",
+					MimeType: "application/pdf",
+					Filename: "offer.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "att-pdf", Size: 8},
+				},
+			},
+		},
+	}
+	fake.attachments["att-pdf"] = base64.URLEncoding.EncodeToString([]byte("%PDF-1.7"))
+
+	s := NewGmailService(fake.start(t))
+	msg, err := s.GetMessage("me", "m1")
+	assert.NoError(t, err)
+	assert.True(t, msg.HasAttachments())
+	assert.Len(t, msg.Attachments, 3)
+
+	logo := msg.Attachments[0]
+	assert.Equal(t, "logo", logo.ContentID)
+	assert.True(t, logo.Inline())
+	assert.Equal(t, "image/png", logo.MimeType)
+
+	invite := msg.Attachments[1]
+	assert.Equal(t, "invite.ics", invite.Filename)
+	assert.Equal(t, datamodel.DispositionAttachment, invite.Disposition)
+	r, err := invite.Open(context.Background(), 0)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "BEGIN:VCALENDAR", string(data))
+
+	offer := msg.Attachments[2]
+	assert.Equal(t, "att-pdf", offer.ID)
+	assert.Equal(t, int64(8), offer.Size)
+	assert.NotContains(t, fake.requests, "GET /gmail/v1/users/me/messages/m1/attachments/att-pdf", "attachments must not be downloaded with the message")
+
+	_, err = offer.Open(context.Background(), 4)
+	assert.True(t, errors.Is(err, datamodel.ErrAttachmentTooLarge))
+
+	r, err = offer.Open(context.Background(), 1024)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(r)
+	assert.Equal(t, "%PDF-1.7", string(data))
+	assert.Contains(t, fake.requests, "GET /gmail/v1/users/me/messages/m1/attachments/att-pdf")
+
+	// a wrong size does not get past the cap, reading fails once the content is bigger
+	offer.Size = 0
+	r, err = offer.Open(context.Background(), 4)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	assert.True(t, errors.Is(err, datamodel.ErrAttachmentTooLarge))
+	assert.Equal(t, "%PDF", string(data))
+	assert.NoError(t, r.Close())
+	r, err = offer.Open(context.Background(), 8)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.7", string(data))
+}
@@ -0,0 +1,125 @@
+package messagesource
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// maxBatchSize is the maximum number of requests the Gmail batch endpoint accepts in one call
+const maxBatchSize = 100
+
+// batchGetMessages gets the messages in one call to the Gmail batch endpoint.
+// The results and errors are in the order of the ids, one of them is set for every id.
+func (s *GmailService) batchGetMessages(userId string, ids []string) ([]*gmail.Message, []error) {
+	messages := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	fail := func(err error) ([]*gmail.Message, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return messages, errs
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for i, id := range ids {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<item-"+strconv.Itoa(i)+">")
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Fprintf(part, "GET /gmail/v1/users/%s/messages/%s?format=%s\r\n\r\n", url.PathEscape(userId), url.PathEscape(id), s.format)
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.Gmail.BasePath, "/")+"/batch/gmail/v1", &body)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+	resp, err := s.batchClient.Do(req)
+	if err != nil {
+		return fail(fmt.Errorf("failed to call batch endpoint: %w", err))
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return fail(fmt.Errorf("batch request failed: %w", err))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fail(fmt.Errorf("unexpected batch response content type %q", resp.Header.Get("Content-Type")))
+	}
+	seen := make([]bool, len(ids))
+	r := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		i, ok := batchItemIndex(part.Header.Get("Content-ID"), len(ids))
+		if !ok {
+			continue
+		}
+		seen[i] = true
+		messages[i], errs[i] = readBatchItem(part)
+	}
+	for i := range ids {
+		if !seen[i] {
+			errs[i] = fmt.Errorf("no response for message %s in batch", ids[i])
+		}
+	}
+	return messages, errs
+}
+
+// batchItemIndex extracts the request index from a "<response-item-N>" content id
+func batchItemIndex(contentID string, n int) (int, bool) {
+	contentID = strings.Trim(contentID, "<>")
+	i := strings.LastIndex(contentID, "item-")
+	if i < 0 {
+		return 0, false
+	}
+	index, err := strconv.Atoi(contentID[i+len("item-"):])
+	if err != nil || index < 0 || index >= n {
+		return 0, false
+	}
+	return index, true
+}
+
+// readBatchItem parses the HTTP response embedded in a part of the batch response
+func readBatchItem(part *multipart.Part) (*gmail.Message, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch item: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	m := &gmail.Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid message in batch item: %w", err)
+	}
+	return m, nil
+}
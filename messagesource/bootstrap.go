@@ -0,0 +1,39 @@
+package messagesource
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// WithBackfill makes the first poll, when there is no history id yet, process the messages
+// received in the last given number of days before switching to the incremental history
+func WithBackfill(days int) GmailOption {
+	return func(s *GmailService) {
+		if days > 0 {
+			s.backfill = time.Duration(days) * 24 * time.Hour
+		}
+	}
+}
+
+// bootstrap starts the polling of a mailbox without a history id. It starts from the current
+// history id of the profile, and lists the messages of the backfill window if there is one.
+func (s *GmailService) bootstrap(userId string) (uint64, []string, error) {
+	profile, err := s.Gmail.Users.GetProfile(userId).Do()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get profile to start polling: %w", err)
+	}
+	if s.backfill == 0 {
+		logging.Logger.Info("no history yet, starting from the current history id", zap.String("user", userId), zap.Uint64("historyId", profile.HistoryId))
+		return profile.HistoryId, nil, nil
+	}
+	since := time.Now().Add(-s.backfill)
+	ids, err := s.listMessageIdsSince(userId, since)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list messages to backfill: %w", err)
+	}
+	logging.Logger.Info("no history yet, backfilling messages", zap.String("user", userId), zap.Uint64("historyId", profile.HistoryId), zap.Time("since", since), zap.Int("messages", len(ids)))
+	return profile.HistoryId, ids, nil
+}
@@ -0,0 +1,109 @@
+package messagesource
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// forwardMessage composes the message forwarding the raw message to the address: a short text part with the
+// headers of the original, and the original attached as message/rfc822
+func forwardMessage(raw []byte, to string) ([]byte, error) {
+	original, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message to forward: %w", err)
+	}
+	subject := decodeHeader(original.Header.Get("Subject"))
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	writeHeaders(&buf, [][2]string{
+		{"To", to},
+		{"Subject", encodeHeader(prefixSubject("Fwd: ", subject))},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/mixed; boundary=" + w.Boundary()},
+	})
+
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "---------- Forwarded message ---------\r\n")
+	for _, name := range []string{"From", "Date", "Subject", "To"} {
+		if value := original.Header.Get(name); value != "" {
+			fmt.Fprintf(text, "%s: %s\r\n", name, decodeHeader(value))
+		}
+	}
+	attached, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"attachment; filename=\"forwarded.eml\""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	attached.Write(raw)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// replyMessage composes the reply to the raw message with the body, addressed to its Reply-To or its sender, and
+// threaded with In-Reply-To and References
+func replyMessage(raw []byte, body string) ([]byte, error) {
+	original, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message to reply to: %w", err)
+	}
+	to := original.Header.Get("Reply-To")
+	if to == "" {
+		to = original.Header.Get("From")
+	}
+	if to == "" {
+		return nil, fmt.Errorf("the message to reply to has no sender")
+	}
+	headers := [][2]string{
+		{"To", to},
+		{"Subject", encodeHeader(prefixSubject("Re: ", decodeHeader(original.Header.Get("Subject"))))},
+	}
+	if messageID := original.Header.Get("Message-ID"); messageID != "" {
+		references := strings.TrimSpace(original.Header.Get("References") + " " + messageID)
+		headers = append(headers, [2]string{"In-Reply-To", messageID}, [2]string{"References", references})
+	}
+	headers = append(headers,
+		[2]string{"Date", time.Now().Format(time.RFC1123Z)},
+		[2]string{"MIME-Version", "1.0"},
+		[2]string{"Content-Type", "text/plain; charset=UTF-8"},
+	)
+
+	var buf bytes.Buffer
+	writeHeaders(&buf, headers)
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
+
+// writeHeaders writes the headers in order, and the blank line ending them
+func writeHeaders(buf *bytes.Buffer, headers [][2]string) {
+	for _, h := range headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+}
+
+// prefixSubject prefixes the subject, unless it already starts with the prefix, like "Re: Re: " replies
+func prefixSubject(prefix, subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), strings.ToLower(prefix)) {
+		return subject
+	}
+	return prefix + subject
+}
+
+// encodeHeader encodes the header value as RFC 2047 encoded-words if it is not ASCII
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
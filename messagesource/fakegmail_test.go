@@ -0,0 +1,288 @@
+package messagesource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeGmail is an httptest stand-in of the Gmail API serving canned messages
+type fakeGmail struct {
+	mu          sync.Mutex
+	messages    map[string]*gmail.Message
+	attachments map[string]string
+	failures    map[string]int
+	requests    []string
+	queries     []string
+
+	// historyId is the current history id of the mailbox, history older than oldestHistoryId has expired
+	historyId       uint64
+	oldestHistoryId uint64
+	history         []*gmail.History
+	pageSize        int
+
+	// watches are the watch requests received, the watch expires 7 days after now
+	watches []*gmail.WatchRequest
+
+	// labels of the mailbox, and the changes, sends and drafts received
+	labels    []*gmail.Label
+	raw       map[string]string
+	batches   []*gmail.BatchModifyMessagesRequest
+	modified  map[string]*gmail.ModifyMessageRequest
+	trashed   []string
+	sent      []*gmail.Message
+	drafts    []*gmail.Draft
+	badLabels map[string]bool
+}
+
+func newFakeGmail() *fakeGmail {
+	return &fakeGmail{
+		messages:    map[string]*gmail.Message{},
+		attachments: map[string]string{},
+		failures:    map[string]int{},
+		raw:         map[string]string{},
+		modified:    map[string]*gmail.ModifyMessageRequest{},
+		badLabels:   map[string]bool{},
+		labels: []*gmail.Label{
+			{Id: "INBOX", Name: "INBOX", Type: "system"},
+			{Id: "UNREAD", Name: "UNREAD", Type: "system"},
+			{Id: "STARRED", Name: "STARRED", Type: "system"},
+		},
+	}
+}
+
+// start runs the fake server and returns a Gmail service talking to it
+func (f *fakeGmail) start(t *testing.T) *gmail.Service {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	svc, err := gmail.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatalf("failed to create gmail service: %v", err)
+	}
+	return svc
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.route(w, r)
+}
+
+func (f *fakeGmail) route(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/batch/gmail/v1" {
+		f.batch(w, r)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/")
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "profile":
+		writeJSON(w, &gmail.Profile{EmailAddress: parts[0], HistoryId: f.historyId})
+	case len(parts) == 2 && parts[1] == "watch" && r.Method == http.MethodPost:
+		req := &gmail.WatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.watches = append(f.watches, req)
+		writeJSON(w, &gmail.WatchResponse{HistoryId: f.historyId, Expiration: time.Now().Add(7 * 24 * time.Hour).UnixMilli()})
+	case len(parts) == 2 && parts[1] == "history":
+		f.listHistory(w, r)
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == http.MethodGet:
+		f.listMessages(w, r)
+	case len(parts) == 2 && parts[1] == "labels" && r.Method == http.MethodGet:
+		writeJSON(w, &gmail.ListLabelsResponse{Labels: f.labels})
+	case len(parts) == 2 && parts[1] == "labels" && r.Method == http.MethodPost:
+		label := &gmail.Label{}
+		json.NewDecoder(r.Body).Decode(label)
+		label.Id = "Label_" + strconv.Itoa(len(f.labels))
+		f.labels = append(f.labels, label)
+		writeJSON(w, label)
+	case len(parts) == 2 && parts[1] == "drafts" && r.Method == http.MethodPost:
+		if code, ok := f.failures["drafts"]; ok {
+			delete(f.failures, "drafts")
+			writeError(w, code, "injected failure")
+			return
+		}
+		draft := &gmail.Draft{}
+		json.NewDecoder(r.Body).Decode(draft)
+		f.drafts = append(f.drafts, draft)
+		writeJSON(w, draft)
+	case len(parts) == 3 && parts[1] == "messages" && parts[2] == "batchModify":
+		req := &gmail.BatchModifyMessagesRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		for _, id := range req.Ids {
+			if f.badLabels[id] {
+				writeError(w, http.StatusBadRequest, "Invalid id value")
+				return
+			}
+		}
+		f.batches = append(f.batches, req)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[1] == "messages" && parts[2] == "send":
+		msg := &gmail.Message{}
+		json.NewDecoder(r.Body).Decode(msg)
+		f.sent = append(f.sent, msg)
+		writeJSON(w, msg)
+	case len(parts) == 4 && parts[1] == "messages" && parts[3] == "modify":
+		if f.badLabels[parts[2]] {
+			writeError(w, http.StatusBadRequest, "Invalid id value")
+			return
+		}
+		req := &gmail.ModifyMessageRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		f.modified[parts[2]] = req
+		writeJSON(w, &gmail.Message{Id: parts[2]})
+	case len(parts) == 4 && parts[1] == "messages" && parts[3] == "trash":
+		f.trashed = append(f.trashed, parts[2])
+		writeJSON(w, &gmail.Message{Id: parts[2]})
+	case len(parts) == 3 && parts[1] == "messages" && r.Method == http.MethodGet:
+		if code, ok := f.failures[parts[2]]; ok {
+			writeError(w, code, "injected failure")
+			return
+		}
+		if r.URL.Query().Get("format") == "raw" {
+			raw, ok := f.raw[parts[2]]
+			if !ok {
+				writeError(w, http.StatusNotFound, "Requested entity was not found.")
+				return
+			}
+			writeJSON(w, &gmail.Message{Id: parts[2], ThreadId: "thread-" + parts[2], Raw: raw})
+			return
+		}
+		m, ok := f.messages[parts[2]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+		writeJSON(w, m)
+	case len(parts) == 5 && parts[1] == "messages" && parts[3] == "attachments":
+		data, ok := f.attachments[parts[4]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Requested entity was not found.")
+			return
+		}
+		writeJSON(w, &gmail.MessagePartBody{AttachmentId: parts[4], Data: data, Size: int64(len(data))})
+	default:
+		writeError(w, http.StatusNotImplemented, "not implemented: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (f *fakeGmail) listHistory(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("startHistoryId"), 10, 64)
+	if err != nil || start == 0 {
+		writeError(w, http.StatusBadRequest, "Invalid startHistoryId")
+		return
+	}
+	if start < f.oldestHistoryId {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	resp := &gmail.ListHistoryResponse{HistoryId: f.historyId}
+	for _, h := range f.history {
+		if h.Id > start {
+			resp.History = append(resp.History, h)
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// listMessages lists the messages newest first, supporting the "after:" query and paging
+func (f *fakeGmail) listMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	f.queries = append(f.queries, q)
+	var after int64
+	if strings.HasPrefix(q, "after:") {
+		after, _ = strconv.ParseInt(strings.TrimPrefix(q, "after:"), 10, 64)
+	}
+	var matched []*gmail.Message
+	for _, m := range f.messages {
+		if m.InternalDate/1000 > after {
+			matched = append(matched, &gmail.Message{Id: m.Id, ThreadId: m.ThreadId, InternalDate: m.InternalDate})
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].InternalDate > matched[j].InternalDate })
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	resp := &gmail.ListMessagesResponse{}
+	end := len(matched)
+	if f.pageSize > 0 && offset+f.pageSize < end {
+		end = offset + f.pageSize
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	if offset < end {
+		resp.Messages = matched[offset:end]
+	}
+	writeJSON(w, resp)
+}
+
+// batch serves the multipart/mixed batch endpoint by routing every embedded request
+func (f *fakeGmail) batch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		// the embedded request line may leave out the HTTP version
+		br := bufio.NewReader(part)
+		line, _ := br.ReadString('\n')
+		if fields := strings.Fields(line); len(fields) == 2 {
+			line = fields[0] + " " + fields[1] + " HTTP/1.1\r\n"
+		}
+		req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(line), br, strings.NewReader("\r\n"))))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rec := httptest.NewRecorder()
+		f.route(rec, req)
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<response-"+strings.Trim(part.Header.Get("Content-ID"), "<>")+">")
+		pw, _ := mw.CreatePart(header)
+		rec.Result().Write(pw)
+	}
+	mw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Write(body.Bytes())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
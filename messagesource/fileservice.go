@@ -0,0 +1,436 @@
+package messagesource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Kinds of file message sources
+const (
+	// FileKindMbox is a single mbox file, for example a Google Takeout export
+	FileKindMbox = "mbox"
+	// FileKindMaildir is a Maildir directory with cur and new sub directories
+	FileKindMaildir = "maildir"
+	// FileKindEML is a directory of .eml files
+	FileKindEML = "eml"
+)
+
+// defaultFileBatchSize is how many messages one poll of a file source returns by default
+const defaultFileBatchSize = 100
+
+// RecordedAction is the plan of a message the handlers asked the file source to apply, it is recorded instead of applied
+type RecordedAction struct {
+	datamodel.Plan
+	Time time.Time `json:"time"`
+}
+
+// FileService implements the message service over messages stored in files, to replay real mail through the handlers.
+// For an mbox the poll cursor is the byte offset of the next message and message ids are the offsets of the messages.
+// For Maildir and .eml directories the cursor is the number of files already returned, in file name order,
+// and message ids are the file paths relative to the directory. Files added later must sort after the existing ones,
+// which is the case for Maildir names as they start with the delivery time.
+type FileService struct {
+	path      string
+	kind      string
+	batchSize int
+
+	mu        sync.Mutex
+	actions   []RecordedAction
+	actionLog io.Writer
+}
+
+// FileOption configures a FileService
+type FileOption func(*FileService)
+
+// WithFileBatchSize sets how many messages a poll returns at most
+func WithFileBatchSize(size int) FileOption {
+	return func(s *FileService) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+// WithActionLog writes every recorded action to w as a line of JSON
+func WithActionLog(w io.Writer) FileOption {
+	return func(s *FileService) {
+		s.actionLog = w
+	}
+}
+
+// NewFileService creates a message service reading the mbox file, Maildir or .eml directory at path
+func NewFileService(path string, options ...FileOption) (*FileService, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message source: %w", err)
+	}
+	s := &FileService{path: path, kind: FileKindMbox, batchSize: defaultFileBatchSize}
+	if info.IsDir() {
+		s.kind = FileKindEML
+		if isDir(filepath.Join(path, "cur")) || isDir(filepath.Join(path, "new")) {
+			s.kind = FileKindMaildir
+		}
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Kind returns the kind of the source, one of FileKindMbox, FileKindMaildir or FileKindEML
+func (s *FileService) Kind() string {
+	return s.kind
+}
+
+// GetMessageIds retrieves the ids of the next batch of messages after the cursor, the userId is not used.
+// A zero cursor starts from the first message.
+func (s *FileService) GetMessageIds(userId string, cursor uint64) (uint64, []string, error) {
+	cursor, records, err := s.GetHistory(userId, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return cursor, messageIdsOf(records), nil
+}
+
+// GetHistory retrieves the next batch of messages after the cursor, one history record per message
+// at the cursor following it
+func (s *FileService) GetHistory(userId string, cursor uint64) (uint64, []datamodel.HistoryRecord, error) {
+	if s.kind == FileKindMbox {
+		return s.mboxHistory(cursor)
+	}
+	files, err := s.listFiles()
+	if err != nil {
+		return 0, nil, err
+	}
+	if cursor > uint64(len(files)) {
+		return 0, nil, fmt.Errorf("cursor %d is after the last of the %d files in %s", cursor, len(files), s.path)
+	}
+	end := cursor + uint64(s.batchSize)
+	if end > uint64(len(files)) {
+		end = uint64(len(files))
+	}
+	var records []datamodel.HistoryRecord
+	for i := cursor; i < end; i++ {
+		records = append(records, datamodel.HistoryRecord{HistoryID: i + 1, MessageIDs: []string{files[i]}})
+	}
+	return end, records, nil
+}
+
+// listFiles lists the message files relative to the directory, sorted by name
+func (s *FileService) listFiles() ([]string, error) {
+	var dirs []string
+	if s.kind == FileKindMaildir {
+		// tmp holds messages still being delivered
+		dirs = []string{"cur", "new"}
+	} else {
+		dirs = []string{""}
+	}
+	var files []string
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(s.path, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list messages: %w", err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			if s.kind == FileKindEML && !strings.EqualFold(filepath.Ext(name), ".eml") {
+				continue
+			}
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// Maildir sorts on the unique name, without the flags after the colon
+	sort.Slice(files, func(i, j int) bool {
+		return maildirKey(files[i]) < maildirKey(files[j])
+	})
+	return files, nil
+}
+
+// maildirKey returns the file name without its directory and Maildir info
+func maildirKey(file string) string {
+	name := filepath.Base(file)
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// mboxHistory scans the mbox from the offset, returning up to batchSize messages by offset,
+// and the offset of the message after them, or the end of the file
+func (s *FileService) mboxHistory(offset uint64) (uint64, []datamodel.HistoryRecord, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to open mbox: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		return 0, nil, fmt.Errorf("unable to seek mbox to %d: %w", offset, err)
+	}
+
+	r := bufio.NewReader(f)
+	pos := offset
+	var records []datamodel.HistoryRecord
+	// each record ends where the next message starts
+	endRecord := func() {
+		if len(records) > 0 {
+			records[len(records)-1].HistoryID = pos
+		}
+	}
+	// the offset is the start of a message, like the start of the file
+	var previous []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if isMboxSeparator(previous, line) {
+				endRecord()
+				if len(records) == s.batchSize {
+					return pos, records, nil
+				}
+				records = append(records, datamodel.HistoryRecord{MessageIDs: []string{strconv.FormatUint(pos, 10)}})
+			} else if pos == offset {
+				return 0, nil, fmt.Errorf("no mbox message starts at offset %d of %s", offset, s.path)
+			}
+			pos += uint64(len(line))
+			previous = line
+		}
+		if err == io.EOF {
+			endRecord()
+			return pos, records, nil
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("unable to read mbox: %w", err)
+		}
+	}
+}
+
+// isMboxSeparator reports whether the line is the "From <sender> <date>" line starting an mbox message. It must
+// start the file, previous is nil then, or follow a blank line, so the body lines starting with "From " which
+// were not escaped, in the mbox files not written as mboxrd, do not split their message.
+func isMboxSeparator(previous, line []byte) bool {
+	if previous != nil && len(bytes.TrimRight(previous, "\r\n")) > 0 {
+		return false
+	}
+	return bytes.HasPrefix(line, []byte("From ")) && !mboxDeliveryTime(line).IsZero()
+}
+
+// isMboxEscapedFrom reports whether the body line was escaped by mboxrd, one ">" is removed when reading
+func isMboxEscapedFrom(line []byte) bool {
+	return len(line) > 0 && line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// readMboxMessage reads the raw message at the offset, and the delivery time of its separator line
+func (s *FileService) readMboxMessage(offset uint64) ([]byte, time.Time, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to open mbox: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to seek mbox to %d: %w", offset, err)
+	}
+
+	r := bufio.NewReader(f)
+	separator, err := r.ReadBytes('\n')
+	if err != nil || !isMboxSeparator(nil, separator) {
+		return nil, time.Time{}, fmt.Errorf("no mbox message starts at offset %d", offset)
+	}
+	var raw bytes.Buffer
+	previous := separator
+	for {
+		line, err := r.ReadBytes('\n')
+		if isMboxSeparator(previous, line) {
+			break
+		}
+		previous = line
+		if isMboxEscapedFrom(line) {
+			line = line[1:]
+		}
+		raw.Write(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("unable to read mbox: %w", err)
+		}
+	}
+	// the blank line before the next separator is not part of the message
+	data := raw.Bytes()
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n\n")) {
+		data = data[:len(data)-1]
+	}
+	return data, mboxDeliveryTime(separator), nil
+}
+
+// mboxDateLayouts are the layouts of the date in separator lines, Google Takeout adds the time zone
+var mboxDateLayouts = []string{time.ANSIC, "Mon Jan _2 15:04:05 -0700 2006"}
+
+// mboxDeliveryTime parses the date of a "From sender Thu Mar 30 12:00:00 2023" separator, zero if it has none
+func mboxDeliveryTime(separator []byte) time.Time {
+	fields := strings.Fields(string(separator))
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range mboxDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// GetMessage retrieves the message by id
+func (s *FileService) GetMessage(userId string, id string) (datamodel.Message, error) {
+	var raw []byte
+	var received time.Time
+	var err error
+	if s.kind == FileKindMbox {
+		offset, parseErr := strconv.ParseUint(id, 10, 64)
+		if parseErr != nil {
+			return datamodel.Message{}, fmt.Errorf("invalid mbox message id %q", id)
+		}
+		raw, received, err = s.readMboxMessage(offset)
+	} else {
+		raw, received, err = s.readFile(id)
+	}
+	if err != nil {
+		return datamodel.Message{}, err
+	}
+
+	gm, err := parseRFC822(id, raw)
+	if err != nil {
+		return datamodel.Message{}, err
+	}
+	if !received.IsZero() {
+		gm.InternalDate = received.UnixMilli()
+	}
+	applyTakeoutHeaders(gm)
+	return convertMessage(gm, nil), nil
+}
+
+// readFile reads the message file by its path relative to the directory, and its modification time
+func (s *FileService) readFile(id string) ([]byte, time.Time, error) {
+	name := filepath.Join(s.path, filepath.FromSlash(id))
+	if !strings.HasPrefix(name, filepath.Clean(s.path)+string(filepath.Separator)) {
+		return nil, time.Time{}, fmt.Errorf("invalid message id %q", id)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to open message %s: %w", id, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to read message %s: %w", id, err)
+	}
+	return raw, info.ModTime(), nil
+}
+
+// takeoutLabels maps the system labels of a Google Takeout export to the Gmail label ids
+var takeoutLabels = map[string]string{
+	"Inbox":     "INBOX",
+	"Unread":    "UNREAD",
+	"Starred":   "STARRED",
+	"Important": "IMPORTANT",
+	"Sent":      "SENT",
+	"Drafts":    "DRAFT",
+	"Spam":      "SPAM",
+	"Trash":     "TRASH",
+}
+
+// applyTakeoutHeaders sets the thread and labels from the headers Google Takeout adds to exported messages
+func applyTakeoutHeaders(m *gmail.Message) {
+	headers := headersFrom(m.Payload)
+	m.ThreadId = headers.Get("X-GM-THRID")
+	if labels := headers.Get("X-Gmail-Labels"); labels != "" {
+		for _, label := range strings.Split(labels, ",") {
+			label = strings.TrimSpace(label)
+			if id, ok := takeoutLabels[label]; ok {
+				label = id
+			}
+			if label != "" {
+				m.LabelIds = append(m.LabelIds, label)
+			}
+		}
+	}
+}
+
+// GetMessages retrieves the messages by ids, in the order of the ids.
+// Messages that could not be read are left out and reported in a FetchErrors error.
+func (s *FileService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
+	var messages []datamodel.Message
+	errs := FetchErrors{}
+	for _, id := range ids {
+		msg, err := s.GetMessage(userId, id)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if len(errs) > 0 {
+		return messages, errs
+	}
+	return messages, nil
+}
+
+// Execute records the plan instead of applying it, the files are never modified
+func (s *FileService) Execute(ctx context.Context, plan datamodel.Plan) error {
+	action := RecordedAction{Plan: plan, Time: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions = append(s.actions, action)
+	logging.Logger.Info("recorded action", zap.Any("action", action))
+	if s.actionLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	if _, err := s.actionLog.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to write action log: %w", err)
+	}
+	return nil
+}
+
+// Actions returns the actions recorded so far
+func (s *FileService) Actions() []RecordedAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RecordedAction(nil), s.actions...)
+}
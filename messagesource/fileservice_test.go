@@ -0,0 +1,218 @@
+package messagesource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"github.com/stretchr/testify/assert"
+)
+
+const takeoutMbox = "From 1762301232450953843@xxx Sat Apr 01 12:00:00 +0000 2023\n" +
+	"X-GM-THRID: 1762301232450953843\n" +
+	"X-Gmail-Labels: Inbox,Unread,Job Search\n" +
+	"From: jobs@acme.example\n" +
+	"Subject: Your application\n" +
+	"Date: Sat, 01 Apr 2023 12:00:00 +0000\n" +
+	"\n" +
+	"We regret to inform you.\n" +
+	">From the hiring team\n" +
+	"\n" +
+	"From 1762301232450953844@xxx Sun Apr  2 09:30:00 2023\n" +
+	"Subject: second\n" +
+	"\n" +
+	"hello\n" +
+	"\n" +
+	"From 1762301232450953845@xxx Mon Apr  3 09:30:00 2023\n" +
+	"Subject: third\n" +
+	"\n" +
+	"bye\n"
+
+func writeTestFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServiceMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "All mail.mbox")
+	writeTestFile(t, path, takeoutMbox)
+	s, err := NewFileService(path, WithFileBatchSize(2))
+	assert.NoError(t, err)
+	assert.Equal(t, FileKindMbox, s.Kind())
+
+	cursor, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	second := uint64(strings.Index(takeoutMbox, "From 1762301232450953844"))
+	third := uint64(strings.Index(takeoutMbox, "From 1762301232450953845"))
+	assert.Equal(t, []string{"0", strconv.FormatUint(second, 10)}, ids)
+	assert.Equal(t, third, cursor)
+
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{strconv.FormatUint(third, 10)}, ids)
+	assert.Equal(t, uint64(len(takeoutMbox)), cursor)
+
+	// nothing new at the end of the file
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, uint64(len(takeoutMbox)), cursor)
+
+	messages, err := s.GetMessages("me", []string{"0", strconv.FormatUint(second, 10)})
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		msg := messages[0]
+		assert.Equal(t, "0", msg.ID)
+		assert.Equal(t, "1762301232450953843", msg.ThreadID)
+		assert.Equal(t, []string{"INBOX", "UNREAD", "Job Search"}, msg.LabelIDs)
+		assert.Equal(t, "Your application", msg.Subject)
+		assert.Equal(t, "We regret to inform you.\nFrom the hiring team\n", msg.PlainBody)
+		assert.Equal(t, "second", messages[1].Subject)
+		assert.Equal(t, "hello\n", messages[1].PlainBody)
+		// without a Date header the date of the separator line is used
+		assert.Equal(t, "2023-04-02T09:30:00Z", messages[1].Date.UTC().Format("2006-01-02T15:04:05Z07:00"))
+	}
+
+	_, err = s.GetMessage("me", "5")
+	assert.Error(t, err)
+	_, _, err = s.GetMessageIds("me", 5)
+	assert.Error(t, err)
+}
+
+func TestFileServiceMboxUnescapedFrom(t *testing.T) {
+	// an mbox not written as mboxrd keeps the body lines starting with "From " as they are
+	mbox := "From sender@example.org Sat Apr  1 12:00:00 2023\n" +
+		"Subject: first\n" +
+		"\n" +
+		"Thanks for applying.\n" +
+		"From the hiring team\n" +
+		"\n" +
+		"From here on, we will keep your resume.\n" +
+		"\n" +
+		"From sender@example.org Sun Apr  2 09:30:00 2023\n" +
+		"Subject: second\n" +
+		"\n" +
+		"hello\n"
+	path := filepath.Join(t.TempDir(), "unescaped.mbox")
+	writeTestFile(t, path, mbox)
+	s, err := NewFileService(path)
+	assert.NoError(t, err)
+
+	cursor, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	second := uint64(strings.Index(mbox, "From sender@example.org Sun"))
+	assert.Equal(t, []string{"0", strconv.FormatUint(second, 10)}, ids)
+	assert.Equal(t, uint64(len(mbox)), cursor)
+
+	msg, err := s.GetMessage("me", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, "Thanks for applying.\nFrom the hiring team\n\nFrom here on, we will keep your resume.\n", msg.PlainBody)
+	msg, err = s.GetMessage("me", ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "second", msg.Subject)
+}
+
+func TestFileServiceMaildir(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "cur", "1680350400.M1P1.host:2,S"), "Subject: read\n\nold news")
+	writeTestFile(t, filepath.Join(dir, "new", "1680436800.M2P1.host"), "Subject: unread\n\nnew news")
+	writeTestFile(t, filepath.Join(dir, "tmp", "1680436801.M3P1.host"), "Subject: partial")
+	s, err := NewFileService(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, FileKindMaildir, s.Kind())
+
+	cursor, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), cursor)
+	assert.Equal(t, []string{filepath.Join("cur", "1680350400.M1P1.host:2,S"), filepath.Join("new", "1680436800.M2P1.host")}, ids)
+
+	msg, err := s.GetMessage("me", ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "unread", msg.Subject)
+	assert.Equal(t, "new news", msg.PlainBody)
+
+	writeTestFile(t, filepath.Join(dir, "new", "1680523200.M4P1.host"), "Subject: later\n\nlater news")
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), cursor)
+	assert.Equal(t, []string{filepath.Join("new", "1680523200.M4P1.host")}, ids)
+
+	_, err = s.GetMessage("me", "../outside")
+	assert.Error(t, err)
+}
+
+func TestFileServiceEML(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "b.eml"), "Subject: b\n\nsecond")
+	writeTestFile(t, filepath.Join(dir, "a.eml"), "Subject: a\n\nfirst")
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "not a message")
+	s, err := NewFileService(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, FileKindEML, s.Kind())
+
+	cursor, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), cursor)
+	assert.Equal(t, []string{"a.eml", "b.eml"}, ids)
+
+	messages, err := s.GetMessages("me", []string{"a.eml", "missing.eml"})
+	assert.Error(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "a", messages[0].Subject)
+	}
+}
+
+func TestFileServiceRecordsActions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.eml"), "Subject: a\n\nfirst")
+	var log bytes.Buffer
+	s, err := NewFileService(dir, WithActionLog(&log))
+	assert.NoError(t, err)
+
+	plan := datamodel.Plan{MessageID: "a.eml", AddLabels: []string{"Rejection"}, MarkRead: true}
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	actions := s.Actions()
+	if assert.Len(t, actions, 1) {
+		assert.Equal(t, plan, actions[0].Plan)
+		assert.False(t, actions[0].Time.IsZero())
+	}
+
+	var logged RecordedAction
+	assert.NoError(t, json.Unmarshal(log.Bytes(), &logged))
+	assert.Equal(t, plan, logged.Plan)
+	assert.Contains(t, log.String(), `"addLabels":["Rejection"]`)
+	// the message file is left untouched
+	data, err := os.ReadFile(filepath.Join(dir, "a.eml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Subject: a\n\nfirst", string(data))
+}
+
+func TestParseRFC822TransferEncoding(t *testing.T) {
+	// the raw bodies are decoded by their transfer encoding only
+	for _, tt := range []struct {
+		name, encoding, body, want string
+	}{
+		{"quoted-printable", "quoted-printable", "See https://jobs.example/status?a=3D3Db=\r\n&x=3D1", "See https://jobs.example/status?a=3Db&x=1"},
+		{"8bit", "8bit", "See https://jobs.example/status?a=3Db", "See https://jobs.example/status?a=3Db"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "Subject: status\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: " + tt.encoding + "\r\n\r\n" + tt.body
+			msg, err := parseRFC822("1", []byte(raw))
+			assert.NoError(t, err)
+			body, err := integration.ExtractMessageBody(msg)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, body.Text())
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package messagesource
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// maxBatchModifyIDs is the maximum number of messages Users.Messages.BatchModify accepts in one call
+const maxBatchModifyIDs = 1000
+
+// defaultModifyWindow is how long the label changes wait for the changes of other messages to batch with
+const defaultModifyWindow = 100 * time.Millisecond
+
+// defaultModifyTimeout bounds the calls applying a batch of label changes
+const defaultModifyTimeout = 30 * time.Second
+
+// Gmail system labels set by the actions
+const (
+	labelInbox   = "INBOX"
+	labelUnread  = "UNREAD"
+	labelStarred = "STARRED"
+)
+
+// SideEffectLog remembers the actions with side effects done for a message, like a forward, so a retry of its
+// plan does not do them again. The side effect store of the polling package is one, it must not forget a record
+// before the plan can no longer be retried.
+type SideEffectLog interface {
+	Contains(account, key string) bool
+	Add(account, key string) error
+}
+
+// WithSideEffectLog sets where the forwards and reply drafts done are recorded. Without it, a plan failing after
+// a forward forwards the message again when it is retried.
+func WithSideEffectLog(log SideEffectLog) GmailOption {
+	return func(s *GmailService) {
+		s.sideEffects = log
+	}
+}
+
+// WithModifyWindow sets how long the label changes of a message wait for the changes of other messages, the
+// messages with the same changes are modified in one BatchModify call. 0 does not wait.
+func WithModifyWindow(window time.Duration) GmailOption {
+	return func(s *GmailService) {
+		if window >= 0 {
+			s.modifyWindow = window
+		}
+	}
+}
+
+// Execute applies the plan of the message: the label changes, starring, marking as read and archiving are
+// batched with the other messages with the same changes, then the message is trashed, forwarded, or replied
+// to with a draft. The forwards and drafts already done by a previous run of the plan are skipped.
+func (s *GmailService) Execute(ctx context.Context, plan datamodel.Plan) error {
+	add, remove, err := s.labelChanges(ctx, plan)
+	if err != nil {
+		return err
+	}
+	if len(add) > 0 || len(remove) > 0 {
+		if err := s.modifier.modify(ctx, plan.MessageID, add, remove); err != nil {
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound) {
+				// a label may have been deleted since it was cached
+				s.labels.reset()
+			}
+			return fmt.Errorf("failed to modify message %s: %w", plan.MessageID, err)
+		}
+	}
+	if plan.Trash {
+		if _, err := s.Gmail.Users.Messages.Trash(s.userID, plan.MessageID).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("failed to trash message %s: %w", plan.MessageID, err)
+		}
+	}
+	var forwardTo []string
+	for _, to := range plan.ForwardTo {
+		if !s.done(plan.MessageID, "forward", to) {
+			forwardTo = append(forwardTo, to)
+		}
+	}
+	replyDraft := plan.ReplyDraft
+	if replyDraft != "" && s.done(plan.MessageID, "draft", "") {
+		replyDraft = ""
+	}
+	if len(forwardTo) == 0 && replyDraft == "" {
+		return nil
+	}
+	original, err := s.Gmail.Users.Messages.Get(s.userID, plan.MessageID).Format("raw").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get message %s: %w", plan.MessageID, err)
+	}
+	raw, err := base64.URLEncoding.DecodeString(original.Raw)
+	if err != nil {
+		return fmt.Errorf("invalid raw message %s: %w", plan.MessageID, err)
+	}
+	for _, to := range forwardTo {
+		forward, err := forwardMessage(raw, to)
+		if err != nil {
+			return err
+		}
+		send := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(forward)}
+		if _, err := s.Gmail.Users.Messages.Send(s.userID, send).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("failed to forward message %s to %s: %w", plan.MessageID, to, err)
+		}
+		if err := s.record(plan.MessageID, "forward", to); err != nil {
+			return err
+		}
+	}
+	if replyDraft != "" {
+		reply, err := replyMessage(raw, replyDraft)
+		if err != nil {
+			return err
+		}
+		draft := &gmail.Draft{Message: &gmail.Message{Raw: base64.URLEncoding.EncodeToString(reply), ThreadId: original.ThreadId}}
+		if _, err := s.Gmail.Users.Drafts.Create(s.userID, draft).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("failed to create reply draft to message %s: %w", plan.MessageID, err)
+		}
+		if err := s.record(plan.MessageID, "draft", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sideEffectKey identifies an action with side effects done for a message, it never collides with a message id
+func sideEffectKey(messageID, action, target string) string {
+	return messageID + "\t" + action + "\t" + target
+}
+
+// done reports whether the action was already done for the message
+func (s *GmailService) done(messageID, action, target string) bool {
+	return s.sideEffects != nil && s.sideEffects.Contains(s.userID, sideEffectKey(messageID, action, target))
+}
+
+// record records the action as done for the message
+func (s *GmailService) record(messageID, action, target string) error {
+	if s.sideEffects == nil {
+		return nil
+	}
+	if err := s.sideEffects.Add(s.userID, sideEffectKey(messageID, action, target)); err != nil {
+		return fmt.Errorf("failed to record %s of message %s: %w", action, messageID, err)
+	}
+	return nil
+}
+
+// labelChanges returns the ids of the labels the plan adds and removes, the labels added are created if needed
+func (s *GmailService) labelChanges(ctx context.Context, plan datamodel.Plan) (add, remove []string, err error) {
+	for _, name := range plan.AddLabels {
+		id, err := s.labels.id(ctx, name, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		add = append(add, id)
+	}
+	for _, name := range plan.RemoveLabels {
+		id, err := s.labels.id(ctx, name, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		// a label that does not exist is on no message
+		if id != "" {
+			remove = append(remove, id)
+		}
+	}
+	if plan.Star {
+		add = append(add, labelStarred)
+	}
+	if plan.MarkRead {
+		remove = append(remove, labelUnread)
+	}
+	if plan.Archive {
+		remove = append(remove, labelInbox)
+	}
+	return add, remove, nil
+}
+
+// LabelID returns the id of the label of the mailbox, "" if there is no such label. The system labels, like
+// "INBOX", are found by their id.
+func (s *GmailService) LabelID(ctx context.Context, name string) (string, error) {
+	return s.labels.id(ctx, name, false)
+}
+
+// labelCache maps the label names to their ids, listed once and kept until a change fails
+type labelCache struct {
+	gmail  *gmail.Service
+	userID string
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+// reset forgets the labels, they are listed again on next use
+func (c *labelCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = nil
+}
+
+// id returns the id of the label, "" if it does not exist. With create, the label is created if it does not exist.
+// The system labels, like "INBOX" or "STARRED", are found by their id.
+func (c *labelCache) id(ctx context.Context, name string, create bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids == nil {
+		if err := c.load(ctx); err != nil {
+			return "", err
+		}
+	}
+	if id, ok := c.ids[name]; ok || !create {
+		return id, nil
+	}
+	label := &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}
+	created, err := c.gmail.Users.Labels.Create(c.userID, label).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		// another instance created it since the labels were listed
+		if err := c.load(ctx); err != nil {
+			return "", err
+		}
+		if id, ok := c.ids[name]; ok {
+			return id, nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create label %s: %w", name, err)
+	}
+	c.ids[name] = created.Id
+	return created.Id, nil
+}
+
+// load lists the labels of the mailbox. It must be called with the lock held.
+func (c *labelCache) load(ctx context.Context) error {
+	labels, err := c.gmail.Users.Labels.List(c.userID).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to list labels: %w", err)
+	}
+	c.ids = map[string]string{}
+	for _, label := range labels.Labels {
+		c.ids[label.Name] = label.Id
+		// system labels are named after their id, but the name may be localized
+		if label.Type == "system" {
+			c.ids[label.Id] = label.Id
+		}
+	}
+	return nil
+}
+
+// modifyBatcher groups the messages getting the same label changes within a time window, and modifies each
+// group with one BatchModify call
+type modifyBatcher struct {
+	gmail  *gmail.Service
+	userID string
+	window time.Duration
+	// timeout bounds the calls applying a batch, the batch belongs to none of its messages so their contexts
+	// do not bound it
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*modifyBatch
+}
+
+// modifyBatch is a group of messages getting the same label changes
+type modifyBatch struct {
+	add    []string
+	remove []string
+	ids    []string
+	once   sync.Once
+	done   chan struct{}
+	// err is the error of the batch, errs the errors of the messages when they were modified one by one
+	err  error
+	errs map[string]error
+}
+
+// errOf returns the error of the message
+func (batch *modifyBatch) errOf(messageID string) error {
+	if batch.errs != nil {
+		return batch.errs[messageID]
+	}
+	return batch.err
+}
+
+// modify adds and removes the labels of the message, it returns once the batch of the message is applied. The
+// context only bounds the wait: the batch is applied for the other messages even if it is done.
+func (b *modifyBatcher) modify(ctx context.Context, messageID string, add, remove []string) error {
+	add, remove = sortedCopy(add), sortedCopy(remove)
+	key := strings.Join(add, ",") + "|" + strings.Join(remove, ",")
+
+	b.mu.Lock()
+	if b.pending == nil {
+		b.pending = map[string]*modifyBatch{}
+	}
+	batch := b.pending[key]
+	if batch == nil {
+		batch = &modifyBatch{add: add, remove: remove, done: make(chan struct{})}
+		b.pending[key] = batch
+		time.AfterFunc(b.window, func() { b.flush(key, batch) })
+	}
+	batch.ids = append(batch.ids, messageID)
+	full := len(batch.ids) >= maxBatchModifyIDs
+	b.mu.Unlock()
+	if full {
+		b.flush(key, batch)
+	}
+
+	select {
+	case <-batch.done:
+		return batch.errOf(messageID)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush applies the batch, once. When Gmail rejects the batch, for example because one of its messages was
+// deleted, the messages are modified one by one so the others do not fail with it. The calls are bound by the
+// timeout of the batcher, not by the context of any of the messages.
+func (b *modifyBatcher) flush(key string, batch *modifyBatch) {
+	batch.once.Do(func() {
+		defer close(batch.done)
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		defer cancel()
+		b.mu.Lock()
+		if b.pending[key] == batch {
+			delete(b.pending, key)
+		}
+		ids := batch.ids
+		b.mu.Unlock()
+
+		request := &gmail.BatchModifyMessagesRequest{Ids: ids, AddLabelIds: batch.add, RemoveLabelIds: batch.remove}
+		batch.err = b.gmail.Users.Messages.BatchModify(b.userID, request).Context(ctx).Do()
+		var apiErr *googleapi.Error
+		if len(ids) == 1 || !errors.As(batch.err, &apiErr) || apiErr.Code >= 500 || apiErr.Code == http.StatusTooManyRequests {
+			return
+		}
+		batch.errs = map[string]error{}
+		for _, id := range ids {
+			modify := &gmail.ModifyMessageRequest{AddLabelIds: batch.add, RemoveLabelIds: batch.remove}
+			if _, err := b.gmail.Users.Messages.Modify(b.userID, id, modify).Context(ctx).Do(); err != nil {
+				batch.errs[id] = err
+			}
+		}
+	})
+}
+
+// sortedCopy returns the values sorted, without changing the slice
+func sortedCopy(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,260 @@
+package messagesource
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+// requestsOf counts the requests of the fake Gmail matching the prefix
+func (f *fakeGmail) requestsOf(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGmailExecuteBatchesLabelChanges(t *testing.T) {
+	f := newFakeGmail()
+	s := NewGmailService(f.start(t), WithModifyWindow(50*time.Millisecond))
+
+	// the messages with the same changes are modified together, the labels are listed once
+	var wg sync.WaitGroup
+	for _, id := range []string{"m1", "m2", "m3"} {
+		id := id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Execute(context.Background(), datamodel.Plan{MessageID: id, AddLabels: []string{"Rejection"}, MarkRead: true}))
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, s.Execute(context.Background(), datamodel.Plan{MessageID: "m4", AddLabels: []string{"Rejection"}, Star: true, Archive: true}))
+
+	assert.Equal(t, 1, f.requestsOf("GET /gmail/v1/users/me/labels"))
+	assert.Equal(t, 1, f.requestsOf("POST /gmail/v1/users/me/labels"))
+	if assert.Len(t, f.batches, 2) {
+		assert.ElementsMatch(t, []string{"m1", "m2", "m3"}, f.batches[0].Ids)
+		assert.Equal(t, []string{"Label_3"}, f.batches[0].AddLabelIds)
+		assert.Equal(t, []string{"UNREAD"}, f.batches[0].RemoveLabelIds)
+		assert.Equal(t, []string{"m4"}, f.batches[1].Ids)
+		assert.Equal(t, []string{"Label_3", "STARRED"}, f.batches[1].AddLabelIds)
+		assert.Equal(t, []string{"INBOX"}, f.batches[1].RemoveLabelIds)
+	}
+}
+
+func TestGmailExecuteRemovesKnownLabels(t *testing.T) {
+	f := newFakeGmail()
+	f.labels = append(f.labels, &gmail.Label{Id: "Label_9", Name: "Todo", Type: "user"})
+	s := NewGmailService(f.start(t), WithModifyWindow(0))
+
+	assert.NoError(t, s.Execute(context.Background(), datamodel.Plan{MessageID: "m1", RemoveLabels: []string{"Todo", "Never created"}}))
+	if assert.Len(t, f.batches, 1) {
+		assert.Empty(t, f.batches[0].AddLabelIds)
+		assert.Equal(t, []string{"Label_9"}, f.batches[0].RemoveLabelIds)
+	}
+	// removing a label that does not exist does not create it
+	assert.Equal(t, 0, f.requestsOf("POST /gmail/v1/users/me/labels"))
+
+	// nothing to change, nothing sent
+	assert.NoError(t, s.Execute(context.Background(), datamodel.Plan{MessageID: "m1", RemoveLabels: []string{"Never created"}}))
+	assert.Len(t, f.batches, 1)
+}
+
+func TestGmailLabelID(t *testing.T) {
+	f := newFakeGmail()
+	f.labels = append(f.labels, &gmail.Label{Id: "Label_9", Name: "Todo", Type: "user"})
+	s := NewGmailService(f.start(t))
+
+	for name, id := range map[string]string{"Todo": "Label_9", "INBOX": "INBOX", "Never created": ""} {
+		got, err := s.LabelID(context.Background(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, id, got, name)
+	}
+	// the labels are listed once
+	assert.Equal(t, 1, f.requestsOf("GET /gmail/v1/users/me/labels"))
+}
+
+func TestGmailExecuteFallsBackToModify(t *testing.T) {
+	f := newFakeGmail()
+	// m2 was deleted, the batch with it is rejected
+	f.badLabels["m2"] = true
+	s := NewGmailService(f.start(t), WithModifyWindow(50*time.Millisecond))
+
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	for i, id := range []string{"m1", "m2", "m3"} {
+		i, id := i, id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Execute(context.Background(), datamodel.Plan{MessageID: id, Star: true})
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, errs[0])
+	assert.ErrorContains(t, errs[1], "failed to modify message m2")
+	assert.NoError(t, errs[2])
+	assert.Empty(t, f.batches)
+	assert.Len(t, f.modified, 2)
+}
+
+func TestGmailExecuteTrashForwardAndReply(t *testing.T) {
+	f := newFakeGmail()
+	f.raw["m1"] = base64.URLEncoding.EncodeToString([]byte(rejectionRFC822))
+	s := NewGmailService(f.start(t), WithModifyWindow(0))
+
+	plan := datamodel.Plan{
+		MessageID:  "m1",
+		Trash:      true,
+		ForwardTo:  []string{"me@example.org"},
+		ReplyDraft: "Thank you for letting me know.",
+	}
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	assert.Equal(t, []string{"m1"}, f.trashed)
+	assert.Empty(t, f.batches)
+
+	if assert.Len(t, f.sent, 1) {
+		forward := decodeRaw(t, f.sent[0].Raw)
+		assert.Equal(t, "me@example.org", forward.Header.Get("To"))
+		assert.Equal(t, "Fwd: Your application", forward.Header.Get("Subject"))
+		body, _ := io.ReadAll(forward.Body)
+		assert.Contains(t, string(body), "---------- Forwarded message ---------")
+		assert.Contains(t, string(body), "From: Acme Recruiting <jobs@acme.example>")
+		assert.Contains(t, string(body), "Content-Type: message/rfc822")
+	}
+	if assert.Len(t, f.drafts, 1) {
+		assert.Equal(t, "thread-m1", f.drafts[0].Message.ThreadId)
+		reply := decodeRaw(t, f.drafts[0].Message.Raw)
+		assert.Equal(t, "=?UTF-8?Q?Acme_Recruiting?= <jobs@acme.example>", reply.Header.Get("To"))
+		assert.Equal(t, "Re: Your application", reply.Header.Get("Subject"))
+		assert.Equal(t, "<rejection@acme.example>", reply.Header.Get("In-Reply-To"))
+		assert.Equal(t, "<rejection@acme.example>", reply.Header.Get("References"))
+		body, _ := io.ReadAll(reply.Body)
+		assert.Equal(t, "Thank you for letting me know.", string(body))
+	}
+}
+
+func TestGmailExecuteBatchOutlivesCanceledMessage(t *testing.T) {
+	f := newFakeGmail()
+	s := NewGmailService(f.start(t), WithModifyWindow(50*time.Millisecond))
+
+	// m1 opens the batch and gives up waiting, the batch is still applied for m2
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i, id := range []string{"m1", "m2"} {
+		i, id := i, id
+		execCtx := context.Background()
+		if i == 0 {
+			execCtx = ctx
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Execute(execCtx, datamodel.Plan{MessageID: id, Star: true})
+		}()
+		assert.Eventually(t, func() bool {
+			s.modifier.mu.Lock()
+			defer s.modifier.mu.Unlock()
+			for _, batch := range s.modifier.pending {
+				return len(batch.ids) == i+1
+			}
+			return false
+		}, time.Second, time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	assert.ErrorIs(t, errs[0], context.Canceled)
+	assert.NoError(t, errs[1])
+	if assert.Len(t, f.batches, 1) {
+		assert.ElementsMatch(t, []string{"m1", "m2"}, f.batches[0].Ids)
+	}
+}
+
+// sideEffects is a SideEffectLog kept in a map
+type sideEffects map[string]bool
+
+func (e sideEffects) Contains(account, key string) bool {
+	return e[account+"/"+key]
+}
+
+func (e sideEffects) Add(account, key string) error {
+	e[account+"/"+key] = true
+	return nil
+}
+
+func TestGmailExecuteRetrySkipsSideEffects(t *testing.T) {
+	f := newFakeGmail()
+	f.raw["m1"] = base64.URLEncoding.EncodeToString([]byte(rejectionRFC822))
+	f.failures["drafts"] = http.StatusInternalServerError
+	s := NewGmailService(f.start(t), WithModifyWindow(0), WithSideEffectLog(sideEffects{}))
+
+	plan := datamodel.Plan{
+		MessageID:  "m1",
+		ForwardTo:  []string{"me@example.org", "you@example.org"},
+		ReplyDraft: "Thank you for letting me know.",
+	}
+	assert.Error(t, s.Execute(context.Background(), plan))
+	assert.Len(t, f.sent, 2)
+	assert.Empty(t, f.drafts)
+
+	// the retry only creates the draft, the message is not forwarded twice
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	assert.Len(t, f.sent, 2)
+	assert.Len(t, f.drafts, 1)
+
+	// once everything is done, the plan does nothing more, not even fetch the message
+	gets := f.requestsOf("GET /gmail/v1/users/me/messages/m1")
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	assert.Len(t, f.sent, 2)
+	assert.Len(t, f.drafts, 1)
+	assert.Equal(t, gets, f.requestsOf("GET /gmail/v1/users/me/messages/m1"))
+}
+
+func TestReplyMessage(t *testing.T) {
+	original := "From: jobs@acme.example\r\n" +
+		"Reply-To: recruiting@acme.example\r\n" +
+		"Subject: =?UTF-8?Q?RE:_Votre_candidature_=C3=A0_Acme?=\r\n" +
+		"Message-ID: <2@acme.example>\r\n" +
+		"References: <1@acme.example>\r\n" +
+		"\r\n" +
+		"Bonjour"
+	raw, err := replyMessage([]byte(original), "Merci\nBonne journée")
+	assert.NoError(t, err)
+	reply, err := mail.ReadMessage(bytes.NewReader(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, "recruiting@acme.example", reply.Header.Get("To"))
+	assert.Equal(t, "RE: Votre candidature à Acme", decodeHeader(reply.Header.Get("Subject")))
+	assert.Equal(t, "<1@acme.example> <2@acme.example>", reply.Header.Get("References"))
+	body, _ := io.ReadAll(reply.Body)
+	assert.Equal(t, "Merci\r\nBonne journée", string(body))
+
+	_, err = replyMessage([]byte("Subject: no sender\r\n\r\nbody"), "hi")
+	assert.ErrorContains(t, err, "no sender")
+}
+
+// decodeRaw parses the base64url raw message of the Gmail API
+func decodeRaw(t *testing.T, raw string) *mail.Message {
+	data, err := base64.URLEncoding.DecodeString(raw)
+	assert.NoError(t, err)
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	return msg
+}
@@ -1,7 +1,14 @@
 package messagesource
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jyouturer/gmail-ai/datamodel"
 	"github.com/jyouturer/gmail-ai/integration"
@@ -10,66 +17,317 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
+// Message formats supported when fetching messages
+const (
+	// FormatFull fetches the headers and the full MIME tree of the message
+	FormatFull = "full"
+	// FormatMetadata fetches only the headers and labels of the message, the body is the snippet
+	FormatMetadata = "metadata"
+)
+
 type GmailService struct {
 	Gmail *gmail.Service
+
+	// userID is the mailbox the actions are applied to
+	userID      string
+	format      string
+	concurrency int
+	batchClient *http.Client
+	batchSize   int
+
+	mu       sync.Mutex
+	lastSync time.Time
+	// polled is the history id and the start of the last poll, lastSync once the history id is saved
+	polled struct {
+		historyId uint64
+		at        time.Time
+	}
+	resyncWindow time.Duration
+	onResync     func(ResyncEvent)
+	backfill     time.Duration
+
+	// the actions are applied with the labels cached, and the label changes batched
+	modifyWindow time.Duration
+	labels       *labelCache
+	modifier     *modifyBatcher
+	sideEffects  SideEffectLog
+}
+
+// GmailOption configures a GmailService
+type GmailOption func(*GmailService)
+
+// WithFormat sets the format messages are fetched with, FormatFull or FormatMetadata
+func WithFormat(format string) GmailOption {
+	return func(s *GmailService) {
+		s.format = format
+	}
+}
+
+// WithUserID sets the mailbox the actions are applied to and the labels are listed in, "me" (the user of the
+// token) by default. The messages must be polled with the same user id.
+func WithUserID(userID string) GmailOption {
+	return func(s *GmailService) {
+		if userID != "" {
+			s.userID = userID
+		}
+	}
+}
+
+// WithConcurrency sets how many messages (or batch requests) are fetched at the same time
+func WithConcurrency(n int) GmailOption {
+	return func(s *GmailService) {
+		if n > 0 {
+			s.concurrency = n
+		}
+	}
 }
 
-func NewGmailService(gmail *gmail.Service) *GmailService {
-	return &GmailService{Gmail: gmail}
+// WithBatchClient makes GetMessages use the Gmail batch endpoint, sending up to size message requests in one HTTP call.
+// The client must be authorized the same way as the Gmail service.
+func WithBatchClient(client *http.Client, size int) GmailOption {
+	return func(s *GmailService) {
+		s.batchClient = client
+		if size > 0 && size <= maxBatchSize {
+			s.batchSize = size
+		}
+	}
 }
 
-// GetMessages retrieves message by ID.
+func NewGmailService(gmail *gmail.Service, options ...GmailOption) *GmailService {
+	s := &GmailService{
+		Gmail:        gmail,
+		userID:       "me",
+		format:       FormatFull,
+		concurrency:  10,
+		batchSize:    50,
+		resyncWindow: 7 * 24 * time.Hour,
+		modifyWindow: defaultModifyWindow,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.labels = &labelCache{gmail: gmail, userID: s.userID}
+	s.modifier = &modifyBatcher{gmail: gmail, userID: s.userID, window: s.modifyWindow, timeout: defaultModifyTimeout}
+	return s
+}
+
+// GetMessage retrieves message by ID.
 func (s *GmailService) GetMessage(userId, messageID string) (datamodel.Message, error) {
-	m, err := s.Gmail.Users.Messages.Get(userId, messageID).Format("full").Do()
+	m, err := s.Gmail.Users.Messages.Get(userId, messageID).Format(s.format).Do()
 	if err != nil {
-		return datamodel.Message{}, fmt.Errorf("failed to get message: %v", err)
+		return datamodel.Message{}, fmt.Errorf("failed to get message: %w", err)
 	}
-	return s.FromGmailMessage(m), nil
+	return s.fromGmailMessage(userId, m), nil
 }
 
-// FromGmailMessage converts a gmail.Message to datamodel.Message
+// FromGmailMessage converts a gmail.Message of the mailbox to datamodel.Message
 func (s *GmailService) FromGmailMessage(m *gmail.Message) datamodel.Message {
-	return datamodel.Message{
-		ID:      m.Id,
-		Subject: m.Snippet,
-		From:    m.Payload.Headers[0].Value,
-		To:      m.Payload.Headers[1].Value,
-		Body:    s.GetBody(m),
+	return s.fromGmailMessage(s.userID, m)
+}
+
+// fromGmailMessage converts a gmail.Message to datamodel.Message, attachments are downloaded on demand for the given user
+func (s *GmailService) fromGmailMessage(userId string, m *gmail.Message) datamodel.Message {
+	return convertMessage(m, func(ctx context.Context, attachmentID string) (io.ReadCloser, error) {
+		return s.openAttachment(ctx, userId, m.Id, attachmentID)
+	})
+}
+
+// convertMessage converts a gmail.Message to datamodel.Message, download fetches the attachments not included in the message
+func convertMessage(m *gmail.Message, download attachmentDownloader) datamodel.Message {
+	headers := headersFrom(m.Payload)
+	body := extractBody(m)
+	msg := datamodel.Message{
+		ID:           m.Id,
+		ThreadID:     m.ThreadId,
+		LabelIDs:     m.LabelIds,
+		Subject:      decodeHeader(headers.Get("Subject")),
+		From:         parseAddress(headers.Get("From")),
+		To:           parseAddressList(headers.Get("To")),
+		Cc:           parseAddressList(headers.Get("Cc")),
+		Bcc:          parseAddressList(headers.Get("Bcc")),
+		ReplyTo:      parseAddressList(headers.Get("Reply-To")),
+		Date:         parseDate(headers.Get("Date")),
+		MessageID:    headers.Get("Message-ID"),
+		InReplyTo:    headers.Get("In-Reply-To"),
+		References:   parseMessageIDs(headers.Get("References")),
+		SizeEstimate: m.SizeEstimate,
+		Headers:      headers,
+		Body:         bodyText(m, body),
+		PlainBody:    body.Plain,
+		HTMLBody:     body.HTML,
+		Attachments:  attachmentsFrom(m, download),
+	}
+	if m.InternalDate > 0 {
+		// internalDate is in milliseconds since epoch
+		msg.InternalDate = time.UnixMilli(m.InternalDate)
+	}
+	if msg.Date.IsZero() {
+		msg.Date = msg.InternalDate
 	}
+	return msg
 }
 
 // GetMessageIds retrieves message ids by history id.
 func (s *GmailService) GetMessageIds(userId string, startHistoryId uint64) (uint64, []string, error) {
+	historyId, records, err := s.GetHistory(userId, startHistoryId)
+	if err != nil {
+		return 0, nil, err
+	}
+	return historyId, messageIdsOf(records), nil
+}
+
+// GetHistory retrieves the history records adding messages after the history id, and the newest history id.
+// When polling starts, or after a resync, the messages listed are in one record at the new history id.
+func (s *GmailService) GetHistory(userId string, startHistoryId uint64) (uint64, []datamodel.HistoryRecord, error) {
+	pollStarted := time.Now()
+	if startHistoryId == 0 {
+		// Gmail refuses a zero history id, start from the profile instead
+		historyId, ids, err := s.bootstrap(userId)
+		if err != nil {
+			return 0, nil, err
+		}
+		return s.polledAt(historyId, pollStarted), singleRecord(historyId, ids), nil
+	}
 	// first get the history list
 	lastHistoryId, histories, err := s.GetHistoryList(userId, startHistoryId)
+	if IsHistoryExpired(err) {
+		// the history id is too old for Gmail to keep, list the messages since the last sync instead
+		historyId, ids, err := s.resync(userId, startHistoryId)
+		if err != nil {
+			return 0, nil, err
+		}
+		return s.polledAt(historyId, pollStarted), singleRecord(historyId, ids), nil
+	}
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to retrieve history: %v", err)
+		return 0, nil, fmt.Errorf("failed to retrieve history: %w", err)
 	}
 	// iterate and get message ids
-	var ids []string
+	var records []datamodel.HistoryRecord
 	for _, h := range histories.History {
 		lastHistoryId = h.Id
+		var ids []string
 		for _, m := range h.MessagesAdded {
-			messageID := m.Message.Id
-			ids = append(ids, messageID)
+			ids = append(ids, m.Message.Id)
+		}
+		if len(ids) > 0 {
+			records = append(records, datamodel.HistoryRecord{HistoryID: h.Id, MessageIDs: ids})
 		}
 	}
-	return lastHistoryId, ids, nil
+	return s.polledAt(lastHistoryId, pollStarted), records, nil
 }
 
-// GetMessages retrieves messages by IDs
-func (s *GmailService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
-	var messages []datamodel.Message
+// singleRecord puts the messages in one history record, none if there are no messages
+func singleRecord(historyId uint64, ids []string) []datamodel.HistoryRecord {
+	if len(ids) == 0 {
+		return nil
+	}
+	return []datamodel.HistoryRecord{{HistoryID: historyId, MessageIDs: ids}}
+}
+
+// FetchErrors reports the messages GetMessages could not retrieve, keyed by message id
+type FetchErrors map[string]error
+
+func (e FetchErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "failed to get %d message(s):", len(e))
 	for _, id := range ids {
-		msg, err := s.GetMessage("me", id)
+		fmt.Fprintf(&sb, " %s: %v;", id, e[id])
+	}
+	return strings.TrimSuffix(sb.String(), ";")
+}
+
+// GetMessages retrieves messages by IDs with bounded concurrency, in the order of the ids.
+// Messages that could not be retrieved are left out and reported in a FetchErrors error.
+func (s *GmailService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
+	results := make([]datamodel.Message, len(ids))
+	fetched := make([]bool, len(ids))
+	errs := FetchErrors{}
+	var mu sync.Mutex
+
+	record := func(i int, m *gmail.Message, err error) {
+		mu.Lock()
+		defer mu.Unlock()
 		if err != nil {
-			continue
+			errs[ids[i]] = err
+			return
 		}
-		messages = append(messages, msg)
+		results[i] = s.fromGmailMessage(userId, m)
+		fetched[i] = true
+	}
+
+	if s.batchClient != nil {
+		var chunks [][]int
+		for start := 0; start < len(ids); start += s.batchSize {
+			end := start + s.batchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			var chunk []int
+			for i := start; i < end; i++ {
+				chunk = append(chunk, i)
+			}
+			chunks = append(chunks, chunk)
+		}
+		runBounded(len(chunks), s.concurrency, func(c int) {
+			chunk := chunks[c]
+			chunkIds := make([]string, len(chunk))
+			for k, i := range chunk {
+				chunkIds[k] = ids[i]
+			}
+			messages, itemErrs := s.batchGetMessages(userId, chunkIds)
+			for k, i := range chunk {
+				record(i, messages[k], itemErrs[k])
+			}
+		})
+	} else {
+		runBounded(len(ids), s.concurrency, func(i int) {
+			m, err := s.Gmail.Users.Messages.Get(userId, ids[i]).Format(s.format).Do()
+			if err != nil {
+				err = fmt.Errorf("failed to get message: %w", err)
+			}
+			record(i, m, err)
+		})
+	}
+
+	messages := make([]datamodel.Message, 0, len(ids))
+	for i := range ids {
+		if fetched[i] {
+			messages = append(messages, results[i])
+		}
+	}
+	if len(errs) > 0 {
+		logging.Logger.Warn("failed to get some messages", zap.Int("failed", len(errs)), zap.Int("requested", len(ids)))
+		return messages, errs
 	}
 	return messages, nil
 }
 
+// runBounded calls fn for every index in [0, n), running at most limit calls at the same time
+func runBounded(n, limit int, fn func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 // GetHistoryList retrieves history list by the starting history id.
 func (s *GmailService) GetHistoryList(userId string, startHistoryId uint64) (uint64, *gmail.ListHistoryResponse, error) {
 	var nextPageToken string
@@ -83,7 +341,7 @@ func (s *GmailService) GetHistoryList(userId string, startHistoryId uint64) (uin
 
 		resp, err := req.Do()
 		if err != nil {
-			return 0, nil, fmt.Errorf("failed to retrieve history: %v", err)
+			return 0, nil, fmt.Errorf("failed to retrieve history: %w", err)
 		}
 
 		histories = append(histories, resp.History...)
@@ -98,14 +356,23 @@ func (s *GmailService) GetHistoryList(userId string, startHistoryId uint64) (uin
 	return startHistoryId, &gmail.ListHistoryResponse{History: histories}, nil
 }
 
-// GetBody retrieves the body of the message by extracting the critical comoonents using NLP
+// GetBody retrieves the readable text body of the message, it falls back to the snippet when there is no text
 func (s *GmailService) GetBody(msg *gmail.Message) string {
-	// Get the text of the email
-	text, err := integration.GetMessageCriticalContents(msg)
+	return bodyText(msg, extractBody(msg))
+}
+
+// extractBody extracts the plain text and HTML bodies of the message
+func extractBody(msg *gmail.Message) integration.MessageBody {
+	body, err := integration.ExtractMessageBody(msg)
 	if err != nil {
 		logging.Logger.Warn("error in parsing message, will use snippet", zap.String("id", msg.Id), zap.Error(err))
-		text = msg.Snippet
 	}
+	return body
+}
+
+// bodyText returns the readable text of the body, or the snippet of the message if the body has no text
+func bodyText(msg *gmail.Message, body integration.MessageBody) string {
+	text := body.Text()
 	if text == "" {
 		logging.Logger.Warn("empty message from parsing, will use snippet", zap.String("id", msg.Id))
 		text = msg.Snippet
@@ -0,0 +1,156 @@
+package messagesource
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestFromGmailMessage(t *testing.T) {
+	m := &gmail.Message{
+		Id:           "m1",
+		ThreadId:     "t1",
+		LabelIds:     []string{"INBOX", "UNREAD"},
+		Snippet:      "snippet text",
+		InternalDate: 1680000000000,
+		SizeEstimate: 2048,
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Received", Value: "from mail.example.com"},
+				{Name: "DKIM-Signature", Value: "v=1; a=rsa-sha256"},
+				{Name: "subject", Value: "=?UTF-8?B?WW91ciBhcHBsaWNhdGlvbiDinJM=?="},
+				{Name: "FROM", Value: "=?ISO-8859-1?Q?Andr=E9_Recruiter?= <andre@example.com>"},
+				{Name: "To", Value: "Jane Doe <jane@example.com>, bob@example.com"},
+				{Name: "Cc", Value: "\"Team, Hiring\" <hiring@example.com>"},
+				{Name: "Reply-To", Value: "noreply@example.com"},
+				{Name: "Date", Value: "Mon, 03 Apr 2023 10:15:00 -0700"},
+				{Name: "Message-Id", Value: "<abc@example.com>"},
+				{Name: "In-Reply-To", Value: "<parent@example.com>"},
+				{Name: "References", Value: "<root@example.com> <parent@example.com>"},
+			},
+			Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("Thank you for applying."))},
+		},
+	}
+
+	s := &GmailService{}
+	msg := s.FromGmailMessage(m)
+
+	assert.Equal(t, "m1", msg.ID)
+	assert.Equal(t, "t1", msg.ThreadID)
+	assert.Equal(t, []string{"INBOX", "UNREAD"}, msg.LabelIDs)
+	assert.Equal(t, "Your application ✓", msg.Subject)
+	assert.Equal(t, datamodel.Address{Name: "André Recruiter", Email: "andre@example.com"}, msg.From)
+	assert.Equal(t, []datamodel.Address{{Name: "Jane Doe", Email: "jane@example.com"}, {Email: "bob@example.com"}}, msg.To)
+	assert.Equal(t, []datamodel.Address{{Name: "Team, Hiring", Email: "hiring@example.com"}}, msg.Cc)
+	assert.Nil(t, msg.Bcc)
+	assert.Equal(t, []datamodel.Address{{Email: "noreply@example.com"}}, msg.ReplyTo)
+	assert.True(t, time.Date(2023, 4, 3, 17, 15, 0, 0, time.UTC).Equal(msg.Date))
+	assert.Equal(t, "<abc@example.com>", msg.MessageID)
+	assert.Equal(t, "<parent@example.com>", msg.InReplyTo)
+	assert.Equal(t, []string{"<root@example.com>", "<parent@example.com>"}, msg.References)
+	assert.Equal(t, int64(1680000000000), msg.InternalDate.UnixMilli())
+	assert.Equal(t, int64(2048), msg.SizeEstimate)
+	assert.Equal(t, "from mail.example.com", msg.Headers.Get("received"))
+	assert.Equal(t, "Thank you for applying.", msg.Body)
+}
+
+func TestFromGmailMessageMissingHeaders(t *testing.T) {
+	m := &gmail.Message{
+		Id:           "m2",
+		Snippet:      "only a snippet",
+		InternalDate: 1680000000000,
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers:  []*gmail.MessagePartHeader{{Name: "From", Value: "not an address"}},
+			Body:     &gmail.MessagePartBody{},
+		},
+	}
+
+	s := &GmailService{}
+	msg := s.FromGmailMessage(m)
+
+	assert.Equal(t, "", msg.Subject)
+	assert.Equal(t, datamodel.Address{Email: "not an address"}, msg.From)
+	assert.Nil(t, msg.To)
+	assert.Equal(t, msg.InternalDate, msg.Date)
+	assert.Equal(t, "only a snippet", msg.Body)
+}
+
+func newFakeMessages(fake *fakeGmail, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("m%d", i)
+		ids = append(ids, id)
+		fake.messages[id] = &gmail.Message{
+			Id:      id,
+			Snippet: "snippet " + id,
+			Payload: &gmail.MessagePart{
+				MimeType: "text/plain",
+				Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: "subject " + id}},
+				Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("body " + id))},
+			},
+		}
+	}
+	return ids
+}
+
+func TestGetMessagesConcurrent(t *testing.T) {
+	fake := newFakeGmail()
+	ids := newFakeMessages(fake, 25)
+	fake.failures["m3"] = http.StatusInternalServerError
+	ids = append(ids, "missing")
+
+	s := NewGmailService(fake.start(t), WithConcurrency(4))
+	messages, err := s.GetMessages("someone@example.com", ids)
+
+	assert.Len(t, messages, 24)
+	for i, m := range messages {
+		assert.NotEqual(t, "m3", m.ID)
+		if i > 0 {
+			assert.Equal(t, "subject "+m.ID, m.Subject)
+		}
+	}
+	assert.Equal(t, "m0", messages[0].ID)
+	assert.Equal(t, "m24", messages[len(messages)-1].ID)
+
+	var fetchErrs FetchErrors
+	assert.True(t, errors.As(err, &fetchErrs))
+	assert.Len(t, fetchErrs, 2)
+	assert.Contains(t, fetchErrs, "m3")
+	assert.Contains(t, fetchErrs, "missing")
+	assert.Contains(t, fake.requests, "GET /gmail/v1/users/someone@example.com/messages/m0")
+}
+
+func TestGetMessagesBatch(t *testing.T) {
+	fake := newFakeGmail()
+	ids := newFakeMessages(fake, 7)
+	fake.failures["m5"] = http.StatusTooManyRequests
+
+	s := NewGmailService(fake.start(t), WithBatchClient(http.DefaultClient, 3), WithFormat(FormatMetadata))
+	messages, err := s.GetMessages("me", ids)
+
+	assert.Len(t, messages, 6)
+	assert.Equal(t, "subject m6", messages[5].Subject)
+	var fetchErrs FetchErrors
+	assert.True(t, errors.As(err, &fetchErrs))
+	var apiErr *googleapi.Error
+	assert.True(t, errors.As(fetchErrs["m5"], &apiErr))
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.Code)
+
+	batchCalls := 0
+	for _, r := range fake.requests {
+		if r == "POST /batch/gmail/v1" {
+			batchCalls++
+		}
+	}
+	assert.Equal(t, 3, batchCalls)
+}
@@ -0,0 +1,100 @@
+package messagesource
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/integration"
+	"google.golang.org/api/gmail/v1"
+)
+
+// wordDecoder decodes RFC 2047 encoded-words found in header values
+var wordDecoder = &mime.WordDecoder{CharsetReader: integration.CharsetReader}
+
+// addressParser parses address lists, decoding encoded-words in display names
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// headersFrom collects the message part headers into a case-insensitive header map
+func headersFrom(part *gmail.MessagePart) datamodel.Header {
+	headers := datamodel.Header{}
+	if part == nil {
+		return headers
+	}
+	for _, h := range part.Headers {
+		headers.Add(h.Name, h.Value)
+	}
+	return headers
+}
+
+// decodeHeader decodes the RFC 2047 encoded-words in a header value, returning the raw value if it can not be decoded
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// parseAddressList parses an address header into structured addresses.
+// Malformed lists are parsed entry by entry, so one bad address does not lose the others.
+func parseAddressList(value string) []datamodel.Address {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	list, err := addressParser.ParseList(value)
+	if err == nil {
+		return toAddresses(list)
+	}
+	var addresses []datamodel.Address
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		a, err := addressParser.Parse(entry)
+		if err != nil {
+			addresses = append(addresses, datamodel.Address{Email: decodeHeader(entry)})
+			continue
+		}
+		addresses = append(addresses, datamodel.Address{Name: a.Name, Email: a.Address})
+	}
+	return addresses
+}
+
+// parseAddress parses a single address header, for example From
+func parseAddress(value string) datamodel.Address {
+	addresses := parseAddressList(value)
+	if len(addresses) == 0 {
+		return datamodel.Address{}
+	}
+	return addresses[0]
+}
+
+func toAddresses(list []*mail.Address) []datamodel.Address {
+	addresses := make([]datamodel.Address, 0, len(list))
+	for _, a := range list {
+		addresses = append(addresses, datamodel.Address{Name: a.Name, Email: a.Address})
+	}
+	return addresses
+}
+
+// parseDate parses the Date header, it returns the zero time if the header is missing or malformed
+func parseDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := mail.ParseDate(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// parseMessageIDs splits the References header into the individual message ids
+func parseMessageIDs(value string) []string {
+	return strings.Fields(value)
+}
@@ -0,0 +1,12 @@
+package messagesource
+
+import "github.com/jyouturer/gmail-ai/datamodel"
+
+// messageIdsOf flattens the message ids of the history records, in order
+func messageIdsOf(records []datamodel.HistoryRecord) []string {
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.MessageIDs...)
+	}
+	return ids
+}
@@ -0,0 +1,619 @@
+package messagesource
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// Label modes of the IMAP service, how a label is applied to a message
+const (
+	// LabelModeKeyword sets the label as an IMAP keyword (flag) on the message
+	LabelModeKeyword = "keyword"
+	// LabelModeFolder copies the message into the folder named after the label
+	LabelModeFolder = "folder"
+)
+
+// imapTimeout is the longest a single IMAP command may take
+const imapTimeout = 2 * time.Minute
+
+// codeHighestModSeq is the response code of SELECT giving the mod-sequence of the mailbox, with the CONDSTORE
+// extension (RFC 7162)
+const codeHighestModSeq = "HIGHESTMODSEQ"
+
+// IMAPConfig is the configuration of an IMAP mailbox
+type IMAPConfig struct {
+	Address  string
+	Username string
+	Password string
+	// TLS connects with implicit TLS, usually on port 993
+	TLS bool
+	// Mailbox is the folder polled for new messages, INBOX by default
+	Mailbox string
+	// LabelMode is LabelModeKeyword (default) or LabelModeFolder
+	LabelMode string
+	// ArchiveFolder is where archived messages are moved to, "Archive" by default
+	ArchiveFolder string
+	// TrashFolder is where trashed messages are moved to, "Trash" by default
+	TrashFolder string
+	// DraftsFolder is where reply drafts are saved, "Drafts" by default
+	DraftsFolder string
+}
+
+// IMAPService implements the message service over IMAP. The poll cursor packs the UIDVALIDITY of the
+// mailbox in the high 32 bits and the last seen UID in the low 32 bits, message ids are the UIDs.
+// With CONDSTORE, the mod-sequence of the mailbox is its source state: it is saved with the cursor, and a poll
+// from that cursor is skipped while the mod-sequence does not change.
+type IMAPService struct {
+	config IMAPConfig
+
+	mu      sync.Mutex
+	client  *client.Client
+	modSeqs *modSeqWatcher
+
+	stateMu sync.Mutex
+	// highestModSeq is the mod-sequence saved with the cursor modSeqCursor, 0 when unknown
+	highestModSeq uint64
+	modSeqCursor  uint64
+	// polled is the cursor and the mod-sequence of the last poll, until they are saved
+	polled struct {
+		cursor uint64
+		modSeq uint64
+	}
+}
+
+// NewIMAPService creates a new IMAP message service, it connects on first use
+func NewIMAPService(config IMAPConfig) *IMAPService {
+	if config.Mailbox == "" {
+		config.Mailbox = "INBOX"
+	}
+	if config.LabelMode == "" {
+		config.LabelMode = LabelModeKeyword
+	}
+	if config.ArchiveFolder == "" {
+		config.ArchiveFolder = "Archive"
+	}
+	if config.TrashFolder == "" {
+		config.TrashFolder = "Trash"
+	}
+	if config.DraftsFolder == "" {
+		config.DraftsFolder = "Drafts"
+	}
+	return &IMAPService{config: config}
+}
+
+// imapCursor packs the UIDVALIDITY and the last seen UID into a poll cursor
+func imapCursor(uidValidity, uid uint32) uint64 {
+	return uint64(uidValidity)<<32 | uint64(uid)
+}
+
+// splitIMAPCursor unpacks the UIDVALIDITY and the last seen UID from a poll cursor
+func splitIMAPCursor(cursor uint64) (uint32, uint32) {
+	return uint32(cursor >> 32), uint32(cursor)
+}
+
+// Close logs out from the server
+func (s *IMAPService) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Logout()
+	s.client = nil
+	return err
+}
+
+// conn returns a logged in connection, reconnecting if needed. It must be called with the lock held.
+func (s *IMAPService) conn() (*client.Client, error) {
+	if s.client != nil && s.client.State() != imap.LogoutState {
+		return s.client, nil
+	}
+	var c *client.Client
+	var err error
+	if s.config.TLS {
+		c, err = client.DialTLS(s.config.Address, &tls.Config{})
+	} else {
+		c, err = client.Dial(s.config.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IMAP server %s: %w", s.config.Address, err)
+	}
+	if err := c.Login(s.config.Username, s.config.Password); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("failed to login to IMAP server %s: %w", s.config.Address, err)
+	}
+	c.Timeout = imapTimeout
+	updates := make(chan client.Update)
+	c.Updates = updates
+	s.modSeqs = watchModSeq(updates, c.LoggedOut())
+	s.client = c
+	return c, nil
+}
+
+// modSeqWatcher receives the unilateral updates of a connection, keeping the HIGHESTMODSEQ response code of the
+// last SELECT, which the client does not parse
+type modSeqWatcher struct {
+	take chan chan uint64
+	done <-chan struct{}
+}
+
+// watchModSeq receives the updates until the connection is closed
+func watchModSeq(updates <-chan client.Update, done <-chan struct{}) *modSeqWatcher {
+	w := &modSeqWatcher{take: make(chan chan uint64), done: done}
+	go func() {
+		var modSeq uint64
+		for {
+			select {
+			case update := <-updates:
+				if u, ok := update.(*client.StatusUpdate); ok && u.Status.Code == codeHighestModSeq && len(u.Status.Arguments) > 0 {
+					modSeq = parseModSeq(u.Status.Arguments[0])
+				}
+			case reply := <-w.take:
+				reply <- modSeq
+				modSeq = 0
+			case <-done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// modSeq returns the HIGHESTMODSEQ received since the last call, 0 if there was none. The updates are received
+// before the command sending them completes, so it is up to date right after SELECT.
+func (w *modSeqWatcher) modSeq() uint64 {
+	reply := make(chan uint64, 1)
+	select {
+	case w.take <- reply:
+		return <-reply
+	case <-w.done:
+		return 0
+	}
+}
+
+// selectMailbox selects the mailbox for reading and writing, unless it is already selected
+func selectMailbox(c *client.Client, name string) (*imap.MailboxStatus, error) {
+	if mbox := c.Mailbox(); mbox != nil && mbox.Name == name && !mbox.ReadOnly {
+		return mbox, nil
+	}
+	mbox, err := c.Select(name, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select mailbox %s: %w", name, err)
+	}
+	return mbox, nil
+}
+
+// GetMessageIds retrieves the UIDs of the messages received after the cursor. The userId is not used,
+// the account is the one logged in. A zero cursor, or a UIDVALIDITY change, starts from the current UIDNEXT.
+func (s *IMAPService) GetMessageIds(userId string, cursor uint64) (uint64, []string, error) {
+	cursor, records, err := s.GetHistory(userId, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return cursor, messageIdsOf(records), nil
+}
+
+// GetHistory retrieves the messages received after the cursor, one history record per message at its UID
+func (s *IMAPService) GetHistory(userId string, cursor uint64) (uint64, []datamodel.HistoryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.conn()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// SELECT rather than STATUS, which is not meant for the selected mailbox, gives the UIDNEXT and the
+	// mod-sequence up to date, the one of an earlier SELECT is dropped first
+	s.modSeqs.modSeq()
+	status, err := c.Select(s.config.Mailbox, false)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to select mailbox %s: %w", s.config.Mailbox, err)
+	}
+	modSeq := s.modSeqs.modSeq()
+	if status.UidNext == 0 {
+		// some servers leave out UIDNEXT for empty mailboxes
+		status.UidNext = 1
+	}
+
+	uidValidity, lastUID := splitIMAPCursor(cursor)
+	if cursor == 0 || uidValidity != status.UidValidity {
+		if cursor != 0 {
+			logging.Logger.Warn("UIDVALIDITY changed, the mailbox was recreated", zap.String("mailbox", s.config.Mailbox), zap.Uint32("old", uidValidity), zap.Uint32("new", status.UidValidity))
+		}
+		return s.polledAt(imapCursor(status.UidValidity, status.UidNext-1), modSeq), nil, nil
+	}
+	if modSeq != 0 && s.unchangedSince(cursor, modSeq) {
+		// nothing changed in the mailbox since the cursor was saved
+		return s.polledAt(cursor, modSeq), nil, nil
+	}
+	if status.UidNext-1 <= lastUID {
+		return s.polledAt(cursor, modSeq), nil, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(lastUID+1, 0)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to search new messages: %w", err)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	var records []datamodel.HistoryRecord
+	for _, uid := range uids {
+		// "n:*" always matches the last message, even when its UID is lower than n
+		if uid <= lastUID {
+			continue
+		}
+		records = append(records, datamodel.HistoryRecord{
+			HistoryID:  imapCursor(status.UidValidity, uid),
+			MessageIDs: []string{strconv.FormatUint(uint64(uid), 10)},
+		})
+		lastUID = uid
+	}
+	return s.polledAt(imapCursor(status.UidValidity, lastUID), modSeq), records, nil
+}
+
+// polledAt records the mod-sequence the mailbox had when polled up to the cursor, it returns the cursor
+func (s *IMAPService) polledAt(cursor, modSeq uint64) uint64 {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.polled.cursor, s.polled.modSeq = cursor, modSeq
+	return cursor
+}
+
+// unchangedSince tells if the mailbox still has the mod-sequence saved with the cursor
+func (s *IMAPService) unchangedSince(cursor, modSeq uint64) bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return cursor == s.modSeqCursor && modSeq == s.highestModSeq
+}
+
+// SourceState returns the mod-sequence to save with the cursor, empty unless the cursor is the end of the last
+// poll: a cursor saved part way through the messages of a poll must not skip the next one
+func (s *IMAPService) SourceState(cursor uint64) string {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if cursor != s.polled.cursor || s.polled.modSeq == 0 {
+		return ""
+	}
+	return strconv.FormatUint(s.polled.modSeq, 10)
+}
+
+// SetSourceState sets the mod-sequence saved with the cursor, when it is read or once it is written
+func (s *IMAPService) SetSourceState(cursor uint64, state string) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.modSeqCursor, s.highestModSeq = cursor, parseModSeq(state)
+}
+
+// parseModSeq parses the HIGHESTMODSEQ value, it returns 0 if the server did not send one
+func parseModSeq(value interface{}) uint64 {
+	if value == nil || value == "" {
+		return 0
+	}
+	modSeq, err := strconv.ParseUint(fmt.Sprint(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return modSeq
+}
+
+// GetMessage retrieves the message by UID
+func (s *IMAPService) GetMessage(userId string, id string) (datamodel.Message, error) {
+	messages, err := s.GetMessages(userId, []string{id})
+	if err != nil {
+		return datamodel.Message{}, err
+	}
+	return messages[0], nil
+}
+
+// GetMessages retrieves the messages by UID in one fetch, in the order of the ids.
+// Messages that could not be retrieved are left out and reported in a FetchErrors error.
+func (s *IMAPService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
+	errs := FetchErrors{}
+	seqSet := new(imap.SeqSet)
+	for _, id := range ids {
+		uid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			errs[id] = fmt.Errorf("invalid IMAP message id %q", id)
+			continue
+		}
+		seqSet.AddNum(uint32(uid))
+	}
+	if seqSet.Empty() {
+		if len(errs) > 0 {
+			return nil, errs
+		}
+		return nil, nil
+	}
+
+	fetched, err := s.fetch(seqSet)
+	if err != nil {
+		return nil, err
+	}
+	var messages []datamodel.Message
+	for _, id := range ids {
+		if _, failed := errs[id]; failed {
+			continue
+		}
+		msg, ok := fetched[id]
+		if !ok {
+			errs[id] = fmt.Errorf("message %s not found in mailbox %s", id, s.config.Mailbox)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if len(errs) > 0 {
+		return messages, errs
+	}
+	return messages, nil
+}
+
+// fetch fetches the full messages of the UIDs, keyed by message id
+func (s *IMAPService) fetch(seqSet *imap.SeqSet) (map[string]datamodel.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := selectMailbox(c, s.config.Mailbox); err != nil {
+		return nil, err
+	}
+
+	// peek so fetching does not mark the messages as read
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, section.FetchItem()}
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, items, ch)
+	}()
+
+	messages := map[string]datamodel.Message{}
+	var parseErr error
+	for m := range ch {
+		id := strconv.FormatUint(uint64(m.Uid), 10)
+		body := m.GetBody(section)
+		if body == nil {
+			continue
+		}
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			parseErr = err
+			continue
+		}
+		gm, err := parseRFC822(id, raw)
+		if err != nil {
+			logging.Logger.Error("unable to parse IMAP message", zap.String("uid", id), zap.Error(err))
+			continue
+		}
+		gm.InternalDate = m.InternalDate.UnixMilli()
+		gm.LabelIds = s.labelsFromFlags(m.Flags)
+		messages[id] = convertMessage(gm, nil)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("failed to read message body: %w", parseErr)
+	}
+	return messages, nil
+}
+
+// labelsFromFlags maps the IMAP flags to Gmail-like label ids, keywords are kept as they are
+func (s *IMAPService) labelsFromFlags(flags []string) []string {
+	labels := []string{s.config.Mailbox}
+	seen := false
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			seen = true
+		case imap.FlaggedFlag:
+			labels = append(labels, "STARRED")
+		case imap.RecentFlag, imap.DeletedFlag:
+		default:
+			labels = append(labels, flag)
+		}
+	}
+	if !seen {
+		labels = append(labels, "UNREAD")
+	}
+	return labels
+}
+
+// Execute applies the plan of the message: the labels are set as keywords or by copying the message to the label
+// folders, the read and starred states as flags, a reply draft is saved in the drafts folder, and the message is
+// moved to the trash or archive folder last. Forwarding needs SMTP, it is not supported.
+func (s *IMAPService) Execute(ctx context.Context, plan datamodel.Plan) error {
+	if len(plan.ForwardTo) > 0 {
+		return fmt.Errorf("forwarding message %s is not supported over IMAP", plan.MessageID)
+	}
+	uid, err := strconv.ParseUint(plan.MessageID, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid IMAP message id %q", plan.MessageID)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uint32(uid))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if _, err := selectMailbox(c, s.config.Mailbox); err != nil {
+		return err
+	}
+
+	var add, remove []interface{}
+	for _, label := range plan.AddLabels {
+		if s.config.LabelMode != LabelModeFolder {
+			add = append(add, imapKeyword(label))
+			continue
+		}
+		if err := ensureFolder(c, label); err != nil {
+			return err
+		}
+		if err := c.UidCopy(seqSet, label); err != nil {
+			return fmt.Errorf("failed to copy message %s to %s: %w", plan.MessageID, label, err)
+		}
+	}
+	for _, label := range plan.RemoveLabels {
+		if s.config.LabelMode == LabelModeFolder {
+			// the copy in the label folder is a message of its own
+			logging.Logger.Warn("labels can not be removed in folder mode", zap.String("message", plan.MessageID), zap.String("label", label))
+			continue
+		}
+		remove = append(remove, imapKeyword(label))
+	}
+	if plan.MarkRead {
+		add = append(add, imap.SeenFlag)
+	}
+	if plan.Star {
+		add = append(add, imap.FlaggedFlag)
+	}
+	if len(add) > 0 {
+		if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), add, nil); err != nil {
+			return fmt.Errorf("failed to set flags on message %s: %w", plan.MessageID, err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.RemoveFlags, true), remove, nil); err != nil {
+			return fmt.Errorf("failed to remove flags from message %s: %w", plan.MessageID, err)
+		}
+	}
+	if plan.ReplyDraft != "" {
+		if err := s.saveReplyDraft(c, seqSet, plan); err != nil {
+			return err
+		}
+	}
+
+	folder := ""
+	switch {
+	case plan.Trash:
+		folder = s.config.TrashFolder
+	case plan.Archive:
+		folder = s.config.ArchiveFolder
+	}
+	if folder != "" {
+		if err := ensureFolder(c, folder); err != nil {
+			return err
+		}
+		if err := moveMessages(c, seqSet, folder); err != nil {
+			return fmt.Errorf("failed to move message %s to %s: %w", plan.MessageID, folder, err)
+		}
+	}
+	return nil
+}
+
+// saveReplyDraft appends the reply to the message to the drafts folder. It must be called with the lock held.
+func (s *IMAPService) saveReplyDraft(c *client.Client, seqSet *imap.SeqSet, plan datamodel.Plan) error {
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, ch)
+	}()
+	var raw []byte
+	var readErr error
+	for m := range ch {
+		if body := m.GetBody(section); body != nil {
+			raw, readErr = ioutil.ReadAll(body)
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch message %s: %w", plan.MessageID, err)
+	}
+	if readErr != nil {
+		return fmt.Errorf("failed to read message %s: %w", plan.MessageID, readErr)
+	}
+	if raw == nil {
+		return fmt.Errorf("message %s not found in mailbox %s", plan.MessageID, s.config.Mailbox)
+	}
+
+	reply, err := replyMessage(raw, plan.ReplyDraft)
+	if err != nil {
+		return err
+	}
+	if err := ensureFolder(c, s.config.DraftsFolder); err != nil {
+		return err
+	}
+	if err := c.Append(s.config.DraftsFolder, []string{imap.DraftFlag, imap.SeenFlag}, time.Now(), bytes.NewReader(reply)); err != nil {
+		return fmt.Errorf("failed to save reply draft to message %s: %w", plan.MessageID, err)
+	}
+	return nil
+}
+
+// moveMessages moves the messages to the folder, with copy, delete and expunge on servers without a working MOVE.
+// A failed MOVE leaves the mailbox unchanged, so falling back is safe.
+func moveMessages(c *client.Client, seqSet *imap.SeqSet, folder string) error {
+	if move, _ := c.Support("MOVE"); move {
+		err := c.UidMove(seqSet, folder)
+		if err == nil {
+			return nil
+		}
+		logging.Logger.Debug("MOVE failed, falling back to copy and expunge", zap.Error(err))
+	}
+	if err := c.UidCopy(seqSet, folder); err != nil {
+		return err
+	}
+	if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	return c.Expunge(nil)
+}
+
+// ensureFolder creates the folder if it does not exist yet
+func ensureFolder(c *client.Client, name string) error {
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", name, ch)
+	}()
+	exists := false
+	for range ch {
+		exists = true
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to list folder %s: %w", name, err)
+	}
+	if exists {
+		return nil
+	}
+	if err := c.Create(name); err != nil {
+		return fmt.Errorf("failed to create folder %s: %w", name, err)
+	}
+	return nil
+}
+
+// LabelID returns the keyword the label is set as, the messages carry the keywords as label ids
+func (s *IMAPService) LabelID(ctx context.Context, name string) (string, error) {
+	return imapKeyword(name), nil
+}
+
+// imapKeyword turns a label name into a valid IMAP keyword, which can not contain spaces or special characters.
+// Keywords are case-insensitive, they are lower cased so every server reports them the same way.
+func imapKeyword(label string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(label))
+}
@@ -0,0 +1,242 @@
+package messagesource
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// startIMAPServer starts an in-memory IMAP server, its INBOX holds one message with UID 6
+func startIMAPServer(t *testing.T) (*memory.Backend, string) {
+	be := memory.New()
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return be, l.Addr().String()
+}
+
+func imapMailbox(t *testing.T, be *memory.Backend, name string) *memory.Mailbox {
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.(*memory.Mailbox)
+}
+
+func appendIMAPMessage(t *testing.T, mbox backend.Mailbox, raw string) {
+	if err := mbox.CreateMessage(nil, time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC), bytes.NewBufferString(raw)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestIMAPService(t *testing.T, addr string, labelMode string) *IMAPService {
+	s := NewIMAPService(IMAPConfig{Address: addr, Username: "username", Password: "password", LabelMode: labelMode})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+const rejectionRFC822 = "From: =?UTF-8?Q?Acme_Recruiting?= <jobs@acme.example>\r\n" +
+	"To: jane@example.org\r\n" +
+	"Subject: Your application\r\n" +
+	"Date: Sat, 01 Apr 2023 12:00:00 +0000\r\n" +
+	"Message-ID: <rejection@acme.example>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"We regret to inform you, Ren=E9e.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>We regret to inform you.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"offer.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"offer.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+func TestIMAPGetMessageIds(t *testing.T) {
+	be, addr := startIMAPServer(t)
+	inbox := imapMailbox(t, be, "INBOX")
+	s := newTestIMAPService(t, addr, "")
+
+	// the first poll starts after the messages already in the mailbox
+	cursor, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, imapCursor(1, 6), cursor)
+
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, imapCursor(1, 6), cursor)
+
+	appendIMAPMessage(t, inbox, rejectionRFC822)
+	appendIMAPMessage(t, inbox, "Subject: second\r\n\r\nhello")
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"7", "8"}, ids)
+	assert.Equal(t, imapCursor(1, 8), cursor)
+
+	cursor, ids, err = s.GetMessageIds("me", cursor)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, imapCursor(1, 8), cursor)
+}
+
+func TestIMAPGetMessageIdsUIDValidityChanged(t *testing.T) {
+	_, addr := startIMAPServer(t)
+	s := newTestIMAPService(t, addr, "")
+
+	// a cursor from another UIDVALIDITY restarts from the current end of the mailbox
+	cursor, ids, err := s.GetMessageIds("me", imapCursor(7, 2))
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	assert.Equal(t, imapCursor(1, 6), cursor)
+}
+
+func TestIMAPModSeqState(t *testing.T) {
+	updates := make(chan client.Update)
+	done := make(chan struct{})
+	defer close(done)
+	w := watchModSeq(updates, done)
+	updates <- &client.StatusUpdate{Status: &imap.StatusResp{Tag: "*", Type: imap.StatusRespOk, Code: codeHighestModSeq, Arguments: []interface{}{"715"}}}
+	updates <- &client.MailboxUpdate{}
+	assert.Equal(t, uint64(715), w.modSeq())
+	// the mod-sequence is only returned once
+	assert.Equal(t, uint64(0), w.modSeq())
+
+	s := NewIMAPService(IMAPConfig{})
+	cursor := imapCursor(1, 8)
+	s.polledAt(cursor, 715)
+	// the mod-sequence is saved with the cursor the poll ended at only
+	assert.Equal(t, "", s.SourceState(imapCursor(1, 7)))
+	assert.Equal(t, "715", s.SourceState(cursor))
+	assert.False(t, s.unchangedSince(cursor, 715))
+
+	s.SetSourceState(cursor, "715")
+	assert.True(t, s.unchangedSince(cursor, 715))
+	assert.False(t, s.unchangedSince(cursor, 716))
+	assert.False(t, s.unchangedSince(imapCursor(1, 7), 715))
+	s.SetSourceState(cursor, "")
+	assert.False(t, s.unchangedSince(cursor, 715))
+}
+
+func TestIMAPGetMessages(t *testing.T) {
+	be, addr := startIMAPServer(t)
+	appendIMAPMessage(t, imapMailbox(t, be, "INBOX"), rejectionRFC822)
+	s := newTestIMAPService(t, addr, "")
+
+	messages, err := s.GetMessages("me", []string{"7", "6", "99"})
+	assert.Len(t, messages, 2)
+	assert.EqualError(t, err, `failed to get 1 message(s): 99: message 99 not found in mailbox INBOX`)
+	if len(messages) != 2 {
+		return
+	}
+
+	msg := messages[0]
+	assert.Equal(t, "7", msg.ID)
+	assert.Equal(t, "Your application", msg.Subject)
+	assert.Equal(t, "Acme Recruiting <jobs@acme.example>", msg.From.String())
+	assert.Equal(t, "<rejection@acme.example>", msg.MessageID)
+	assert.Equal(t, "We regret to inform you, Renée.", msg.PlainBody)
+	assert.Equal(t, "<p>We regret to inform you.</p>", msg.HTMLBody)
+	assert.Equal(t, []string{"INBOX", "UNREAD"}, msg.LabelIDs)
+	assert.True(t, msg.HasAttachments())
+	if assert.Len(t, msg.Attachments, 1) {
+		assert.Equal(t, "offer.pdf", msg.Attachments[0].Filename)
+		assert.Equal(t, int64(8), msg.Attachments[0].Size)
+	}
+
+	assert.Equal(t, "6", messages[1].ID)
+	assert.Equal(t, "A little message, just for you", messages[1].Subject)
+	assert.Equal(t, []string{"INBOX"}, messages[1].LabelIDs)
+}
+
+func TestIMAPExecuteKeyword(t *testing.T) {
+	be, addr := startIMAPServer(t)
+	inbox := imapMailbox(t, be, "INBOX")
+	appendIMAPMessage(t, inbox, rejectionRFC822)
+	s := newTestIMAPService(t, addr, LabelModeKeyword)
+
+	plan := datamodel.Plan{MessageID: "7", AddLabels: []string{"Job Rejection", "Todo"}, MarkRead: true, Star: true}
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	assert.ElementsMatch(t, []string{"job_rejection", "todo", `\Seen`, `\Flagged`}, inbox.Messages[1].Flags)
+
+	plan = datamodel.Plan{MessageID: "7", RemoveLabels: []string{"Todo"}}
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	msg, err := s.GetMessage("me", "7")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"INBOX", "job_rejection", "STARRED"}, msg.LabelIDs)
+}
+
+func TestIMAPExecuteFolderAndArchive(t *testing.T) {
+	be, addr := startIMAPServer(t)
+	inbox := imapMailbox(t, be, "INBOX")
+	appendIMAPMessage(t, inbox, rejectionRFC822)
+	s := newTestIMAPService(t, addr, LabelModeFolder)
+
+	assert.NoError(t, s.Execute(context.Background(), datamodel.Plan{MessageID: "7", AddLabels: []string{"Rejection"}, Archive: true}))
+	assert.Len(t, imapMailbox(t, be, "Rejection").Messages, 1)
+	assert.Len(t, imapMailbox(t, be, "Archive").Messages, 1)
+	assert.Len(t, inbox.Messages, 1)
+	assert.Equal(t, uint32(6), inbox.Messages[0].Uid)
+}
+
+func TestIMAPExecuteTrashAndReplyDraft(t *testing.T) {
+	be, addr := startIMAPServer(t)
+	inbox := imapMailbox(t, be, "INBOX")
+	appendIMAPMessage(t, inbox, rejectionRFC822)
+	s := newTestIMAPService(t, addr, LabelModeKeyword)
+
+	plan := datamodel.Plan{MessageID: "7", Trash: true, ReplyDraft: "Thank you for letting me know."}
+	assert.NoError(t, s.Execute(context.Background(), plan))
+	assert.Len(t, imapMailbox(t, be, "Trash").Messages, 1)
+	assert.Len(t, inbox.Messages, 1)
+
+	drafts := imapMailbox(t, be, "Drafts").Messages
+	if assert.Len(t, drafts, 1) {
+		assert.Contains(t, drafts[0].Flags, `\Draft`)
+		draft, err := mail.ReadMessage(bytes.NewReader(drafts[0].Body))
+		assert.NoError(t, err)
+		assert.Equal(t, "Re: Your application", draft.Header.Get("Subject"))
+		body, _ := io.ReadAll(draft.Body)
+		assert.Equal(t, "Thank you for letting me know.", string(body))
+	}
+}
+
+func TestIMAPExecuteForwardNotSupported(t *testing.T) {
+	_, addr := startIMAPServer(t)
+	s := newTestIMAPService(t, addr, LabelModeKeyword)
+	assert.ErrorContains(t, s.Execute(context.Background(), datamodel.Plan{MessageID: "6", ForwardTo: []string{"me@example.org"}}), "not supported")
+}
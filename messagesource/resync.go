@@ -0,0 +1,155 @@
+package messagesource
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+)
+
+// ResyncEvent describes a resync done because the stored history id had expired
+type ResyncEvent struct {
+	UserID string
+	// StaleHistoryID is the expired history id the poll started from
+	StaleHistoryID uint64
+	// Since is the lower bound of the messages listed instead of the history
+	Since time.Time
+	// HistoryID is the new history id the polling continues from
+	HistoryID uint64
+	// Messages is the number of messages found since the lower bound
+	Messages int
+}
+
+// WithLastSync seeds the time of the last successful poll, for example from the history store,
+// it bounds the messages listed when the history id has expired
+func WithLastSync(t time.Time) GmailOption {
+	return func(s *GmailService) {
+		s.lastSync = t
+	}
+}
+
+// WithResyncWindow sets how far back to list messages on resync when the time of the last successful poll is unknown
+func WithResyncWindow(window time.Duration) GmailOption {
+	return func(s *GmailService) {
+		if window > 0 {
+			s.resyncWindow = window
+		}
+	}
+}
+
+// WithResyncHook registers a function called every time a resync happens
+func WithResyncHook(hook func(ResyncEvent)) GmailOption {
+	return func(s *GmailService) {
+		s.onResync = hook
+	}
+}
+
+// IsHistoryExpired reports whether the error is Gmail refusing a history id that is too old
+func IsHistoryExpired(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// polledAt records when the poll up to the history id started, it returns the history id
+func (s *GmailService) polledAt(historyId uint64, t time.Time) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polled.historyId, s.polled.at = historyId, t
+	return historyId
+}
+
+// SourceState returns the time of the last sync to save with the history id, in milliseconds since epoch. It is
+// the start of the last poll only if the history id is the one the poll ended at: messages of the poll after a
+// history id saved part way through must still be listed by a resync.
+func (s *GmailService) SourceState(historyId uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lastSync := s.lastSync
+	if historyId == s.polled.historyId && !s.polled.at.IsZero() {
+		lastSync = s.polled.at
+	}
+	if lastSync.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(lastSync.UnixMilli(), 10)
+}
+
+// SetSourceState sets the time of the last sync saved with the history id, once it is read or written. Without
+// one, the time seeded by WithLastSync is kept.
+func (s *GmailService) SetSourceState(historyId uint64, state string) {
+	millis, err := strconv.ParseInt(state, 10, 64)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSync = time.UnixMilli(millis)
+}
+
+// resync lists the messages received since the last successful poll, and reseeds the history id from the profile
+func (s *GmailService) resync(userId string, staleHistoryId uint64) (uint64, []string, error) {
+	s.mu.Lock()
+	since := s.lastSync
+	s.mu.Unlock()
+	if since.IsZero() {
+		since = time.Now().Add(-s.resyncWindow)
+	}
+	logging.Logger.Warn("history id expired, resyncing", zap.String("user", userId), zap.Uint64("historyId", staleHistoryId), zap.Time("since", since))
+
+	// take the profile history id first, so messages arriving while listing show up in the next history
+	profile, err := s.Gmail.Users.GetProfile(userId).Do()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get profile for resync: %w", err)
+	}
+	ids, err := s.listMessageIdsSince(userId, since)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list messages for resync: %w", err)
+	}
+
+	event := ResyncEvent{
+		UserID:         userId,
+		StaleHistoryID: staleHistoryId,
+		Since:          since,
+		HistoryID:      profile.HistoryId,
+		Messages:       len(ids),
+	}
+	logging.Logger.Warn("resynced", zap.Any("resync", event))
+	if s.onResync != nil {
+		s.onResync(event)
+	}
+	return profile.HistoryId, ids, nil
+}
+
+// listMessageIdsSince lists the ids of the messages received after the given time, oldest first
+func (s *GmailService) listMessageIdsSince(userId string, since time.Time) ([]string, error) {
+	var ids []string
+	query := fmt.Sprintf("after:%d", since.Unix())
+	var nextPageToken string
+	for {
+		req := s.Gmail.Users.Messages.List(userId).Q(query).MaxResults(500)
+		if nextPageToken != "" {
+			req = req.PageToken(nextPageToken)
+		}
+		resp, err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range resp.Messages {
+			ids = append(ids, m.Id)
+		}
+		nextPageToken = resp.NextPageToken
+		if nextPageToken == "" {
+			break
+		}
+	}
+	// Gmail lists the newest messages first
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, nil
+}
@@ -0,0 +1,151 @@
+package messagesource
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestGetMessageIdsIncremental(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 120
+	fake.oldestHistoryId = 50
+	fake.history = []*gmail.History{
+		{Id: 101, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "a"}}}},
+		{Id: 110, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "b"}}, {Message: &gmail.Message{Id: "c"}}}},
+	}
+
+	resynced := false
+	s := NewGmailService(fake.start(t), WithResyncHook(func(ResyncEvent) { resynced = true }))
+	historyId, ids, err := s.GetMessageIds("me", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(110), historyId)
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+	assert.False(t, resynced)
+}
+
+func TestGetMessageIdsResyncsExpiredHistory(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 5000
+	fake.oldestHistoryId = 4000
+	fake.pageSize = 2
+	lastSync := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"old", "new1", "new2", "new3"} {
+		received := lastSync.Add(time.Duration(i*2-1) * time.Hour)
+		fake.messages[id] = &gmail.Message{Id: id, InternalDate: received.UnixMilli()}
+	}
+
+	var events []ResyncEvent
+	s := NewGmailService(fake.start(t), WithLastSync(lastSync), WithResyncHook(func(e ResyncEvent) { events = append(events, e) }))
+	historyId, ids, err := s.GetMessageIds("me", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5000), historyId)
+	assert.Equal(t, []string{"new1", "new2", "new3"}, ids)
+	assert.Equal(t, []string{"after:1680350400"}, fake.queries[:1])
+	assert.Len(t, events, 1)
+	assert.Equal(t, ResyncEvent{UserID: "me", StaleHistoryID: 100, Since: lastSync, HistoryID: 5000, Messages: 3}, events[0])
+
+	// the next poll continues from the reseeded history id
+	fake.history = []*gmail.History{{Id: 5001, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "later"}}}}}
+	historyId, ids, err = s.GetMessageIds("me", historyId)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5001), historyId)
+	assert.Equal(t, []string{"later"}, ids)
+	assert.Len(t, events, 1)
+}
+
+func TestGetMessageIdsResyncWindow(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 10
+	fake.oldestHistoryId = 5
+
+	s := NewGmailService(fake.start(t), WithResyncWindow(48*time.Hour))
+	before := time.Now().Add(-48 * time.Hour).Unix()
+	_, _, err := s.GetMessageIds("me", 1)
+	assert.NoError(t, err)
+	assert.Len(t, fake.queries, 1)
+	var after int64
+	_, err = fmt.Sscanf(fake.queries[0], "after:%d", &after)
+	assert.NoError(t, err)
+	assert.InDelta(t, before, after, 5)
+}
+
+func TestLastSyncState(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 120
+	fake.oldestHistoryId = 50
+	fake.history = []*gmail.History{
+		{Id: 101, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "a"}}}},
+		{Id: 110, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "b"}}}},
+	}
+	seeded := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	s := NewGmailService(fake.start(t), WithLastSync(seeded))
+
+	started := time.Now()
+	historyId, _, err := s.GetHistory("me", 100)
+	assert.NoError(t, err)
+	// the poll does not move the last sync until its history id is saved
+	assert.Equal(t, seeded, s.lastSync)
+	// a history id part way through the poll keeps the last sync
+	assert.Equal(t, strconv.FormatInt(seeded.UnixMilli(), 10), s.SourceState(101))
+	state := s.SourceState(historyId)
+	millis, err := strconv.ParseInt(state, 10, 64)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, started, time.UnixMilli(millis), time.Second)
+
+	s.SetSourceState(historyId, state)
+	assert.Equal(t, time.UnixMilli(millis), s.lastSync)
+	// a history saved without the last sync keeps the seeded one
+	s.SetSourceState(historyId, "")
+	assert.Equal(t, time.UnixMilli(millis), s.lastSync)
+}
+
+func TestGetMessageIdsBootstrap(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 700
+	now := time.Now()
+	fake.messages["recent"] = &gmail.Message{Id: "recent", InternalDate: now.Add(-24 * time.Hour).UnixMilli()}
+	fake.messages["older"] = &gmail.Message{Id: "older", InternalDate: now.Add(-72 * time.Hour).UnixMilli()}
+	fake.messages["oldest"] = &gmail.Message{Id: "oldest", InternalDate: now.Add(-30 * 24 * time.Hour).UnixMilli()}
+
+	// without backfill the polling starts from the profile history id
+	s := NewGmailService(fake.start(t))
+	historyId, ids, err := s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(700), historyId)
+	assert.Empty(t, ids)
+	assert.Empty(t, fake.queries)
+
+	// with backfill the messages of the window are processed first
+	s = NewGmailService(fake.start(t), WithBackfill(7))
+	historyId, ids, err = s.GetMessageIds("me", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(700), historyId)
+	assert.Equal(t, []string{"older", "recent"}, ids)
+}
+
+func TestGetHistoryRecords(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 120
+	fake.oldestHistoryId = 50
+	fake.history = []*gmail.History{
+		{Id: 101, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "a"}}}},
+		{Id: 105},
+		{Id: 110, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "b"}}, {Message: &gmail.Message{Id: "c"}}}},
+	}
+
+	s := NewGmailService(fake.start(t))
+	historyId, records, err := s.GetHistory("me", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(110), historyId)
+	// only the records adding messages are returned, each at its own history id
+	assert.Equal(t, []datamodel.HistoryRecord{
+		{HistoryID: 101, MessageIDs: []string{"a"}},
+		{HistoryID: 110, MessageIDs: []string{"b", "c"}},
+	}, records)
+}
@@ -0,0 +1,138 @@
+package messagesource
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	integration "github.com/jyouturer/gmail-ai/integration"
+	"google.golang.org/api/gmail/v1"
+)
+
+// parseRFC822 parses a raw RFC 5322 message into the shape of a Gmail API message in "full" format,
+// so messages from other sources go through the same conversion as Gmail ones
+func parseRFC822(id string, raw []byte) (*gmail.Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message %s: %w", id, err)
+	}
+	payload, err := buildPart("", textproto.MIMEHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message %s: %w", id, err)
+	}
+	return &gmail.Message{
+		Id:           id,
+		Payload:      payload,
+		SizeEstimate: int64(len(raw)),
+	}, nil
+}
+
+// buildPart builds the MIME part and its children, the body of leaf parts is stored decoded like the Gmail API does
+func buildPart(partID string, header textproto.MIMEHeader, body io.Reader, depth int) (*gmail.MessagePart, error) {
+	if depth > integration.MaxPartDepth {
+		return nil, fmt.Errorf("MIME parts nested deeper than %d", integration.MaxPartDepth)
+	}
+	part := &gmail.MessagePart{PartId: partID, MimeType: "text/plain"}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil {
+		part.MimeType = mediaType
+	}
+
+	if strings.HasPrefix(part.MimeType, "multipart/") && params["boundary"] != "" {
+		part.Headers = partHeaders(header, false)
+		part.Body = &gmail.MessagePartBody{}
+		r := multipart.NewReader(body, params["boundary"])
+		for i := 0; ; i++ {
+			// raw parts keep the transfer encoding header, it is decoded below
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			childID := strconv.Itoa(i)
+			if partID != "" {
+				childID = partID + "." + childID
+			}
+			child, err := buildPart(childID, p.Header, p, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return nil, err
+	}
+	part.Headers = partHeaders(header, true)
+	part.Filename = partFilename(header, params)
+	part.Body = &gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString(data),
+		Size: int64(len(data)),
+	}
+	return part, nil
+}
+
+// partHeaders lists the headers in a stable order, the transfer encoding is left out of decoded parts
+func partHeaders(header textproto.MIMEHeader, decoded bool) []*gmail.MessagePartHeader {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if decoded && name == "Content-Transfer-Encoding" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers []*gmail.MessagePartHeader
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, &gmail.MessagePartHeader{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// partFilename returns the decoded file name of the part from its disposition or content type
+func partFilename(header textproto.MIMEHeader, contentTypeParams map[string]string) string {
+	filename := contentTypeParams["name"]
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	return decodeHeader(filename)
+}
+
+// decodeTransferEncoding reads the body, removing its base64 or quoted-printable transfer encoding
+func decodeTransferEncoding(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		cleaned := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(data))
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(cleaned, "="))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(body))
+	default:
+		return ioutil.ReadAll(body)
+	}
+}
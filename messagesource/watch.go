@@ -0,0 +1,74 @@
+package messagesource
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Gmail watches expire after 7 days, Google recommends renewing them once a day
+const (
+	watchRenewInterval = 24 * time.Hour
+	// watchRenewMargin is how long before the expiration the watch is renewed at the latest
+	watchRenewMargin = time.Hour
+	// watchRetryInterval is how long to wait before retrying a failed renewal
+	watchRetryInterval = time.Minute
+)
+
+// Watch asks Gmail to publish a notification to the Pub/Sub topic ("projects/<project>/topics/<topic>")
+// when the inbox changes. It returns the current history id and when the watch expires.
+func (s *GmailService) Watch(userId, topicName string) (uint64, time.Time, error) {
+	resp, err := s.Gmail.Users.Watch(userId, &gmail.WatchRequest{
+		LabelIds:  []string{"INBOX"},
+		TopicName: topicName,
+	}).Do()
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to set up Gmail watch: %w", err)
+	}
+	// expiration is in milliseconds since epoch
+	return resp.HistoryId, time.UnixMilli(resp.Expiration), nil
+}
+
+// EmailAddress returns the email address of the mailbox, the one its push notifications are for
+func (s *GmailService) EmailAddress(userId string) (string, error) {
+	profile, err := s.Gmail.Users.GetProfile(userId).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get profile: %w", err)
+	}
+	return profile.EmailAddress, nil
+}
+
+// KeepWatching sets up the watch and renews it before it expires, until the context is done
+func (s *GmailService) KeepWatching(ctx context.Context, userId, topicName string) error {
+	for {
+		wait := watchRetryInterval
+		historyId, expiration, err := s.Watch(userId, topicName)
+		if err != nil {
+			logging.Logger.Error("unable to renew Gmail watch", zap.String("topic", topicName), zap.Error(err))
+		} else {
+			wait = nextWatchRenewal(time.Now(), expiration)
+			logging.Logger.Info("Gmail watch renewed", zap.String("topic", topicName), zap.Uint64("historyId", historyId), zap.Time("expiration", expiration), zap.Duration("next", wait))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// nextWatchRenewal returns how long to wait before renewing a watch expiring at the given time
+func nextWatchRenewal(now, expiration time.Time) time.Duration {
+	wait := expiration.Add(-watchRenewMargin).Sub(now)
+	if wait > watchRenewInterval {
+		wait = watchRenewInterval
+	}
+	if wait < watchRetryInterval {
+		wait = watchRetryInterval
+	}
+	return wait
+}
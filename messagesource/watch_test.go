@@ -0,0 +1,38 @@
+package messagesource
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	fake := newFakeGmail()
+	fake.historyId = 4242
+	s := NewGmailService(fake.start(t))
+
+	historyId, expiration, err := s.Watch("me", "projects/myproject/topics/gmail")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4242), historyId)
+	assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), expiration, time.Minute)
+	if assert.Len(t, fake.watches, 1) {
+		assert.Equal(t, "projects/myproject/topics/gmail", fake.watches[0].TopicName)
+		assert.Equal(t, []string{"INBOX"}, fake.watches[0].LabelIds)
+	}
+
+	// the fake profile has the user id as email address
+	emailAddress, err := s.EmailAddress("jane@example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.org", emailAddress)
+}
+
+func TestNextWatchRenewal(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	// a fresh watch is renewed daily
+	assert.Equal(t, 24*time.Hour, nextWatchRenewal(now, now.Add(7*24*time.Hour)))
+	// a watch close to its expiration is renewed before it expires
+	assert.Equal(t, 2*time.Hour, nextWatchRenewal(now, now.Add(3*time.Hour)))
+	// an expired watch is renewed soon, without hammering the API
+	assert.Equal(t, time.Minute, nextWatchRenewal(now, now.Add(-time.Hour)))
+}
@@ -0,0 +1,270 @@
+package polling
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// DeadLetter is a message whose processing failed for good, kept to be replayed once the cause is fixed
+type DeadLetter struct {
+	Account  string            `json:"account"`
+	Message  datamodel.Message `json:"message"`
+	Error    string            `json:"error"`
+	Attempts int               `json:"attempts"`
+	Time     time.Time         `json:"time"`
+}
+
+// key identifies the dead letter, a message is in the queue at most once
+func (d DeadLetter) key() string {
+	return dedupeKey(d.Account, d.Message.ID)
+}
+
+// deadLetterRecord is a line of the queue file, removing a message is recorded with a line too
+type deadLetterRecord struct {
+	DeadLetter
+	Removed bool `json:"removed,omitempty"`
+}
+
+// DeadLetterQueue keeps the messages that could not be processed in a file, as JSON lines. Every change is
+// appended to the file and synced to disk before it returns, so dead letters survive crashes. The lines which
+// can not be read back are moved to the file with the ".corrupt" suffix when the queue is opened.
+type DeadLetterQueue struct {
+	filename string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	letters map[string]DeadLetter
+	file    *os.File
+	lines   int
+}
+
+// OpenDeadLetterQueue opens the dead-letter queue persisted in the file, it is created if it does not exist
+func OpenDeadLetterQueue(filename string) (*DeadLetterQueue, error) {
+	q := &DeadLetterQueue{
+		filename: filename,
+		now:      time.Now,
+		letters:  map[string]DeadLetter{},
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(q.letters); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Add puts the message in the queue, replacing the dead letter of the same message if any
+func (q *DeadLetterQueue) Add(letter DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if letter.Time.IsZero() {
+		letter.Time = q.now()
+	}
+	if err := q.append(deadLetterRecord{DeadLetter: letter}); err != nil {
+		return err
+	}
+	q.letters[letter.key()] = letter
+	return nil
+}
+
+// Remove takes the message of the account out of the queue
+func (q *DeadLetterQueue) Remove(account, messageID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := dedupeKey(account, messageID)
+	letter, ok := q.letters[key]
+	if !ok {
+		return nil
+	}
+	if err := q.append(deadLetterRecord{DeadLetter: letter, Removed: true}); err != nil {
+		return err
+	}
+	delete(q.letters, key)
+	if q.lines > 2*len(q.letters)+100 {
+		return q.compact(q.letters)
+	}
+	return nil
+}
+
+// List returns the dead letters, oldest first
+func (q *DeadLetterQueue) List() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := make([]DeadLetter, 0, len(q.letters))
+	for _, letter := range q.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].Time.Equal(letters[j].Time) {
+			return letters[i].key() < letters[j].key()
+		}
+		return letters[i].Time.Before(letters[j].Time)
+	})
+	return letters
+}
+
+// Len returns the number of dead letters
+func (q *DeadLetterQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.letters)
+}
+
+// Purge empties the queue, the dead letters are kept if the file could not be emptied
+func (q *DeadLetterQueue) Purge() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := map[string]DeadLetter{}
+	if err := q.compact(letters); err != nil {
+		return err
+	}
+	q.letters = letters
+	return nil
+}
+
+// Close closes the file of the queue
+func (q *DeadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// append writes the record at the end of the file and syncs it
+func (q *DeadLetterQueue) append(record deadLetterRecord) error {
+	if q.file == nil {
+		return fmt.Errorf("unable to save dead letter: the queue is closed")
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode dead letter: %w", err)
+	}
+	if _, err := q.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to save dead letter: %w", err)
+	}
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("unable to save dead letter: %w", err)
+	}
+	q.lines++
+	return nil
+}
+
+// load replays the records of the file, the corrupt lines are moved aside
+func (q *DeadLetterQueue) load() error {
+	f, err := os.Open(q.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open dead-letter queue: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// a line holds a whole message
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var corrupt [][]byte
+	for n := 1; scanner.Scan(); n++ {
+		var record deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a line cut by a crash, or edited by hand
+			logging.Logger.Warn("corrupt line in dead-letter queue", zap.String("file", q.filename), zap.Int("line", n), zap.Error(err))
+			corrupt = append(corrupt, append([]byte(nil), scanner.Bytes()...))
+			continue
+		}
+		if record.Removed {
+			delete(q.letters, record.key())
+		} else {
+			q.letters[record.key()] = record.DeadLetter
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read dead-letter queue: %w", err)
+	}
+	return q.keepCorrupt(corrupt)
+}
+
+// keepCorrupt appends the corrupt lines to the ".corrupt" file, before compacting drops them from the queue
+func (q *DeadLetterQueue) keepCorrupt(lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	filename := q.filename + ".corrupt"
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to keep corrupt dead letters: %w", err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("unable to keep corrupt dead letters: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("unable to keep corrupt dead letters: %w", err)
+	}
+	logging.Logger.Warn("corrupt dead letters moved aside", zap.String("file", filename), zap.Int("lines", len(lines)))
+	return nil
+}
+
+// compact rewrites the file with the letters only, and reopens it for appending. The file is left as it was
+// if it fails.
+func (q *DeadLetterQueue) compact(letters map[string]DeadLetter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.filename), filepath.Base(q.filename)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to compact dead-letter queue: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	lines := 0
+	for _, letter := range letters {
+		line, err := json.Marshal(deadLetterRecord{DeadLetter: letter})
+		if err != nil {
+			continue
+		}
+		w.Write(append(line, '\n'))
+		lines++
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dead-letter queue: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dead-letter queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dead-letter queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.filename); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dead-letter queue: %w", err)
+	}
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+	f, err := os.OpenFile(q.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open dead-letter queue: %w", err)
+	}
+	q.file = f
+	q.lines = lines
+	return nil
+}
@@ -0,0 +1,142 @@
+package polling
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeadLetterQueuePersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	q, err := OpenDeadLetterQueue(filename)
+	assert.NoError(t, err)
+	start := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "c"} {
+		letter := DeadLetter{Account: "me", Message: datamodel.Message{ID: id, Subject: "subject " + id}, Error: "boom", Attempts: 3, Time: start.Add(time.Duration(i) * time.Minute)}
+		assert.NoError(t, q.Add(letter))
+	}
+	assert.NoError(t, q.Remove("me", "b"))
+	// removing a message not in the queue does nothing
+	assert.NoError(t, q.Remove("me", "z"))
+	assert.NoError(t, q.Close())
+
+	q, err = OpenDeadLetterQueue(filename)
+	assert.NoError(t, err)
+	letters := q.List()
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "a", letters[0].Message.ID)
+		assert.Equal(t, "subject a", letters[0].Message.Subject)
+		assert.Equal(t, 3, letters[0].Attempts)
+		assert.Equal(t, "c", letters[1].Message.ID)
+	}
+
+	assert.NoError(t, q.Purge())
+	assert.NoError(t, q.Close())
+	q, err = OpenDeadLetterQueue(filename)
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestDeadLetterQueueCorruptLines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	data := `{"account":"me","message":{"id":"a"},"error":"boom"}` + "\n" +
+		`{"account":"me","message":{"id":` + "\n" +
+		`{"account":"me","message":{"id":"b"},"error":"boom"}` + "\n"
+	assert.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+
+	// the corrupt line is moved aside, the others are loaded
+	q, err := OpenDeadLetterQueue(filename)
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 2, q.Len())
+	corrupt, err := os.ReadFile(filename + ".corrupt")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"account":"me","message":{"id":`+"\n", string(corrupt))
+}
+
+func TestDeadLetterQueuePurgeFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	q, err := OpenDeadLetterQueue(filepath.Join(dir, "deadletters.jsonl"))
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.NoError(t, q.Add(DeadLetter{Account: "me", Message: datamodel.Message{ID: "a"}}))
+
+	// the file can not be rewritten, the dead letters are kept
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, q.Purge())
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestPollAndProcessDeadLetters(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &flakyHandler{
+		err:      status.Error(codes.Unavailable, "classifier restarting"),
+		failures: map[string]int{"b": 100},
+		calls:    map[string]int{},
+	}
+	history := NewMemoryHistory(0)
+	q, err := OpenDeadLetterQueue(filepath.Join(t.TempDir(), "deadletters.jsonl"))
+	assert.NoError(t, err)
+	defer q.Close()
+	provider := NewMessageProvider(service,
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}),
+		WithDeadLetterQueue(q))
+
+	// b exhausts its retries and goes to the dead-letter queue, the cursor does not wait for it
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, 3, h.callsOf("b"))
+	assert.Equal(t, uint64(3), readHistory(t, history))
+	letters := q.List()
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "me", letters[0].Account)
+		assert.Equal(t, "b", letters[0].Message.ID)
+		assert.Equal(t, 3, letters[0].Attempts)
+		assert.Contains(t, letters[0].Error, "classifier restarting")
+	}
+
+	// the replay fails while the classifier is still down, and keeps the message
+	replayed, err := provider.ReplayDeadLetters(context.Background(), q, []MessageHandlerFunc{h.handle})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 4, q.List()[0].Attempts)
+
+	// once it is back, the message is replayed and leaves the queue
+	h.mu.Lock()
+	h.failures["b"] = 0
+	h.mu.Unlock()
+	replayed, err = provider.ReplayDeadLetters(context.Background(), q, []MessageHandlerFunc{h.handle})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestReplayDeadLettersOfMessages(t *testing.T) {
+	q, err := OpenDeadLetterQueue(filepath.Join(t.TempDir(), "deadletters.jsonl"))
+	assert.NoError(t, err)
+	defer q.Close()
+	for _, id := range []string{"a", "b"} {
+		assert.NoError(t, q.Add(DeadLetter{Account: "me", Message: datamodel.Message{ID: id}, Error: "boom", Attempts: 1}))
+	}
+	// a dead letter of another account is not replayed
+	assert.NoError(t, q.Add(DeadLetter{Account: "jane@example.org", Message: datamodel.Message{ID: "a"}, Error: "boom", Attempts: 1}))
+
+	// the messages are not in the service anymore, the saved copies are replayed
+	h := &recordingHandler{}
+	provider := NewMessageProvider(&fakeService{})
+	replayed, err := provider.ReplayDeadLetters(context.Background(), q, []MessageHandlerFunc{h.handle}, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, []string{"a"}, h.messages())
+	assert.Equal(t, 2, q.Len())
+}
@@ -0,0 +1,219 @@
+package polling
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default bounds of the dedupe store
+const (
+	DefaultDedupeSize = 10000
+	DefaultDedupeTTL  = 30 * 24 * time.Hour
+)
+
+// dedupeEntry is a processed message, identified by its account and message id
+type dedupeEntry struct {
+	key       string
+	processed time.Time
+}
+
+// DedupeStore remembers the messages already processed, so messages showing up again in the history,
+// after label changes or resyncs, are not processed twice. It keeps at most maxSize messages, for at most ttl.
+// When opened on a file, every processed message is appended to it and the file is compacted when it grows
+// to twice the size of the store.
+type DedupeStore struct {
+	maxSize int
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // oldest first
+	filename string
+	file     *os.File
+	lines    int
+}
+
+// NewDedupeStore creates a dedupe store kept in memory only
+func NewDedupeStore(maxSize int, ttl time.Duration) *DedupeStore {
+	if maxSize <= 0 {
+		maxSize = DefaultDedupeSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultDedupeTTL
+	}
+	return &DedupeStore{
+		maxSize: maxSize,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// OpenDedupeStore opens the dedupe store persisted in the file, it is created if it does not exist
+func OpenDedupeStore(filename string, maxSize int, ttl time.Duration) (*DedupeStore, error) {
+	s := NewDedupeStore(maxSize, ttl)
+	s.filename = filename
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// rewriting drops the expired and evicted messages of the previous runs
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dedupeKey joins the account and the message id
+func dedupeKey(account, messageID string) string {
+	return account + "\t" + messageID
+}
+
+// Contains reports whether the message of the account was processed, and did not expire yet. It is O(1).
+func (s *DedupeStore) Contains(account, messageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[dedupeKey(account, messageID)]
+	if !ok {
+		return false
+	}
+	return s.now().Sub(e.Value.(*dedupeEntry).processed) < s.ttl
+}
+
+// Add records the message of the account as processed
+func (s *DedupeStore) Add(account, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &dedupeEntry{key: dedupeKey(account, messageID), processed: s.now()}
+	s.put(entry)
+	if s.file == nil {
+		return nil
+	}
+	if _, err := s.file.WriteString(formatDedupeEntry(entry)); err != nil {
+		return fmt.Errorf("unable to save processed message: %w", err)
+	}
+	s.lines++
+	if s.lines > 2*s.maxSize {
+		return s.compact()
+	}
+	return nil
+}
+
+// put inserts or refreshes the entry, evicting the expired and the oldest entries over the size
+func (s *DedupeStore) put(entry *dedupeEntry) {
+	if e, ok := s.entries[entry.key]; ok {
+		s.order.Remove(e)
+	}
+	s.entries[entry.key] = s.order.PushBack(entry)
+	for s.order.Len() > 0 {
+		oldest := s.order.Front().Value.(*dedupeEntry)
+		if s.order.Len() <= s.maxSize && entry.processed.Sub(oldest.processed) < s.ttl {
+			break
+		}
+		s.order.Remove(s.order.Front())
+		delete(s.entries, oldest.key)
+	}
+}
+
+// Len returns the number of messages in the store
+func (s *DedupeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// Close closes the file of the store
+func (s *DedupeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// formatDedupeEntry formats the entry as a line of the file: the unix time, the account and the message id
+func formatDedupeEntry(entry *dedupeEntry) string {
+	return strconv.FormatInt(entry.processed.Unix(), 10) + "\t" + entry.key + "\n"
+}
+
+// load reads the entries of the file, in the order they were processed
+func (s *DedupeStore) load() error {
+	f, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open dedupe store: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		processed, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		s.put(&dedupeEntry{key: fields[1], processed: time.Unix(processed, 0)})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read dedupe store: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the file with the current entries only, and reopens it for appending
+func (s *DedupeStore) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	now := s.now()
+	tmp, err := os.CreateTemp(filepath.Dir(s.filename), filepath.Base(s.filename)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to compact dedupe store: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	lines := 0
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*dedupeEntry)
+		if now.Sub(entry.processed) >= s.ttl {
+			continue
+		}
+		w.WriteString(formatDedupeEntry(entry))
+		lines++
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dedupe store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dedupe store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.filename); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact dedupe store: %w", err)
+	}
+	f, err := os.OpenFile(s.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open dedupe store: %w", err)
+	}
+	s.file = f
+	s.lines = lines
+	return nil
+}
@@ -0,0 +1,120 @@
+package polling
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a settable clock for the dedupe store
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestDedupeStore(t *testing.T) {
+	s := NewDedupeStore(2, time.Hour)
+	assert.False(t, s.Contains("me", "a"))
+	assert.NoError(t, s.Add("me", "a"))
+	assert.True(t, s.Contains("me", "a"))
+	// messages are keyed by account
+	assert.False(t, s.Contains("jane@example.org", "a"))
+
+	assert.NoError(t, s.Add("me", "b"))
+	assert.NoError(t, s.Add("me", "c"))
+	// the oldest message is evicted over the size
+	assert.Equal(t, 2, s.Len())
+	assert.False(t, s.Contains("me", "a"))
+	assert.True(t, s.Contains("me", "b"))
+	assert.True(t, s.Contains("me", "c"))
+}
+
+func TestDedupeStoreExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)}
+	s := NewDedupeStore(10, time.Hour)
+	s.now = clock.Now
+
+	assert.NoError(t, s.Add("me", "a"))
+	clock.now = clock.now.Add(30 * time.Minute)
+	assert.NoError(t, s.Add("me", "b"))
+	assert.True(t, s.Contains("me", "a"))
+
+	clock.now = clock.now.Add(31 * time.Minute)
+	assert.False(t, s.Contains("me", "a"))
+	assert.True(t, s.Contains("me", "b"))
+
+	// adding drops the expired messages
+	assert.NoError(t, s.Add("me", "c"))
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestDedupeStorePersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "processed.txt")
+	s, err := OpenDedupeStore(filename, 3, time.Hour)
+	assert.NoError(t, err)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, s.Add("me", id))
+	}
+	assert.NoError(t, s.Close())
+
+	s, err = OpenDedupeStore(filename, 3, time.Hour)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.False(t, s.Contains("me", "a"))
+	assert.True(t, s.Contains("me", "b"))
+	assert.True(t, s.Contains("me", "d"))
+	// reopening compacts the file to the messages still in the store
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	// the file is compacted when it grows to twice the size of the store
+	for _, id := range []string{"e", "f", "g", "h"} {
+		assert.NoError(t, s.Add("me", id))
+	}
+	data, err = os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+	assert.True(t, s.Contains("me", "h"))
+}
+
+func TestPollAndProcessSkipsProcessedMessages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "processed.txt")
+	store, err := OpenDedupeStore(filename, 100, time.Hour)
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var handled []string
+	handler := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.ID)
+		return nil, nil
+	}
+
+	service := &fakeService{}
+	service.receive("a", "b")
+	provider := NewMessageProvider(service, WithDedupeStore(store))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), NewMemoryHistory(0), []MessageHandlerFunc{handler}))
+	assert.ElementsMatch(t, []string{"a", "b"}, handled)
+	assert.NoError(t, store.Close())
+
+	// after a restart, the same messages showing up again in the history are skipped
+	store, err = OpenDedupeStore(filename, 100, time.Hour)
+	assert.NoError(t, err)
+	defer store.Close()
+	service.receive("c")
+	provider = NewMessageProvider(service, WithDedupeStore(store))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), NewMemoryHistory(0), []MessageHandlerFunc{handler}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, handled)
+}
@@ -0,0 +1,87 @@
+package polling
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// ActionExecutor applies the plan of a message, the message sources implement it
+type ActionExecutor interface {
+	Execute(ctx context.Context, plan datamodel.Plan) error
+}
+
+// ActionExecutorFunc is a function applying the plan of a message
+type ActionExecutorFunc func(ctx context.Context, plan datamodel.Plan) error
+
+// Execute calls the function
+func (f ActionExecutorFunc) Execute(ctx context.Context, plan datamodel.Plan) error {
+	return f(ctx, plan)
+}
+
+// MergeActions merges the actions planned by the handlers of a message into its plan. Duplicates are dropped,
+// and conflicts are settled: a label both added and removed is added, a message trashed is not archived, and
+// only the first reply draft is kept.
+func MergeActions(messageID string, actions []datamodel.Action) datamodel.Plan {
+	plan := datamodel.Plan{MessageID: messageID}
+	added := map[string]bool{}
+	removed := map[string]bool{}
+	forwarded := map[string]bool{}
+	for _, a := range actions {
+		switch a.Type {
+		case datamodel.ActionAddLabel:
+			if a.Label != "" && !added[a.Label] {
+				added[a.Label] = true
+				plan.AddLabels = append(plan.AddLabels, a.Label)
+			}
+		case datamodel.ActionRemoveLabel:
+			if a.Label != "" && !removed[a.Label] {
+				removed[a.Label] = true
+				plan.RemoveLabels = append(plan.RemoveLabels, a.Label)
+			}
+		case datamodel.ActionArchive:
+			plan.Archive = true
+		case datamodel.ActionMarkRead:
+			plan.MarkRead = true
+		case datamodel.ActionStar:
+			plan.Star = true
+		case datamodel.ActionTrash:
+			plan.Trash = true
+		case datamodel.ActionForward:
+			to := strings.ToLower(strings.TrimSpace(a.To))
+			if to != "" && !forwarded[to] {
+				forwarded[to] = true
+				plan.ForwardTo = append(plan.ForwardTo, strings.TrimSpace(a.To))
+			}
+		case datamodel.ActionReplyDraft:
+			if plan.ReplyDraft == "" {
+				plan.ReplyDraft = a.Body
+			} else if a.Body != plan.ReplyDraft {
+				logging.Logger.Warn("dropping a second reply draft", zap.String("message", messageID))
+			}
+		default:
+			logging.Logger.Warn("dropping unknown action", zap.String("message", messageID), zap.String("action", string(a.Type)))
+		}
+	}
+	// the label added wins over the label removed
+	if len(removed) > 0 {
+		kept := plan.RemoveLabels[:0]
+		for _, label := range plan.RemoveLabels {
+			if !added[label] {
+				kept = append(kept, label)
+			}
+		}
+		plan.RemoveLabels = kept
+		if len(kept) == 0 {
+			plan.RemoveLabels = nil
+		}
+	}
+	// the trash takes the message out of the inbox anyway
+	if plan.Trash {
+		plan.Archive = false
+	}
+	return plan
+}
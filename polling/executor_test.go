@@ -0,0 +1,185 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingExecutor records the plans it applies, and fails the number of times it is told to
+type recordingExecutor struct {
+	mu       sync.Mutex
+	plans    []datamodel.Plan
+	err      error
+	failures int
+}
+
+func (e *recordingExecutor) Execute(ctx context.Context, plan datamodel.Plan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures > 0 {
+		e.failures--
+		return e.err
+	}
+	e.plans = append(e.plans, plan)
+	return nil
+}
+
+func (e *recordingExecutor) applied() []datamodel.Plan {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]datamodel.Plan(nil), e.plans...)
+}
+
+// planning returns a handler planning the actions on every message
+func planning(actions ...datamodel.Action) MessageHandlerFunc {
+	return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		return actions, nil
+	}
+}
+
+func TestMergeActions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		actions []datamodel.Action
+		plan    datamodel.Plan
+	}{
+		{"no action", nil, datamodel.Plan{MessageID: "1"}},
+		{
+			"duplicates",
+			[]datamodel.Action{datamodel.AddLabel("Jobs"), datamodel.AddLabel("Jobs"), datamodel.MarkRead(), datamodel.MarkRead()},
+			datamodel.Plan{MessageID: "1", AddLabels: []string{"Jobs"}, MarkRead: true},
+		},
+		{
+			"label added and removed",
+			[]datamodel.Action{datamodel.RemoveLabel("Jobs"), datamodel.RemoveLabel("Todo"), datamodel.AddLabel("Jobs")},
+			datamodel.Plan{MessageID: "1", AddLabels: []string{"Jobs"}, RemoveLabels: []string{"Todo"}},
+		},
+		{
+			"only label removed is added",
+			[]datamodel.Action{datamodel.RemoveLabel("Jobs"), datamodel.AddLabel("Jobs")},
+			datamodel.Plan{MessageID: "1", AddLabels: []string{"Jobs"}},
+		},
+		{
+			"trash and archive",
+			[]datamodel.Action{datamodel.Archive(), datamodel.Trash(), datamodel.Star()},
+			datamodel.Plan{MessageID: "1", Trash: true, Star: true},
+		},
+		{
+			"forwards",
+			[]datamodel.Action{datamodel.Forward("Me@example.org"), datamodel.Forward(" me@example.org"), datamodel.Forward("you@example.org")},
+			datamodel.Plan{MessageID: "1", ForwardTo: []string{"Me@example.org", "you@example.org"}},
+		},
+		{
+			"reply drafts",
+			[]datamodel.Action{datamodel.ReplyDraft("thanks"), datamodel.ReplyDraft("no thanks")},
+			datamodel.Plan{MessageID: "1", ReplyDraft: "thanks"},
+		},
+		{
+			"invalid actions",
+			[]datamodel.Action{datamodel.AddLabel(""), datamodel.Forward(""), {Type: "explode"}},
+			datamodel.Plan{MessageID: "1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := MergeActions("1", tc.actions)
+			assert.Equal(t, tc.plan, plan)
+		})
+	}
+	assert.True(t, MergeActions("1", nil).Empty())
+	assert.False(t, MergeActions("1", []datamodel.Action{datamodel.Star()}).Empty())
+}
+
+func TestPollAndProcessExecutesMergedActions(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	executor := &recordingExecutor{}
+	labeling := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		if msg.ID == "b" {
+			// nothing to do with this message
+			return nil, nil
+		}
+		return []datamodel.Action{datamodel.AddLabel("Jobs"), datamodel.MarkRead()}, nil
+	}
+	provider := NewMessageProvider(service, WithActionExecutor(executor))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), NewMemoryHistory(0), []MessageHandlerFunc{
+		labeling,
+		planning(datamodel.AddLabel("Jobs"), datamodel.Archive()),
+	}))
+	assert.ElementsMatch(t, []datamodel.Plan{
+		{MessageID: "a", AddLabels: []string{"Jobs"}, MarkRead: true, Archive: true},
+		{MessageID: "b", AddLabels: []string{"Jobs"}, Archive: true},
+	}, executor.applied())
+}
+
+func TestPollAndProcessSkipsActionsOfFailedMessages(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	executor := &recordingExecutor{}
+	h := &recordingHandler{fail: map[string]int{"a": 1}}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithActionExecutor(executor), WithPipeline(PipelineConfig{PreprocessWorkers: 1, HandlerWorkers: 1}))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle, planning(datamodel.Star())}))
+	// the actions of the other handlers are not applied either, so the retry does not apply them twice
+	assert.Equal(t, []datamodel.Plan{{MessageID: "b", Star: true}}, executor.applied())
+	assert.Equal(t, uint64(0), readHistory(t, history))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle, planning(datamodel.Star())}))
+	assert.Equal(t, []datamodel.Plan{{MessageID: "b", Star: true}, {MessageID: "a", Star: true}}, executor.applied())
+	assert.Equal(t, uint64(2), readHistory(t, history))
+}
+
+func TestPollAndProcessRetriesExecutor(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a")
+	executor := &recordingExecutor{err: Retryable(errors.New("rate limited")), failures: 2}
+	provider := NewMessageProvider(service, WithActionExecutor(executor),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), NewMemoryHistory(0), []MessageHandlerFunc{planning(datamodel.Trash())}))
+	assert.Equal(t, []datamodel.Plan{{MessageID: "a", Trash: true}}, executor.applied())
+}
+
+func TestPollAndProcessDeadLettersExecutorFailures(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a")
+	executor := &recordingExecutor{err: errors.New("label name is invalid"), failures: 1}
+	q, err := OpenDeadLetterQueue(filepath.Join(t.TempDir(), "deadletters.jsonl"))
+	assert.NoError(t, err)
+	defer q.Close()
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithActionExecutor(executor), WithDeadLetterQueue(q))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{planning(datamodel.AddLabel("/"))}))
+	assert.Empty(t, executor.applied())
+	assert.Equal(t, uint64(1), readHistory(t, history))
+	letters := q.List()
+	assert.Len(t, letters, 1)
+	assert.Equal(t, "unable to apply actions: label name is invalid", letters[0].Error)
+}
+
+func TestPollAndProcessWithoutExecutor(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	// handlers planning nothing do not need an executor
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, uint64(2), readHistory(t, history))
+
+	// the actions planned can not be applied, the message fails
+	service.receive("c")
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{planning(datamodel.Star())}))
+	assert.Equal(t, 1, provider.Attempts("c"))
+	assert.Equal(t, uint64(2), readHistory(t, history))
+}
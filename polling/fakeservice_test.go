@@ -0,0 +1,87 @@
+package polling
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+)
+
+// fakeService is an in-memory MessageService. Every message is its own history record,
+// the history id of a record is the number of messages received up to it.
+type fakeService struct {
+	mu       sync.Mutex
+	messages []datamodel.Message
+	polls    int
+
+	// historyErr fails GetHistory
+	historyErr error
+	// fetchFailures fails fetching the message that many times
+	fetchFailures map[string]int
+}
+
+func (s *fakeService) receive(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.messages = append(s.messages, datamodel.Message{ID: id, Subject: "subject " + id})
+	}
+}
+
+func (s *fakeService) failFetch(id string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetchFailures == nil {
+		s.fetchFailures = map[string]int{}
+	}
+	s.fetchFailures[id] = times
+}
+
+func (s *fakeService) pollCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.polls
+}
+
+func (s *fakeService) GetHistory(userId string, startHistoryId uint64) (uint64, []datamodel.HistoryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polls++
+	if s.historyErr != nil {
+		return 0, nil, s.historyErr
+	}
+	var records []datamodel.HistoryRecord
+	for i := startHistoryId; i < uint64(len(s.messages)); i++ {
+		records = append(records, datamodel.HistoryRecord{HistoryID: i + 1, MessageIDs: []string{s.messages[i].ID}})
+	}
+	return uint64(len(s.messages)), records, nil
+}
+
+func (s *fakeService) GetMessage(userId string, id string) (datamodel.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetchFailures[id] > 0 {
+		s.fetchFailures[id]--
+		return datamodel.Message{}, fmt.Errorf("injected failure of message %s", id)
+	}
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return datamodel.Message{}, fmt.Errorf("message %s not found", id)
+}
+
+func (s *fakeService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
+	var messages []datamodel.Message
+	var err error
+	for _, id := range ids {
+		m, getErr := s.GetMessage(userId, id)
+		if getErr != nil {
+			err = getErr
+			continue
+		}
+		messages = append(messages, m)
+	}
+	return messages, err
+}
@@ -0,0 +1,145 @@
+package polling
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// DefaultLeaseTTL is how long a lease lasts without being renewed
+const DefaultLeaseTTL = 30 * time.Second
+
+// acquireLeaseScript takes the lease if it is free, or extends it if this instance holds it
+var acquireLeaseScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return 1
+end
+if not holder then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+  return 1
+end
+return 0
+`)
+
+// releaseLeaseScript frees the lease if this instance holds it
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Lease is a lock in Redis held by one instance at a time, for a limited time. The instance holding it is the
+// leader, it must renew the lease before it expires, otherwise another instance takes over.
+type Lease struct {
+	client *redis.Client
+	key    string
+	token  string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	heldUntil time.Time
+}
+
+// NewLease creates the lease stored at the key, identified by a random token for this instance
+func NewLease(client *redis.Client, key string, ttl time.Duration) *Lease {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Lease{
+		client: client,
+		key:    key,
+		token:  leaseToken(),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// leaseToken identifies this instance: the host name, the process id, and random bytes
+func leaseToken() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Token returns the token of this instance
+func (l *Lease) Token() string {
+	return l.token
+}
+
+// Acquire takes the lease, or renews it if this instance holds it. It returns false if another instance holds it.
+func (l *Lease) Acquire(ctx context.Context) (bool, error) {
+	start := l.now()
+	res, err := acquireLeaseScript.Run(ctx, l.client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		// the lease may be lost, stop acting as the leader
+		l.heldUntil = time.Time{}
+		return false, fmt.Errorf("unable to acquire lease: %w", err)
+	}
+	if res != 1 {
+		l.heldUntil = time.Time{}
+		return false, nil
+	}
+	// the lease started at the latest when the script was sent
+	l.heldUntil = start.Add(l.ttl)
+	return true, nil
+}
+
+// Held reports whether this instance holds the lease, as of its last renewal
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.now().Before(l.heldUntil)
+}
+
+// Release frees the lease if this instance holds it, so another instance can take over right away
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	l.heldUntil = time.Time{}
+	l.mu.Unlock()
+	if err := releaseLeaseScript.Run(ctx, l.client, []string{l.key}, l.token).Err(); err != nil {
+		return fmt.Errorf("unable to release lease: %w", err)
+	}
+	return nil
+}
+
+// Keep tries to acquire and renew the lease every third of its TTL, until the context is done. The lease is
+// then released.
+func (l *Lease) Keep(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	leader := false
+	for {
+		held, err := l.Acquire(ctx)
+		if err != nil {
+			logging.Logger.Warn("unable to renew lease", zap.String("lease", l.key), zap.Error(err))
+		}
+		if held != leader {
+			leader = held
+			logging.Logger.Info("leadership changed", zap.String("lease", l.key), zap.Bool("leader", leader))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// the context is done, release with a fresh one
+			if err := l.Release(context.Background()); err != nil {
+				logging.Logger.Warn("unable to release lease", zap.String("lease", l.key), zap.Error(err))
+			}
+			return
+		}
+	}
+}
@@ -2,103 +2,473 @@ package polling
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/jyouturer/gmail-ai/datamodel"
-	"github.com/jyouturer/gmail-ai/internal"
 	"github.com/jyouturer/gmail-ai/internal/logging"
 	"go.uber.org/zap"
 )
 
-// Define a type for message handler functions
-type MessageHandlerFunc func(ctx context.Context, msg datamodel.Message) error
+// MessageHandlerFunc decides what to do with a message, it returns the actions planned, which are applied once
+// all the handlers of the message succeeded
+type MessageHandlerFunc func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error)
 
 // Define an interface for message services
 type MessageService interface {
-	GetMessageIds(userId string, startHistoryId uint64) (uint64, []string, error)
+	// GetHistory returns the history records adding messages after the cursor, and the newest cursor
+	GetHistory(userId string, startHistoryId uint64) (uint64, []datamodel.HistoryRecord, error)
 	GetMessage(userId string, id string) (datamodel.Message, error)
 	GetMessages(userId string, ids []string) ([]datamodel.Message, error)
 }
 
+// StatefulService is a message service with a state following its cursor, like the mod-sequence of an IMAP
+// mailbox. The state is saved with the history id, in a StateHistory, and set back when the history id is read,
+// so it never runs ahead of the messages handled.
+type StatefulService interface {
+	// SourceState returns the state to save with the history id
+	SourceState(historyId uint64) string
+	// SetSourceState sets the state saved with the history id, once it is read or written
+	SetSourceState(historyId uint64, state string)
+}
+
+// Defaults of the message provider
+const (
+	// DefaultMaxAttempts is how many polls a failing message is retried in before it is skipped
+	DefaultMaxAttempts = 5
+	// DefaultDrainTimeout is how long the messages being handled may take to finish, once the poll is stopped
+	DefaultDrainTimeout = 30 * time.Second
+)
+
 // Define a struct to represent a message provider
 type MessageProvider struct {
-	service MessageService
+	service     MessageService
+	userID      string
+	pipeline    PipelineConfig
+	preprocess  PreprocessFunc
+	maxAttempts int
+	retry       RetryPolicy
+	// drainTimeout is how long the messages being handled may take once the poll is stopped
+	drainTimeout time.Duration
+	// processed remembers the messages already processed, across polls
+	processed *DedupeStore
+	// deadLetters keeps the messages that failed for good, if set
+	deadLetters *DeadLetterQueue
+	// executor applies the actions planned by the handlers
+	executor ActionExecutor
+	// dryRun gets the actions planned instead of the executor, if set
+	dryRun *ActionReport
+
+	mu sync.Mutex
+	// attempts counts the failed attempts of the messages being retried
+	attempts map[string]int
 }
 
-func NewMessageProvider(service MessageService) *MessageProvider {
-	return &MessageProvider{
-		service: service,
+// ProviderOption configures a MessageProvider
+type ProviderOption func(*MessageProvider)
+
+// WithUserID sets the account polled, "me" (the authenticated user) by default
+func WithUserID(userID string) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.userID = userID
 	}
 }
 
-func (ep *MessageProvider) PollAndProcess(ctx context.Context, pollHistory PollHistory, handlers []MessageHandlerFunc) error {
-	// Create a context with a timeout of 60 seconds
-	ctxTimeout, cancel := context.WithTimeout(ctx, 60*time.Second)
-	defer cancel()
+// WithDedupeStore sets the store of the messages already processed, an in-memory store by default
+func WithDedupeStore(store *DedupeStore) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.processed = store
+	}
+}
+
+// WithPipeline sets the parallelism of the stages of the pipeline, the values not set keep their default
+func WithPipeline(config PipelineConfig) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.pipeline = config.withDefaults()
+	}
+}
+
+// WithPreprocessor sets the function preparing the messages before the handlers run
+func WithPreprocessor(preprocess PreprocessFunc) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.preprocess = preprocess
+	}
+}
+
+// WithMaxAttempts sets how many polls a failing message is retried in, before it is skipped so the cursor can move on
+func WithMaxAttempts(attempts int) ProviderOption {
+	return func(ep *MessageProvider) {
+		if attempts > 0 {
+			ep.maxAttempts = attempts
+		}
+	}
+}
+
+// WithRetryPolicy sets how the handlers failing with a transient error are retried, the values not set keep their default
+func WithRetryPolicy(policy RetryPolicy) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.retry = policy.withDefaults()
+	}
+}
+
+// WithDeadLetterQueue sets the queue of the messages that failed for good. Without it, messages failing in the
+// handlers are retried in the next polls, and skipped after the max attempts.
+func WithDeadLetterQueue(queue *DeadLetterQueue) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.deadLetters = queue
+	}
+}
+
+// WithDrainTimeout sets how long the messages being handled may take to finish once the context of the poll
+// is done, before they are canceled too. 0 cancels them right away.
+func WithDrainTimeout(timeout time.Duration) ProviderOption {
+	return func(ep *MessageProvider) {
+		if timeout >= 0 {
+			ep.drainTimeout = timeout
+		}
+	}
+}
+
+// WithActionExecutor sets what applies the actions planned by the handlers, the message service by default
+// when it is an ActionExecutor
+func WithActionExecutor(executor ActionExecutor) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.executor = executor
+	}
+}
+
+// WithDryRun writes the actions planned by the handlers to the report, instead of applying them. The messages
+// are still recorded as processed in the dedupe store, and the history id still moves on: use an in-memory
+// dedupe store and a ReadOnlyHistory to leave no trace.
+func WithDryRun(report *ActionReport) ProviderOption {
+	return func(ep *MessageProvider) {
+		ep.dryRun = report
+	}
+}
 
-	// Create a processed messages buffer
-	processedMessages := internal.NewRingBuffer(100)
+func NewMessageProvider(service MessageService, options ...ProviderOption) *MessageProvider {
+	ep := &MessageProvider{
+		service:      service,
+		userID:       "me",
+		pipeline:     DefaultPipelineConfig(),
+		maxAttempts:  DefaultMaxAttempts,
+		retry:        DefaultRetryPolicy(),
+		drainTimeout: DefaultDrainTimeout,
+		attempts:     map[string]int{},
+	}
+	for _, option := range options {
+		option(ep)
+	}
+	if ep.processed == nil {
+		ep.processed = NewDedupeStore(DefaultDedupeSize, DefaultDedupeTTL)
+	}
+	if executor, ok := service.(ActionExecutor); ok && ep.executor == nil {
+		ep.executor = executor
+	}
+	return ep
+}
 
+// PollAndProcess processes the messages added since the stored history id, through a pipeline of workers
+// fetching, preprocessing and handling them. The stored history id only moves past a history record once
+// all its messages are handled, so messages are processed at least once: messages that could not be
+// fetched or processed in time are retried in the next poll. When the context is done, the messages being
+// handled are given the drain timeout to finish, and the history is saved before it returns.
+func (ep *MessageProvider) PollAndProcess(ctx context.Context, pollHistory PollHistory, handlers []MessageHandlerFunc) error {
 	// Read the last history ID from the file
-	lastHistoryId, err := pollHistory.ReadHistory()
+	lastHistoryId, state, err := ep.readHistory(pollHistory)
 	if err != nil {
-		return fmt.Errorf("unable to read last historyId from file: %v", err)
+		return fmt.Errorf("unable to read last historyId from file: %w", err)
 	}
 	logging.Logger.Debug("last history ID", zap.Uint64("historyId", lastHistoryId))
 	// Retrieve the list of histories
-	lastHistoryId, ids, err := ep.service.GetMessageIds("me", lastHistoryId)
+	newestHistoryId, records, err := ep.service.GetHistory(ep.userID, lastHistoryId)
 	if err != nil {
-		return fmt.Errorf("unable to get histories: %v", err)
+		return fmt.Errorf("unable to get histories: %w", err)
 	}
+	tracker := newCommitTracker(pollHistory, lastHistoryId, newestHistoryId, records)
+	tracker.service, _ = ep.service.(StatefulService)
+	tracker.state = state
+	// the history is saved as records complete, and once more on the way out
+	defer tracker.commit()
 
-	// Defer writing the last history ID to the file
-	defer func() {
-		err = pollHistory.WriteHistory(lastHistoryId)
-		if err != nil {
-			logging.Logger.Error("error saving history", zap.Any("history", pollHistory), zap.Error(err))
+	// Skip the messages already processed
+	var pending []string
+	seen := map[string]bool{}
+	for _, r := range records {
+		for _, id := range r.MessageIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if ep.processed.Contains(ep.userID, id) {
+				logging.Logger.Debug("skipping message already processed", zap.String("message", id))
+				tracker.done(id)
+				continue
+			}
+			pending = append(pending, id)
 		}
-	}()
-	logging.Logger.Debug("message ids", zap.Any("message ids", ids))
-	// Create a wait group for email handler functions
+	}
+	logging.Logger.Debug("message ids", zap.Any("message ids", pending))
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// once ctx is done no message is started, the messages being handled have the drain timeout to finish
+	drain, cancel := drainContext(ctx, ep.drainTimeout)
+	defer cancel()
+	results := make(chan messageResult, ep.pipeline.QueueSize)
+	go ep.runPipeline(ctx, drain, pending, handlers, results)
+
+	fetched := 0
+	var fetchErr error
+	for r := range results {
+		if r.fetched {
+			fetched++
+		} else if fetchErr == nil {
+			fetchErr = r.err
+		}
+		if r.err != nil {
+			if ep.giveUp(r) {
+				tracker.done(r.messageID)
+			}
+		} else {
+			// Mark the message as processed, so it is skipped if it shows up again
+			if err := ep.processed.Add(ep.userID, r.messageID); err != nil {
+				logging.Logger.Error("unable to record processed message", zap.String("message", r.messageID), zap.Error(err))
+			}
+			ep.succeeded(r.messageID)
+			tracker.done(r.messageID)
+		}
+		tracker.commit()
+	}
+
+	if ctx.Err() != nil {
+		// stopped, the messages not done are retried in the next poll
+		return fmt.Errorf("poll interrupted: %w", ctx.Err())
+	}
+	if fetched == 0 && fetchErr != nil {
+		return fmt.Errorf("unable to get messages: %w", fetchErr)
+	}
+	return nil
+}
+
+// readHistory reads the history id, and the state of the service saved with it, which is set back on the service
+func (ep *MessageProvider) readHistory(history PollHistory) (uint64, string, error) {
+	service, stateful := ep.service.(StatefulService)
+	sh, ok := history.(StateHistory)
+	if !stateful || !ok {
+		historyId, err := history.ReadHistory()
+		return historyId, "", err
+	}
+	historyId, state, err := sh.ReadHistoryState()
+	if err != nil {
+		return 0, "", err
+	}
+	service.SetSourceState(historyId, state)
+	return historyId, state, nil
+}
+
+// handlerError is a handler failing on a message, after it was retried
+type handlerError struct {
+	err      error
+	attempts int
+}
+
+func (e *handlerError) Error() string { return e.err.Error() }
+func (e *handlerError) Unwrap() error { return e.err }
+
+// processMessage runs the handlers on the message in parallel, retrying them on transient errors, then applies
+// the actions they planned, merged. The actions are only applied once all the handlers succeeded, so a message
+// retried does not get them twice. It returns the first handler error, or the context error if the context is
+// done first.
+func (ep *MessageProvider) processMessage(ctx context.Context, handlers []MessageHandlerFunc, msg datamodel.Message) error {
 	var wg sync.WaitGroup
+	errs := make([]error, len(handlers))
+	actions := make([][]datamodel.Action, len(handlers))
+	// Process the message content with each handler function to determine if it meets the criteria
+	for i, handler := range handlers {
+		wg.Add(1)
+		go handleMessage(ctx, ep.retry, handler, msg, &wg, &actions[i], &errs[i])
+	}
+
+	// Wait for all handler functions to complete or for a context timeout
+	if err := waitHandlers(ctx, &wg); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// the handlers failed because they ran out of time
+		return ctx.Err()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	var planned []datamodel.Action
+	for _, a := range actions {
+		planned = append(planned, a...)
+	}
+	if ep.dryRun != nil {
+		if err := ep.dryRun.Write(msg, planned); err != nil {
+			return &handlerError{err: err, attempts: 1}
+		}
+		return nil
+	}
+	return ep.execute(ctx, MergeActions(msg.ID, planned))
+}
+
+// execute applies the plan of the message with the executor, retrying it on transient errors
+func (ep *MessageProvider) execute(ctx context.Context, plan datamodel.Plan) error {
+	if plan.Empty() {
+		return nil
+	}
+	if ep.executor == nil {
+		return &handlerError{err: fmt.Errorf("no executor to apply the actions on message %s", plan.MessageID), attempts: 1}
+	}
+	attempts, err := ep.retry.run(ctx, func() error {
+		return ep.executor.Execute(ctx, plan)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logging.Logger.Error("error applying actions", zap.String("message", plan.MessageID), zap.Int("attempts", attempts), zap.Error(err))
+		return &handlerError{err: fmt.Errorf("unable to apply actions: %w", err), attempts: attempts}
+	}
+	return nil
+}
+
+// giveUp decides what happens to a failed message, it returns true when the message is done with. Handler
+// failures were already retried, they go to the dead-letter queue right away if there is one. Other failures,
+// like fetch failures and timeouts, are retried in the next polls, up to the max attempts.
+func (ep *MessageProvider) giveUp(r messageResult) bool {
+	var handlerErr *handlerError
+	if ep.deadLetters != nil && errors.As(r.err, &handlerErr) && ep.deadLetter(r.message, r.err, handlerErr.attempts) {
+		ep.succeeded(r.messageID)
+		return true
+	}
+	if !ep.failed(r.messageID, r.err) {
+		return false
+	}
+	if ep.deadLetters != nil && r.fetched {
+		ep.deadLetter(r.message, r.err, ep.maxAttempts)
+	}
+	return true
+}
 
-	// Process each message in the history item
-	for _, id := range ids {
-		// Check if the message has already been processed
-		if processedMessages.Contains(id) {
+// deadLetter puts the message in the dead-letter queue, it returns false if the queue could not be saved
+func (ep *MessageProvider) deadLetter(msg datamodel.Message, cause error, attempts int) bool {
+	err := ep.deadLetters.Add(DeadLetter{Account: ep.userID, Message: msg, Error: cause.Error(), Attempts: attempts})
+	if err != nil {
+		logging.Logger.Error("unable to save dead letter", zap.String("message", msg.ID), zap.Error(err))
+		return false
+	}
+	logging.Logger.Warn("message moved to the dead-letter queue", zap.String("message", msg.ID), zap.Int("attempts", attempts), zap.Error(cause))
+	// it is replayed from the queue, not when it shows up again in the history
+	if err := ep.processed.Add(ep.userID, msg.ID); err != nil {
+		logging.Logger.Error("unable to record processed message", zap.String("message", msg.ID), zap.Error(err))
+	}
+	return true
+}
+
+// ReplayDeadLetters processes again the dead letters of the account, or only the given messages, and takes
+// the ones processed successfully out of the queue. The messages are fetched again when possible, so the
+// handlers see their current state. It returns how many messages were replayed successfully.
+func (ep *MessageProvider) ReplayDeadLetters(ctx context.Context, queue *DeadLetterQueue, handlers []MessageHandlerFunc, messageIDs ...string) (int, error) {
+	only := map[string]bool{}
+	for _, id := range messageIDs {
+		only[id] = true
+	}
+	replayed := 0
+	for _, letter := range queue.List() {
+		if letter.Account != ep.userID || (len(only) > 0 && !only[letter.Message.ID]) {
 			continue
 		}
-		// Retrieve the message
-		logging.Logger.Debug("retrieving message", zap.String("message", id))
-		m, err := ep.service.GetMessage("me", id)
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+		msg, err := ep.service.GetMessage(ep.userID, letter.Message.ID)
 		if err != nil {
-			return fmt.Errorf("unable to get message: %v", err)
+			logging.Logger.Warn("unable to fetch dead letter, replaying the saved message", zap.String("message", letter.Message.ID), zap.Error(err))
+			msg = letter.Message
 		}
-		// Process the message content with each handler function to determine if it meets the criteria
-		for _, handler := range handlers {
-			wg.Add(1)
-			go handleMessage(ctxTimeout, handler, m, &wg)
+		msgCtx, cancel := context.WithTimeout(ctx, ep.pipeline.MessageTimeout)
+		err = ep.processMessage(msgCtx, handlers, msg)
+		cancel()
+		if err != nil {
+			letter.Error = err.Error()
+			letter.Attempts++
+			letter.Time = time.Time{}
+			if err := queue.Add(letter); err != nil {
+				return replayed, err
+			}
+			continue
 		}
-
-		// Wait for all handler functions to complete or for a context timeout
-		if err = waitHandlers(ctxTimeout, &wg, processedMessages, id); err != nil {
-			return err
+		if err := queue.Remove(letter.Account, letter.Message.ID); err != nil {
+			return replayed, err
+		}
+		if err := ep.processed.Add(ep.userID, letter.Message.ID); err != nil {
+			logging.Logger.Error("unable to record processed message", zap.String("message", letter.Message.ID), zap.Error(err))
 		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// failed counts a failed attempt of the message. The message is retried in the next poll, unless it
+// failed too many times: then it is skipped, and failed returns true.
+func (ep *MessageProvider) failed(messageID string, err error) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.attempts[messageID]++
+	attempts := ep.attempts[messageID]
+	if attempts < ep.maxAttempts {
+		logging.Logger.Warn("message failed, it will be retried", zap.String("message", messageID), zap.Int("attempts", attempts), zap.Error(err))
+		return false
 	}
+	logging.Logger.Error("message failed too many times, skipping it", zap.String("message", messageID), zap.Int("attempts", attempts), zap.Error(err))
+	delete(ep.attempts, messageID)
+	return true
+}
 
-	return nil
+// succeeded forgets the failed attempts of the message
+func (ep *MessageProvider) succeeded(messageID string) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	delete(ep.attempts, messageID)
 }
 
-func handleMessage(ctx context.Context, handler MessageHandlerFunc, msg datamodel.Message, wg *sync.WaitGroup) {
+// Attempts returns how many times the message failed, while it is retried
+func (ep *MessageProvider) Attempts(messageID string) int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.attempts[messageID]
+}
+
+func handleMessage(ctx context.Context, retry RetryPolicy, handler MessageHandlerFunc, msg datamodel.Message, wg *sync.WaitGroup, actions *[]datamodel.Action, result *error) {
 	defer wg.Done()
-	if err := handler(ctx, msg); err != nil {
-		logging.Logger.Error("error processing message", zap.String("message", msg.ID), zap.Error(err))
+	attempts, err := retry.run(ctx, func() (err error) {
+		// the handler runs in its own goroutine, a panic fails the message instead of crashing the program
+		defer func() {
+			if r := recover(); r != nil {
+				logging.Logger.Error("handler panicked", zap.String("message", msg.ID), zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+				*actions, err = nil, Permanent(fmt.Errorf("panic: %v", r))
+			}
+		}()
+		planned, err := handler(ctx, msg)
+		*actions = planned
+		return err
+	})
+	if err != nil {
+		logging.Logger.Error("error processing message", zap.String("message", msg.ID), zap.Int("attempts", attempts), zap.Error(err))
+		*result = &handlerError{err: err, attempts: attempts}
 	}
 }
 
-func waitHandlers(ctx context.Context, wg *sync.WaitGroup, processedMessages *internal.RingBuffer, messageID string) error {
+func waitHandlers(ctx context.Context, wg *sync.WaitGroup) error {
 	doneCh := make(chan struct{})
 	go func() {
 		defer close(doneCh)
@@ -108,8 +478,6 @@ func waitHandlers(ctx context.Context, wg *sync.WaitGroup, processedMessages *in
 	select {
 	case <-doneCh:
 		// All email handler functions have completed
-		// Mark the message as processed in the ring buffer
-		processedMessages.Put(messageID)
 	case <-ctx.Done():
 		return ctx.Err()
 	}
@@ -0,0 +1,361 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHandler records the messages it handled, and fails or blocks on the messages it is told to
+type recordingHandler struct {
+	mu      sync.Mutex
+	handled []string
+	fail    map[string]int
+	block   map[string]bool
+}
+
+func (h *recordingHandler) handle(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+	h.mu.Lock()
+	if h.block[msg.ID] {
+		h.mu.Unlock()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	defer h.mu.Unlock()
+	if h.fail[msg.ID] > 0 {
+		h.fail[msg.ID]--
+		return nil, errors.New("injected handler failure")
+	}
+	h.handled = append(h.handled, msg.ID)
+	return nil, nil
+}
+
+func (h *recordingHandler) messages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.handled...)
+}
+
+// failingHistory fails to save the history, like a crash right before the cursor is saved
+type failingHistory struct {
+	*MemoryHistory
+}
+
+func (h failingHistory) WriteHistory(uint64) error {
+	return errors.New("crashed")
+}
+
+func readHistory(t *testing.T, h PollHistory) uint64 {
+	historyId, err := h.ReadHistory()
+	assert.NoError(t, err)
+	return historyId
+}
+
+func TestPollAndProcessCommitsAllRecords(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+
+	assert.NoError(t, NewMessageProvider(service).PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+func TestPollAndProcessHistoryFailure(t *testing.T) {
+	service := &fakeService{historyErr: errors.New("history unavailable")}
+	service.receive("a")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+
+	err := NewMessageProvider(service).PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle})
+	assert.ErrorContains(t, err, "history unavailable")
+	assert.Empty(t, h.messages())
+	assert.Equal(t, uint64(0), readHistory(t, history))
+}
+
+func TestPollAndProcessFetchFailure(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	service.failFetch("a", 1)
+	service.failFetch("b", 1)
+	service.failFetch("c", 1)
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	// nothing could be fetched, the cursor stays
+	err := provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle})
+	assert.ErrorContains(t, err, "unable to get messages")
+	assert.Equal(t, uint64(0), readHistory(t, history))
+	assert.Equal(t, 1, provider.Attempts("b"))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+	assert.Equal(t, 0, provider.Attempts("b"))
+}
+
+func TestPollAndProcessPartialFetchFailure(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	service.failFetch("b", 1)
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	// the cursor moves past a, but not past the failed b, even though c was processed
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "c"}, h.messages())
+	assert.Equal(t, uint64(1), readHistory(t, history))
+
+	// b is retried, c is not processed again
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "c", "b"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+func TestPollAndProcessHandlerFailure(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{fail: map[string]int{"b": 1}}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "c"}, h.messages())
+	assert.Equal(t, uint64(1), readHistory(t, history))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "c", "b"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+func TestPollAndProcessHandlerPanic(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	calls := 0
+	panicking := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		if msg.ID == "b" {
+			calls++
+			panic("bug")
+		}
+		return h.handle(ctx, msg)
+	}
+	// the panic fails the message like a permanent error, it is not retried and the others are handled
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{panicking}))
+	assert.ElementsMatch(t, []string{"a", "c"}, h.messages())
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, provider.Attempts("b"))
+}
+
+func TestPollAndProcessTimeout(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{block: map[string]bool{"b": true}}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithPipeline(PipelineConfig{MessageTimeout: 20 * time.Millisecond}))
+
+	// b runs out of time and is retried, the other messages are not held back
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "c"}, h.messages())
+	assert.Equal(t, uint64(1), readHistory(t, history))
+	assert.Equal(t, 1, provider.Attempts("b"))
+
+	h.mu.Lock()
+	h.block = nil
+	h.mu.Unlock()
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+func TestPollAndProcessCanceled(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	history := NewMemoryHistory(0)
+	var handled []string
+	// the program is stopped while a is processed
+	handler := func(_ context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		handled = append(handled, msg.ID)
+		cancel()
+		return nil, nil
+	}
+
+	provider := NewMessageProvider(service, WithPipeline(PipelineConfig{PreprocessWorkers: 1, HandlerWorkers: 1}))
+	err := provider.PollAndProcess(ctx, history, []MessageHandlerFunc{handler})
+	assert.ErrorIs(t, err, context.Canceled)
+	// a finished and its history was saved, b was not started
+	assert.Equal(t, []string{"a"}, handled)
+	assert.Equal(t, uint64(1), readHistory(t, history))
+}
+
+func TestPollAndProcessDrainsOnCancel(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a")
+	ctx, cancel := context.WithCancel(context.Background())
+	history := NewMemoryHistory(0)
+	// a takes a while to finish after the program is stopped
+	handler := func(msgCtx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		cancel()
+		select {
+		case <-time.After(50 * time.Millisecond):
+			return nil, nil
+		case <-msgCtx.Done():
+			return nil, msgCtx.Err()
+		}
+	}
+
+	provider := NewMessageProvider(service, WithDrainTimeout(time.Second))
+	assert.ErrorIs(t, provider.PollAndProcess(ctx, history, []MessageHandlerFunc{handler}), context.Canceled)
+	assert.Equal(t, uint64(1), readHistory(t, history))
+}
+
+func TestPollAndProcessDrainTimeout(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a")
+	ctx, cancel := context.WithCancel(context.Background())
+	history := NewMemoryHistory(0)
+	// a does not finish, it is canceled after the drain timeout
+	handler := func(msgCtx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		cancel()
+		<-msgCtx.Done()
+		return nil, msgCtx.Err()
+	}
+
+	provider := NewMessageProvider(service, WithDrainTimeout(20*time.Millisecond))
+	start := time.Now()
+	assert.ErrorIs(t, provider.PollAndProcess(ctx, history, []MessageHandlerFunc{handler}), context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, uint64(0), readHistory(t, history))
+	// a is retried in the next poll
+	assert.Equal(t, 0, provider.Attempts("a"))
+}
+
+func TestPollAndProcessCrashBeforeCommit(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	h := &recordingHandler{}
+	filename := filepath.Join(t.TempDir(), "processed.txt")
+	store, err := OpenDedupeStore(filename, 100, time.Hour)
+	assert.NoError(t, err)
+	history := NewMemoryHistory(0)
+
+	// the messages are processed, but the cursor is never saved
+	assert.NoError(t, NewMessageProvider(service, WithDedupeStore(store)).PollAndProcess(context.Background(), failingHistory{history}, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, uint64(0), readHistory(t, history))
+	assert.NoError(t, store.Close())
+
+	// after the restart the messages are delivered again, but not processed twice
+	service.receive("c")
+	store, err = OpenDedupeStore(filename, 100, time.Hour)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, NewMessageProvider(service, WithDedupeStore(store)).PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+// statefulService is a fakeService whose state is the number of its polls, reached at the end of each poll
+type statefulService struct {
+	*fakeService
+	newest uint64
+	// restored is the history id and the state last set
+	restored []interface{}
+}
+
+func (s *statefulService) GetHistory(userId string, startHistoryId uint64) (uint64, []datamodel.HistoryRecord, error) {
+	newest, records, err := s.fakeService.GetHistory(userId, startHistoryId)
+	s.newest = newest
+	return newest, records, err
+}
+
+func (s *statefulService) SourceState(historyId uint64) string {
+	if historyId != s.newest {
+		return ""
+	}
+	return fmt.Sprintf("poll %d", s.pollCount())
+}
+
+func (s *statefulService) SetSourceState(historyId uint64, state string) {
+	s.restored = []interface{}{historyId, state}
+}
+
+func TestPollAndProcessSavesServiceState(t *testing.T) {
+	service := &statefulService{fakeService: &fakeService{}}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{fail: map[string]int{"b": 1}}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service)
+
+	// the state of the end of the poll is not saved with a history id part way through it
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	historyId, state, _ := history.ReadHistoryState()
+	assert.Equal(t, uint64(1), historyId)
+	assert.Equal(t, "", state)
+	assert.Equal(t, []interface{}{uint64(1), ""}, service.restored)
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	historyId, state, _ = history.ReadHistoryState()
+	assert.Equal(t, uint64(3), historyId)
+	assert.Equal(t, "poll 2", state)
+
+	// the state moves on without new messages, and is set back on the service when read
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	historyId, state, _ = history.ReadHistoryState()
+	assert.Equal(t, uint64(3), historyId)
+	assert.Equal(t, "poll 3", state)
+	assert.Equal(t, []interface{}{uint64(3), "poll 3"}, service.restored)
+
+	// a dry run reads the state but does not save it
+	assert.NoError(t, provider.PollAndProcess(context.Background(), ReadOnlyHistory(history), []MessageHandlerFunc{h.handle}))
+	_, state, _ = history.ReadHistoryState()
+	assert.Equal(t, "poll 3", state)
+}
+
+func TestFileHistoryState(t *testing.T) {
+	h := NewFileHistory(filepath.Join(t.TempDir(), "history"))
+	assert.NoError(t, h.WriteHistoryState(7, "12345"))
+	historyId, state, err := h.ReadHistoryState()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), historyId)
+	assert.Equal(t, "12345", state)
+	assert.Equal(t, uint64(7), readHistory(t, h))
+
+	// a history without state reads as before
+	assert.NoError(t, h.WriteHistory(8))
+	historyId, state, err = h.ReadHistoryState()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), historyId)
+	assert.Equal(t, "", state)
+}
+
+func TestPollAndProcessGivesUpAfterMaxAttempts(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	h := &recordingHandler{fail: map[string]int{"b": 100}}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithMaxAttempts(3))
+
+	for i := 1; i < 3; i++ {
+		assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+		assert.Equal(t, uint64(1), readHistory(t, history))
+		assert.Equal(t, i, provider.Attempts("b"))
+	}
+	// the third failure skips b, so the cursor is not stuck on it
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, uint64(3), readHistory(t, history))
+	assert.ElementsMatch(t, []string{"a", "c"}, h.messages())
+}
@@ -0,0 +1,176 @@
+package polling
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// Middleware wraps a handler, to add a behavior to it before or after it runs
+type Middleware func(next MessageHandlerFunc) MessageHandlerFunc
+
+// Chain combines the middleware into one, the first one is the outermost: it runs first and sees the result last
+func Chain(middleware ...Middleware) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			next = middleware[i](next)
+		}
+		return next
+	}
+}
+
+// Recover turns a panic of the handler into a permanent error, so it fails the message instead of crashing the process
+func Recover(name string) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(ctx context.Context, msg datamodel.Message) (actions []datamodel.Action, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logging.Logger.Error("handler panicked", zap.String("handler", name), zap.String("message", msg.ID),
+						zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+					actions, err = nil, Permanent(fmt.Errorf("panic: %v", r))
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timeout bounds each run of the handler. A run timing out fails with a retryable error, unless the context it
+// was given is done too.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			runCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			actions, err := next(runCtx, msg)
+			if err != nil && runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				return nil, Retryable(fmt.Errorf("timed out after %v: %w", timeout, err))
+			}
+			return actions, err
+		}
+	}
+}
+
+// Logging logs every run of the handler, with the message id, its duration, and its actions or its error
+func Logging(name string) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			logger := logging.Logger.With(zap.String("handler", name), zap.String("message", msg.ID))
+			logger.Debug("handler started")
+			start := time.Now()
+			actions, err := next(ctx, msg)
+			if err != nil {
+				logger.Warn("handler failed", zap.Duration("duration", time.Since(start)), zap.Error(err))
+				return nil, err
+			}
+			logger.Info("handler done", zap.Duration("duration", time.Since(start)), zap.Any("actions", actions))
+			return actions, nil
+		}
+	}
+}
+
+// LatencyObserver receives the latency of every run of a handler, and its error
+type LatencyObserver func(handler string, latency time.Duration, err error)
+
+// Latency measures every run of the handler, and gives the latency to the observer
+func Latency(name string, observe LatencyObserver) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			start := time.Now()
+			actions, err := next(ctx, msg)
+			observe(name, time.Since(start), err)
+			return actions, err
+		}
+	}
+}
+
+// ConcurrencyLimit bounds how many messages the handler processes at the same time, the others wait their turn,
+// or fail if their context is done first
+func ConcurrencyLimit(limit int) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		slots := make(chan struct{}, limit)
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			defer func() { <-slots }()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// LatencyStats sums up the latencies of a handler
+type LatencyStats struct {
+	Count  int
+	Errors int
+	Total  time.Duration
+	Max    time.Duration
+}
+
+// Mean returns the mean latency, 0 without runs
+func (s LatencyStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// LatencyRecorder is a LatencyObserver keeping the stats of each handler, until they are collected
+type LatencyRecorder struct {
+	mu    sync.Mutex
+	stats map[string]LatencyStats
+}
+
+// NewLatencyRecorder creates an empty recorder
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{stats: map[string]LatencyStats{}}
+}
+
+// Observe records a run of the handler
+func (r *LatencyRecorder) Observe(handler string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats[handler]
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.Total += latency
+	if latency > s.Max {
+		s.Max = latency
+	}
+	r.stats[handler] = s
+}
+
+// Collect returns the stats of the handlers recorded since the last collect, and starts over
+func (r *LatencyRecorder) Collect() map[string]LatencyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	r.stats = map[string]LatencyStats{}
+	return stats
+}
+
+// Log logs the stats collected with the fields, one line per handler sorted by name
+func (r *LatencyRecorder) Log(fields ...zap.Field) {
+	stats := r.Collect()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := stats[name]
+		logging.Logger.With(fields...).Info("handler latency", zap.String("handler", name), zap.Int("runs", s.Count),
+			zap.Int("errors", s.Errors), zap.Duration("mean", s.Mean()), zap.Duration("max", s.Max))
+	}
+}
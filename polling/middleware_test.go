@@ -0,0 +1,218 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// tracing is a middleware recording when it runs, before and after the handler
+func tracing(name string, trace *[]string) Middleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+			*trace = append(*trace, name+" before")
+			actions, err := next(ctx, msg)
+			*trace = append(*trace, name+" after")
+			return actions, err
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	handler := Chain(tracing("outer", &trace), tracing("inner", &trace))(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		trace = append(trace, "handler")
+		return []datamodel.Action{datamodel.Star()}, nil
+	})
+	actions, err := handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.Action{datamodel.Star()}, actions)
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after", "outer after"}, trace)
+
+	// an empty chain leaves the handler as it is
+	trace = nil
+	handler = Chain()(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		trace = append(trace, "handler")
+		return nil, nil
+	})
+	_, err = handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"handler"}, trace)
+}
+
+func TestRecover(t *testing.T) {
+	handler := Recover("buggy")(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		var labels map[string]string
+		labels[msg.ID] = "boom"
+		return []datamodel.Action{datamodel.Trash()}, nil
+	})
+	actions, err := handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.Empty(t, actions)
+	assert.ErrorContains(t, err, "panic: assignment to entry in nil map")
+	// a panic is a bug, retrying it would panic again
+	assert.False(t, IsRetryable(err))
+
+	handler = Recover("fine")(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		return nil, errors.New("failure")
+	})
+	_, err = handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.EqualError(t, err, "failure")
+}
+
+func TestTimeout(t *testing.T) {
+	slow := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		select {
+		case <-time.After(time.Second):
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	_, err := Timeout(10*time.Millisecond)(slow)(context.Background(), datamodel.Message{ID: "1"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "timed out after 10ms")
+	assert.True(t, IsRetryable(err))
+
+	// the context of the message being done is not a timeout of the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Timeout(time.Second)(slow)(ctx, datamodel.Message{ID: "1"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, IsRetryable(err))
+
+	fast := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		return []datamodel.Action{datamodel.MarkRead()}, nil
+	}
+	actions, err := Timeout(time.Second)(fast)(context.Background(), datamodel.Message{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.Action{datamodel.MarkRead()}, actions)
+}
+
+func TestLogging(t *testing.T) {
+	handler := Logging("logged")(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		if msg.ID == "2" {
+			return nil, errors.New("failure")
+		}
+		return []datamodel.Action{datamodel.AddLabel("Logged")}, nil
+	})
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer func(logger *zap.Logger) { logging.Logger = logger }(logging.Logger)
+	logging.Logger = zap.New(core)
+
+	actions, err := handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []datamodel.Action{datamodel.AddLabel("Logged")}, actions)
+	_, err = handler(context.Background(), datamodel.Message{ID: "2"})
+	assert.EqualError(t, err, "failure")
+
+	entries := logs.AllUntimed()
+	if assert.Len(t, entries, 4) {
+		for i, e := range []struct {
+			level   zapcore.Level
+			message string
+			id      string
+		}{
+			{zapcore.DebugLevel, "handler started", "1"},
+			{zapcore.InfoLevel, "handler done", "1"},
+			{zapcore.DebugLevel, "handler started", "2"},
+			{zapcore.WarnLevel, "handler failed", "2"},
+		} {
+			assert.Equal(t, e.level, entries[i].Level)
+			assert.Equal(t, e.message, entries[i].Message)
+			fields := entries[i].ContextMap()
+			assert.Equal(t, "logged", fields["handler"])
+			assert.Equal(t, e.id, fields["message"])
+		}
+		assert.Contains(t, entries[1].ContextMap(), "actions")
+		assert.Equal(t, "failure", entries[3].ContextMap()["error"])
+	}
+}
+
+func TestLatency(t *testing.T) {
+	recorder := NewLatencyRecorder()
+	handler := Latency("timed", recorder.Observe)(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		time.Sleep(5 * time.Millisecond)
+		if msg.ID == "2" {
+			return nil, errors.New("failure")
+		}
+		return nil, nil
+	})
+	_, err := handler(context.Background(), datamodel.Message{ID: "1"})
+	assert.NoError(t, err)
+	_, err = handler(context.Background(), datamodel.Message{ID: "2"})
+	assert.Error(t, err)
+
+	stats := recorder.Collect()
+	assert.Len(t, stats, 1)
+	s := stats["timed"]
+	assert.Equal(t, 2, s.Count)
+	assert.Equal(t, 1, s.Errors)
+	assert.GreaterOrEqual(t, s.Max, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, s.Total, 10*time.Millisecond)
+	assert.Equal(t, s.Total/2, s.Mean())
+
+	// the stats start over once collected
+	assert.Empty(t, recorder.Collect())
+	assert.Equal(t, time.Duration(0), LatencyStats{}.Mean())
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	var running, maxRunning int32
+	handler := ConcurrencyLimit(2)(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := handler(context.Background(), datamodel.Message{ID: "1"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning)
+}
+
+func TestConcurrencyLimitCanceled(t *testing.T) {
+	release := make(chan struct{})
+	handler := ConcurrencyLimit(1)(func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		<-release
+		return nil, nil
+	})
+	done := make(chan error)
+	go func() {
+		_, err := handler(context.Background(), datamodel.Message{ID: "1"})
+		done <- err
+	}()
+	// wait for the first message to take the only slot
+	time.Sleep(10 * time.Millisecond)
+
+	// the second message gives up waiting when its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := handler(ctx, datamodel.Message{ID: "2"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, <-done)
+}
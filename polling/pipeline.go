@@ -0,0 +1,344 @@
+package polling
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// PreprocessFunc prepares a fetched message before the handlers run, for example to enrich or filter it
+type PreprocessFunc func(ctx context.Context, msg datamodel.Message) (datamodel.Message, error)
+
+// PipelineConfig sets the parallelism of the stages of the message pipeline: fetch, preprocess and handlers.
+// The stages are connected by queues of QueueSize messages, a full queue holds the stage before it back.
+type PipelineConfig struct {
+	// FetchWorkers is how many GetMessages calls run at the same time
+	FetchWorkers int
+	// FetchBatchSize is how many messages one GetMessages call fetches
+	FetchBatchSize int
+	// PreprocessWorkers is how many messages are preprocessed at the same time
+	PreprocessWorkers int
+	// HandlerWorkers is how many messages are handled at the same time, the handlers of one message run in parallel
+	HandlerWorkers int
+	// QueueSize is the capacity of the queues between the stages
+	QueueSize int
+	// MessageTimeout is how long the preprocessing and handlers of one message may take
+	MessageTimeout time.Duration
+}
+
+// DefaultPipelineConfig returns the default pipeline parallelism
+func DefaultPipelineConfig() PipelineConfig {
+	return PipelineConfig{
+		FetchWorkers:      2,
+		FetchBatchSize:    50,
+		PreprocessWorkers: 2,
+		HandlerWorkers:    4,
+		QueueSize:         16,
+		MessageTimeout:    60 * time.Second,
+	}
+}
+
+// withDefaults fills the unset values with the defaults
+func (c PipelineConfig) withDefaults() PipelineConfig {
+	d := DefaultPipelineConfig()
+	if c.FetchWorkers <= 0 {
+		c.FetchWorkers = d.FetchWorkers
+	}
+	if c.FetchBatchSize <= 0 {
+		c.FetchBatchSize = d.FetchBatchSize
+	}
+	if c.PreprocessWorkers <= 0 {
+		c.PreprocessWorkers = d.PreprocessWorkers
+	}
+	if c.HandlerWorkers <= 0 {
+		c.HandlerWorkers = d.HandlerWorkers
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = d.QueueSize
+	}
+	if c.MessageTimeout <= 0 {
+		c.MessageTimeout = d.MessageTimeout
+	}
+	return c
+}
+
+// messageResult is the outcome of a message going through the pipeline
+type messageResult struct {
+	messageID string
+	err       error
+	// fetched is false when the message could not be fetched
+	fetched bool
+	message datamodel.Message
+}
+
+// runPipeline fetches, preprocesses and handles the messages, and sends the result of every message to results.
+// When stop is done no message is started anymore, the messages being handled go on until ctx is done. It
+// closes results when every fetcher, preprocessor and worker is done, so no stage can send to it afterwards.
+func (ep *MessageProvider) runPipeline(stop, ctx context.Context, ids []string, handlers []MessageHandlerFunc, results chan<- messageResult) {
+	config := ep.pipeline
+	batches := make(chan []string)
+	fetched := make(chan datamodel.Message, config.QueueSize)
+	prepared := make(chan datamodel.Message, config.QueueSize)
+
+	send := func(r messageResult) {
+		select {
+		case results <- r:
+		case <-ctx.Done():
+		}
+	}
+
+	// stages counts the goroutines of every stage that sends to results
+	var stages sync.WaitGroup
+
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(ids); start += config.FetchBatchSize {
+			end := start + config.FetchBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			select {
+			case batches <- ids[start:end]:
+			case <-stop.Done():
+				return
+			}
+		}
+	}()
+
+	var fetchers sync.WaitGroup
+	for i := 0; i < config.FetchWorkers; i++ {
+		fetchers.Add(1)
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			defer fetchers.Done()
+			for batch := range batches {
+				if stop.Err() != nil {
+					return
+				}
+				var messages []datamodel.Message
+				err := recovered("fetch", func() (err error) {
+					messages, err = ep.service.GetMessages(ep.userID, batch)
+					return err
+				})
+				got := map[string]bool{}
+				for _, m := range messages {
+					got[m.ID] = true
+					select {
+					case fetched <- m:
+					case <-stop.Done():
+						return
+					}
+				}
+				for _, id := range batch {
+					if !got[id] {
+						if err == nil {
+							err = fmt.Errorf("message %s was not returned", id)
+						}
+						send(messageResult{messageID: id, err: err})
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		fetchers.Wait()
+		close(fetched)
+	}()
+
+	var preprocessors sync.WaitGroup
+	for i := 0; i < config.PreprocessWorkers; i++ {
+		preprocessors.Add(1)
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			defer preprocessors.Done()
+			for m := range fetched {
+				if stop.Err() != nil {
+					return
+				}
+				if ep.preprocess != nil {
+					msgCtx, cancel := context.WithTimeout(ctx, config.MessageTimeout)
+					var out datamodel.Message
+					err := recovered("preprocess", func() (err error) {
+						out, err = ep.preprocess(msgCtx, m)
+						return err
+					})
+					cancel()
+					if err != nil {
+						send(messageResult{messageID: m.ID, err: fmt.Errorf("preprocessing failed: %w", err), fetched: true, message: m})
+						continue
+					}
+					m = out
+				}
+				select {
+				case prepared <- m:
+				case <-stop.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		preprocessors.Wait()
+		close(prepared)
+	}()
+
+	for i := 0; i < config.HandlerWorkers; i++ {
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			// the workers drain prepared until it is closed, the stages before them never block on it
+			for m := range prepared {
+				if stop.Err() != nil {
+					continue
+				}
+				msgCtx, cancel := context.WithTimeout(ctx, config.MessageTimeout)
+				err := recovered("process", func() error {
+					return ep.processMessage(msgCtx, handlers, m)
+				})
+				cancel()
+				if ctx.Err() != nil {
+					// aborted, the message is not done and is retried in the next poll
+					continue
+				}
+				send(messageResult{messageID: m.ID, err: err, fetched: true, message: m})
+			}
+		}()
+	}
+	stages.Wait()
+	close(results)
+}
+
+// recovered runs the stage of the pipeline, a panic fails the messages of the stage instead of crashing the program
+func recovered(stage string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Logger.Error("pipeline panicked", zap.String("stage", stage), zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("%s panicked: %v", stage, r)
+		}
+	}()
+	return f()
+}
+
+// detachedContext keeps the values of its parent, but not its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// drainContext returns a context done the timeout after ctx is done, so the work in flight can finish
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	drain, cancel := context.WithCancel(detachedContext{parent: ctx})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drain.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-drain.Done():
+		}
+	}()
+	return drain, cancel
+}
+
+// commitTracker saves the history id as the history records are completed, in order: the history id moves
+// past a record once all its messages, and the messages of all the records before it, are done.
+type commitTracker struct {
+	history   PollHistory
+	records   []datamodel.HistoryRecord
+	newest    uint64
+	committed uint64
+	// remaining counts the messages not done yet of each record
+	remaining []int
+	// recordsOf lists the records of each message
+	recordsOf map[string][]int
+	next      int
+	// service is the message service when it has a state saved with the history id, state the one saved last
+	service StatefulService
+	state   string
+}
+
+func newCommitTracker(history PollHistory, start, newest uint64, records []datamodel.HistoryRecord) *commitTracker {
+	t := &commitTracker{
+		history:   history,
+		records:   records,
+		newest:    newest,
+		committed: start,
+		remaining: make([]int, len(records)),
+		recordsOf: map[string][]int{},
+	}
+	for i, r := range records {
+		seen := map[string]bool{}
+		for _, id := range r.MessageIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			t.remaining[i]++
+			t.recordsOf[id] = append(t.recordsOf[id], i)
+		}
+	}
+	return t
+}
+
+// done marks the message as done with
+func (t *commitTracker) done(messageID string) {
+	for _, i := range t.recordsOf[messageID] {
+		t.remaining[i]--
+	}
+	delete(t.recordsOf, messageID)
+}
+
+// commit saves the history id of the last record completed in order, or the newest history id if all
+// the records are, with the state of the service at it. Nothing is written when neither moved, so the
+// history keeps the time of the last progress.
+func (t *commitTracker) commit() {
+	historyId := t.committed
+	for t.next < len(t.records) && t.remaining[t.next] <= 0 {
+		historyId = t.records[t.next].HistoryID
+		t.next++
+	}
+	if t.next == len(t.records) {
+		historyId = t.newest
+	}
+	state := ""
+	if t.service != nil {
+		state = t.service.SourceState(historyId)
+	}
+	if (historyId == t.committed && state == t.state) || historyId == 0 {
+		return
+	}
+	logging.Logger.Debug("saving history", zap.Uint64("historyId", historyId), zap.Uint64("newest", t.newest))
+	if err := t.write(historyId, state); err != nil {
+		logging.Logger.Error("error saving history", zap.Any("history", t.history), zap.Error(err))
+		return
+	}
+	t.committed, t.state = historyId, state
+	if t.service != nil {
+		t.service.SetSourceState(historyId, state)
+	}
+}
+
+// write saves the history id, and the state with it when the history keeps one
+func (t *commitTracker) write(historyId uint64, state string) error {
+	if h, ok := t.history.(StateHistory); ok && t.service != nil {
+		return h.WriteHistoryState(historyId, state)
+	}
+	return t.history.WriteHistory(historyId)
+}
@@ -0,0 +1,207 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineHandlesMessagesConcurrently(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c", "d")
+	history := NewMemoryHistory(0)
+
+	// every handler waits for all the others, which only returns if the 4 messages are handled at the same time
+	var barrier sync.WaitGroup
+	barrier.Add(4)
+	handler := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		barrier.Done()
+		done := make(chan struct{})
+		go func() {
+			barrier.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	provider := NewMessageProvider(service, WithPipeline(PipelineConfig{HandlerWorkers: 4, FetchBatchSize: 1, MessageTimeout: time.Second}))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{handler}))
+	assert.Equal(t, uint64(4), readHistory(t, history))
+}
+
+func TestPipelineCommitsInOrder(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b", "c")
+	history := NewMemoryHistory(0)
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	handler := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		if msg.ID == "a" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.ID)
+		return nil, nil
+	}
+
+	provider := NewMessageProvider(service, WithPipeline(PipelineConfig{HandlerWorkers: 3}))
+	done := make(chan error, 1)
+	go func() {
+		done <- provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{handler})
+	}()
+
+	// b and c are done, but the cursor is held by a
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(0), readHistory(t, history))
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, "a", handled[2])
+	assert.Equal(t, uint64(3), readHistory(t, history))
+}
+
+func TestPipelinePreprocessor(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+
+	var mu sync.Mutex
+	var subjects []string
+	preprocess := func(ctx context.Context, msg datamodel.Message) (datamodel.Message, error) {
+		if msg.ID == "b" {
+			return msg, errors.New("unreadable")
+		}
+		msg.Subject = strings.ToUpper(msg.Subject)
+		mu.Lock()
+		subjects = append(subjects, msg.Subject)
+		mu.Unlock()
+		return msg, nil
+	}
+
+	provider := NewMessageProvider(service, WithPreprocessor(preprocess))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, []string{"SUBJECT A"}, subjects)
+	// a message failing the preprocessing is not handled, and retried
+	assert.Equal(t, []string{"a"}, h.messages())
+	assert.Equal(t, 1, provider.Attempts("b"))
+	assert.Equal(t, uint64(1), readHistory(t, history))
+}
+
+func TestPipelinePreprocessorPanic(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	h := &recordingHandler{}
+	history := NewMemoryHistory(0)
+
+	preprocess := func(ctx context.Context, msg datamodel.Message) (datamodel.Message, error) {
+		if msg.ID == "b" {
+			panic("unreadable")
+		}
+		return msg, nil
+	}
+
+	provider := NewMessageProvider(service, WithPreprocessor(preprocess))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	// the panic fails the message like an error, the worker goes on
+	assert.Equal(t, []string{"a"}, h.messages())
+	assert.Equal(t, 1, provider.Attempts("b"))
+	assert.Equal(t, uint64(1), readHistory(t, history))
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	service := &fakeService{}
+	ids := make([]string, 50)
+	for i := range ids {
+		ids[i] = string(rune('A' + i))
+	}
+	service.receive(ids...)
+	history := NewMemoryHistory(0)
+
+	// the fetch stage is held back by the slow handler, it can not run more than the queues ahead
+	var mu sync.Mutex
+	fetched, handled, maxAhead := 0, 0, 0
+	preprocess := func(ctx context.Context, msg datamodel.Message) (datamodel.Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched++
+		if fetched-handled > maxAhead {
+			maxAhead = fetched - handled
+		}
+		return msg, nil
+	}
+	handler := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil, nil
+	}
+
+	config := PipelineConfig{FetchWorkers: 1, FetchBatchSize: 1, PreprocessWorkers: 1, HandlerWorkers: 1, QueueSize: 2}
+	provider := NewMessageProvider(service, WithPipeline(config), WithPreprocessor(preprocess))
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{handler}))
+	assert.Equal(t, 50, handled)
+	// the messages queued for the handler, plus the one handled and the one waiting to be queued
+	assert.LessOrEqual(t, maxAhead, config.QueueSize+2)
+	assert.Equal(t, uint64(50), readHistory(t, history))
+}
+
+// slowFetchService fails fetching message b, after a delay
+type slowFetchService struct {
+	*fakeService
+	started chan struct{}
+	failed  chan struct{}
+}
+
+func (s *slowFetchService) GetMessages(userId string, ids []string) ([]datamodel.Message, error) {
+	if ids[0] != "b" {
+		return s.fakeService.GetMessages(userId, ids)
+	}
+	close(s.started)
+	time.Sleep(50 * time.Millisecond)
+	defer close(s.failed)
+	return nil, errors.New("injected failure of message b")
+}
+
+func TestPipelineStopsWhileFetching(t *testing.T) {
+	service := &slowFetchService{fakeService: &fakeService{}, started: make(chan struct{}), failed: make(chan struct{})}
+	service.receive("a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	history := NewMemoryHistory(0)
+	// the poll is stopped while b is still being fetched
+	handler := func(msgCtx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		<-service.started
+		cancel()
+		<-msgCtx.Done()
+		return nil, msgCtx.Err()
+	}
+
+	config := PipelineConfig{FetchWorkers: 2, FetchBatchSize: 1, HandlerWorkers: 1}
+	provider := NewMessageProvider(service, WithPipeline(config), WithDrainTimeout(0))
+	assert.ErrorIs(t, provider.PollAndProcess(ctx, history, []MessageHandlerFunc{handler}), context.Canceled)
+	// the failed fetch of b is reported before the poll returns, not to the closed results
+	select {
+	case <-service.failed:
+	default:
+		t.Fatal("the poll returned before the fetch of b was done")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type PollHistory interface {
@@ -11,6 +14,16 @@ type PollHistory interface {
 	WriteHistory(uint64) error
 }
 
+// StateHistory is a PollHistory which also saves the state the message service reached at the historyId, see
+// StatefulService
+type StateHistory interface {
+	PollHistory
+	// ReadHistoryState reads the last historyId and the state saved with it, empty if there is none
+	ReadHistoryState() (uint64, string, error)
+	// WriteHistoryState writes the historyId and the state of the message service at it
+	WriteHistoryState(uint64, string) error
+}
+
 type FileHistory struct {
 	filename string
 }
@@ -21,22 +34,127 @@ func NewFileHistory(filename string) *FileHistory {
 
 // Read the last historyId from the file
 func (f *FileHistory) ReadHistory() (uint64, error) {
+	historyId, _, err := f.ReadHistoryState()
+	return historyId, err
+}
+
+// Write the last historyId to the file
+func (f *FileHistory) WriteHistory(historyId uint64) error {
+	return f.WriteHistoryState(historyId, "")
+}
+
+// ReadHistoryState reads the last historyId from the first line of the file, and the state from the second one
+func (f *FileHistory) ReadHistoryState() (uint64, string, error) {
 	data, err := ioutil.ReadFile(f.filename)
 	if err != nil {
 		// If the file does not exist, return 0 and no error
 		if os.IsNotExist(err) {
-			return 0, nil
+			return 0, "", nil
 		}
-		return 0, err
+		return 0, "", err
 	}
-	historyId, err := strconv.ParseUint(string(data), 10, 64)
+	lines := strings.SplitN(string(data), "\n", 2)
+	historyId, err := strconv.ParseUint(lines[0], 10, 64)
 	if err != nil {
-		return 0, err
+		return 0, "", err
+	}
+	if len(lines) < 2 {
+		return historyId, "", nil
 	}
-	return historyId, nil
+	return historyId, lines[1], nil
 }
 
-// Write the last historyId to the file
-func (f *FileHistory) WriteHistory(historyId uint64) error {
-	return ioutil.WriteFile(f.filename, []byte(strconv.FormatUint(historyId, 10)), 0644)
+// WriteHistoryState writes the last historyId to the file, followed by the state on a line of its own
+func (f *FileHistory) WriteHistoryState(historyId uint64, state string) error {
+	data := strconv.FormatUint(historyId, 10)
+	if state != "" {
+		data += "\n" + state
+	}
+	return ioutil.WriteFile(f.filename, []byte(data), 0644)
+}
+
+// LastWriteTime returns when the historyId was last written, it is the zero time if it was never written
+func (f *FileHistory) LastWriteTime() (time.Time, error) {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// MemoryHistory keeps the historyId in memory, for one-off runs that should not leave a history file behind
+type MemoryHistory struct {
+	mu        sync.Mutex
+	historyId uint64
+	state     string
+}
+
+// NewMemoryHistory creates a MemoryHistory starting at the historyId
+func NewMemoryHistory(historyId uint64) *MemoryHistory {
+	return &MemoryHistory{historyId: historyId}
+}
+
+// Read the last historyId
+func (h *MemoryHistory) ReadHistory() (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.historyId, nil
+}
+
+// Write the last historyId
+func (h *MemoryHistory) WriteHistory(historyId uint64) error {
+	return h.WriteHistoryState(historyId, "")
+}
+
+// ReadHistoryState reads the last historyId and its state
+func (h *MemoryHistory) ReadHistoryState() (uint64, string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.historyId, h.state, nil
+}
+
+// WriteHistoryState writes the last historyId and its state
+func (h *MemoryHistory) WriteHistoryState(historyId uint64, state string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.historyId, h.state = historyId, state
+	return nil
+}
+
+// ReadOnlyHistory returns the history reading the history id of the history, and never writing it, for the dry
+// runs that should not move the history on
+func ReadOnlyHistory(history PollHistory) PollHistory {
+	return readOnlyHistory{history}
+}
+
+// readOnlyHistory drops the writes of the history id
+type readOnlyHistory struct {
+	history PollHistory
+}
+
+// Read the last historyId of the history
+func (h readOnlyHistory) ReadHistory() (uint64, error) {
+	return h.history.ReadHistory()
+}
+
+// Write does nothing
+func (h readOnlyHistory) WriteHistory(uint64) error {
+	return nil
+}
+
+// ReadHistoryState reads the last historyId of the history, and its state if the history saves one
+func (h readOnlyHistory) ReadHistoryState() (uint64, string, error) {
+	if sh, ok := h.history.(StateHistory); ok {
+		return sh.ReadHistoryState()
+	}
+	historyId, err := h.history.ReadHistory()
+	return historyId, "", err
+}
+
+// WriteHistoryState does nothing
+func (h readOnlyHistory) WriteHistoryState(uint64, string) error {
+	return nil
 }
@@ -0,0 +1,150 @@
+package polling
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/internal/logging"
+	"go.uber.org/zap"
+)
+
+// maxPushBodySize bounds the size of a push delivery, Gmail notifications are tiny
+const maxPushBodySize = 64 << 10
+
+// PushNotification is the Gmail notification carried by a Pub/Sub message
+type PushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// pushEnvelope is the body of a Pub/Sub push delivery
+type pushEnvelope struct {
+	Message *struct {
+		Data        string `json:"data"`
+		MessageID   string `json:"messageId"`
+		PublishTime string `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PushHandler receives Pub/Sub push deliveries of Gmail notifications over HTTP.
+// Valid notifications are sent to the Notifications channel, which keeps only the latest pending one,
+// as one poll catches up on all the changes since the last history id anyway.
+type PushHandler struct {
+	token         string
+	emailAddress  string
+	notifications chan PushNotification
+}
+
+// NewPushHandler creates a PushHandler. If token is set, deliveries must carry it in the "token" query parameter
+// of the push endpoint. If emailAddress is set, notifications for other mailboxes are refused.
+func NewPushHandler(token, emailAddress string) *PushHandler {
+	return &PushHandler{
+		token:         token,
+		emailAddress:  emailAddress,
+		notifications: make(chan PushNotification, 1),
+	}
+}
+
+// Notifications returns the channel of received notifications
+func (h *PushHandler) Notifications() <-chan PushNotification {
+	return h.notifications
+}
+
+func (h *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	notification, err := DecodePushNotification(io.LimitReader(r.Body, maxPushBodySize))
+	if err != nil {
+		logging.Logger.Warn("invalid push delivery", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.emailAddress != "" && !strings.EqualFold(notification.EmailAddress, h.emailAddress) {
+		logging.Logger.Warn("push delivery for another mailbox", zap.String("emailAddress", notification.EmailAddress))
+		http.Error(w, "unknown mailbox", http.StatusBadRequest)
+		return
+	}
+	logging.Logger.Debug("push notification", zap.String("emailAddress", notification.EmailAddress), zap.Uint64("historyId", notification.HistoryID))
+	h.notify(notification)
+	// any 2xx acknowledges the delivery to Pub/Sub
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notify queues the notification, replacing the one still pending if any
+func (h *PushHandler) notify(notification PushNotification) {
+	for {
+		select {
+		case h.notifications <- notification:
+			return
+		default:
+		}
+		select {
+		case <-h.notifications:
+		default:
+		}
+	}
+}
+
+// DecodePushNotification decodes the Gmail notification from the body of a Pub/Sub push delivery
+func DecodePushNotification(body io.Reader) (PushNotification, error) {
+	var envelope pushEnvelope
+	if err := json.NewDecoder(body).Decode(&envelope); err != nil {
+		return PushNotification{}, fmt.Errorf("invalid push envelope: %w", err)
+	}
+	if envelope.Message == nil || envelope.Message.Data == "" {
+		return PushNotification{}, fmt.Errorf("push envelope has no message data")
+	}
+	data, err := base64.StdEncoding.DecodeString(envelope.Message.Data)
+	if err != nil {
+		return PushNotification{}, fmt.Errorf("invalid push message data: %w", err)
+	}
+	var notification PushNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return PushNotification{}, fmt.Errorf("invalid Gmail notification: %w", err)
+	}
+	if notification.EmailAddress == "" || notification.HistoryID == 0 {
+		return PushNotification{}, fmt.Errorf("Gmail notification is missing the emailAddress or historyId")
+	}
+	return notification, nil
+}
+
+// Serve processes new messages whenever a notification arrives. If no notification arrives for the
+// fallback interval, it polls anyway, in case the notifications stopped. It runs until the context is done.
+func (ep *MessageProvider) Serve(ctx context.Context, pollHistory PollHistory, handlers []MessageHandlerFunc, notifications <-chan PushNotification, fallback time.Duration) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-notifications:
+			logging.Logger.Info("processing on push notification", zap.Uint64("historyId", n.HistoryID))
+		case <-timer.C:
+			logging.Logger.Info("no recent push notification, polling")
+		}
+		if err := ep.PollAndProcess(ctx, pollHistory, handlers); err != nil {
+			logging.Logger.Error("error processing messages", zap.Error(err))
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(fallback)
+	}
+}
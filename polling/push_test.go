@@ -0,0 +1,132 @@
+package polling
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// pushEnvelopeBody builds the body of a Pub/Sub push delivery carrying the data
+func pushEnvelopeBody(data string) string {
+	return `{"message":{"data":"` + base64.StdEncoding.EncodeToString([]byte(data)) + `","messageId":"2070443601311540","publishTime":"2023-04-01T12:00:00.000Z"},"subscription":"projects/myproject/subscriptions/mysubscription"}`
+}
+
+func postPush(h http.Handler, target, body string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestPushHandler(t *testing.T) {
+	h := NewPushHandler("secret", "jane@example.org")
+
+	code := postPush(h, "/push?token=secret", pushEnvelopeBody(`{"emailAddress":"jane@example.org","historyId":9876543210}`))
+	assert.Equal(t, http.StatusNoContent, code)
+	select {
+	case n := <-h.Notifications():
+		assert.Equal(t, PushNotification{EmailAddress: "jane@example.org", HistoryID: 9876543210}, n)
+	default:
+		t.Fatal("no notification received")
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		code   int
+	}{
+		{"missing token", "/push", pushEnvelopeBody(`{"emailAddress":"jane@example.org","historyId":1}`), http.StatusForbidden},
+		{"wrong token", "/push?token=guess", pushEnvelopeBody(`{"emailAddress":"jane@example.org","historyId":1}`), http.StatusForbidden},
+		{"not json", "/push?token=secret", "hello", http.StatusBadRequest},
+		{"no message", "/push?token=secret", `{"subscription":"projects/myproject/subscriptions/mysubscription"}`, http.StatusBadRequest},
+		{"not base64", "/push?token=secret", `{"message":{"data":"%%%"}}`, http.StatusBadRequest},
+		{"no history id", "/push?token=secret", pushEnvelopeBody(`{"emailAddress":"jane@example.org"}`), http.StatusBadRequest},
+		{"other mailbox", "/push?token=secret", pushEnvelopeBody(`{"emailAddress":"john@example.org","historyId":1}`), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, postPush(h, tt.target, tt.body))
+		})
+	}
+	assert.Len(t, h.Notifications(), 0)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/push?token=secret", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestPushHandlerKeepsLatestNotification(t *testing.T) {
+	h := NewPushHandler("", "")
+	for _, historyId := range []string{"1", "2", "3"} {
+		code := postPush(h, "/push", pushEnvelopeBody(`{"emailAddress":"jane@example.org","historyId":`+historyId+`}`))
+		assert.Equal(t, http.StatusNoContent, code)
+	}
+	assert.Len(t, h.Notifications(), 1)
+	assert.Equal(t, uint64(3), (<-h.Notifications()).HistoryID)
+}
+
+func TestServeProcessesOnPush(t *testing.T) {
+	service := &fakeService{}
+	history := NewMemoryHistory(0)
+	h := NewPushHandler("", "")
+
+	var mu sync.Mutex
+	var handled []string
+	processed := make(chan struct{}, 10)
+	handler := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.ID)
+		processed <- struct{}{}
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewMessageProvider(service).Serve(ctx, history, []MessageHandlerFunc{handler}, h.Notifications(), time.Hour)
+	}()
+
+	// the first poll runs right away
+	assert.Eventually(t, func() bool { return service.pollCount() == 1 }, time.Second, time.Millisecond)
+
+	service.receive("a", "b")
+	assert.Equal(t, http.StatusNoContent, postPush(h, "/push", pushEnvelopeBody(`{"emailAddress":"jane@example.org","historyId":2}`)))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatal("messages not processed after the push notification")
+		}
+	}
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"a", "b"}, handled)
+	mu.Unlock()
+	// the history is saved once the poll is done
+	assert.Eventually(t, func() bool {
+		historyId, _ := history.ReadHistory()
+		return historyId == 2
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestServeFallsBackToPolling(t *testing.T) {
+	service := &fakeService{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewMessageProvider(service).Serve(ctx, NewMemoryHistory(0), nil, make(chan PushNotification), 10*time.Millisecond)
+
+	// without notifications it keeps polling at the fallback interval
+	assert.Eventually(t, func() bool { return service.pollCount() >= 3 }, time.Second, time.Millisecond)
+}
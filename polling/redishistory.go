@@ -0,0 +1,147 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Errors of the RedisHistory writes
+var (
+	// ErrHistoryConflict is returned when the history id was changed by another instance since it was read
+	ErrHistoryConflict = errors.New("history id was changed by another instance")
+	// ErrNotLeader is returned when the history is written without holding its lease
+	ErrNotLeader = errors.New("lease is not held by this instance")
+)
+
+// writeHistoryScript sets the history id if it is still the one expected, and if the lease, when there is one,
+// is held by this instance
+var writeHistoryScript = redis.NewScript(`
+if #KEYS > 1 and redis.call('GET', KEYS[2]) ~= ARGV[4] then
+  return -1
+end
+local current = redis.call('HGET', KEYS[1], 'historyId')
+if not current then
+  current = '0'
+end
+if current ~= ARGV[1] then
+  return 0
+end
+redis.call('HSET', KEYS[1], 'historyId', ARGV[2], 'updated', ARGV[3], 'state', ARGV[5])
+return 1
+`)
+
+// RedisHistory keeps the historyId in Redis, so several instances can share it. Writes are compare-and-set:
+// a write only succeeds if the history id is still the one this instance last read or wrote.
+type RedisHistory struct {
+	client *redis.Client
+	key    string
+	lease  *Lease
+	now    func() time.Time
+
+	mu sync.Mutex
+	// expected is the history id last read or written
+	expected uint64
+}
+
+// RedisHistoryOption configures a RedisHistory
+type RedisHistoryOption func(*RedisHistory)
+
+// WithHistoryLease fences the writes with the lease: only the instance holding it can move the history id
+func WithHistoryLease(lease *Lease) RedisHistoryOption {
+	return func(h *RedisHistory) {
+		h.lease = lease
+	}
+}
+
+// NewRedisHistory creates a RedisHistory stored in the hash at the key
+func NewRedisHistory(client *redis.Client, key string, options ...RedisHistoryOption) *RedisHistory {
+	h := &RedisHistory{
+		client: client,
+		key:    key,
+		now:    time.Now,
+	}
+	for _, option := range options {
+		option(h)
+	}
+	return h
+}
+
+// Read the last historyId, 0 if there is none yet
+func (h *RedisHistory) ReadHistory() (uint64, error) {
+	historyId, _, err := h.ReadHistoryState()
+	return historyId, err
+}
+
+// Write the last historyId, it fails with ErrHistoryConflict if another instance changed it since it was
+// read, and with ErrNotLeader if the lease is not held by this instance
+func (h *RedisHistory) WriteHistory(historyId uint64) error {
+	return h.WriteHistoryState(historyId, "")
+}
+
+// ReadHistoryState reads the last historyId, 0 if there is none yet, and the state saved with it
+func (h *RedisHistory) ReadHistoryState() (uint64, string, error) {
+	values, err := h.client.HMGet(context.Background(), h.key, "historyId", "state").Result()
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to read history from redis: %w", err)
+	}
+	value, _ := values[0].(string)
+	if value == "" {
+		value = "0"
+	}
+	historyId, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid history id %q in redis: %w", value, err)
+	}
+	state, _ := values[1].(string)
+	h.mu.Lock()
+	h.expected = historyId
+	h.mu.Unlock()
+	return historyId, state, nil
+}
+
+// WriteHistoryState writes the last historyId and the state reached at it, with the same checks as WriteHistory
+func (h *RedisHistory) WriteHistoryState(historyId uint64, state string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := []string{h.key}
+	token := ""
+	if h.lease != nil {
+		keys = append(keys, h.lease.key)
+		token = h.lease.token
+	}
+	res, err := writeHistoryScript.Run(context.Background(), h.client, keys,
+		strconv.FormatUint(h.expected, 10), strconv.FormatUint(historyId, 10), h.now().UnixMilli(), token, state).Int()
+	if err != nil {
+		return fmt.Errorf("unable to write history to redis: %w", err)
+	}
+	switch res {
+	case -1:
+		return ErrNotLeader
+	case 0:
+		return ErrHistoryConflict
+	}
+	h.expected = historyId
+	return nil
+}
+
+// LastWriteTime returns when the historyId was last written, it is the zero time if it was never written
+func (h *RedisHistory) LastWriteTime() (time.Time, error) {
+	value, err := h.client.HGet(context.Background(), h.key, "updated").Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read history from redis: %w", err)
+	}
+	updated, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid history time %q in redis: %w", value, err)
+	}
+	return time.UnixMilli(updated), nil
+}
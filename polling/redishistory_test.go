@@ -0,0 +1,156 @@
+package polling
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRedis starts an in-memory Redis server, and returns it with a client to it
+func newRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestRedisHistory(t *testing.T) {
+	_, client := newRedis(t)
+	h := NewRedisHistory(client, "gmail-ai:history")
+	h.now = func() time.Time { return time.UnixMilli(1680000000000) }
+
+	assert.Equal(t, uint64(0), readHistory(t, h))
+	updated, err := h.LastWriteTime()
+	assert.NoError(t, err)
+	assert.True(t, updated.IsZero())
+
+	assert.NoError(t, h.WriteHistory(5))
+	assert.NoError(t, h.WriteHistory(7))
+	assert.Equal(t, uint64(7), readHistory(t, NewRedisHistory(client, "gmail-ai:history")))
+	updated, err = h.LastWriteTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.UnixMilli(1680000000000), updated)
+
+	// the state is written with the history id
+	assert.NoError(t, h.WriteHistoryState(9, "42"))
+	historyId, state, err := NewRedisHistory(client, "gmail-ai:history").ReadHistoryState()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9), historyId)
+	assert.Equal(t, "42", state)
+	assert.NoError(t, h.WriteHistory(10))
+	_, state, err = h.ReadHistoryState()
+	assert.NoError(t, err)
+	assert.Equal(t, "", state)
+}
+
+func TestRedisHistoryCompareAndSet(t *testing.T) {
+	_, client := newRedis(t)
+	a := NewRedisHistory(client, "gmail-ai:history")
+	b := NewRedisHistory(client, "gmail-ai:history")
+	assert.Equal(t, uint64(0), readHistory(t, a))
+	assert.Equal(t, uint64(0), readHistory(t, b))
+
+	assert.NoError(t, a.WriteHistory(5))
+	// b did not see the write of a
+	assert.ErrorIs(t, b.WriteHistory(6), ErrHistoryConflict)
+	assert.Equal(t, uint64(5), readHistory(t, b))
+	assert.NoError(t, b.WriteHistory(6))
+	assert.ErrorIs(t, a.WriteHistory(8), ErrHistoryConflict)
+}
+
+func TestLease(t *testing.T) {
+	server, client := newRedis(t)
+	clock := &fakeClock{now: time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)}
+	a := NewLease(client, "gmail-ai:leader", 30*time.Second)
+	b := NewLease(client, "gmail-ai:leader", 30*time.Second)
+	a.now, b.now = clock.Now, clock.Now
+	assert.NotEqual(t, a.Token(), b.Token())
+	ctx := context.Background()
+
+	held, err := a.Acquire(ctx)
+	assert.NoError(t, err)
+	assert.True(t, held)
+	assert.True(t, a.Held())
+	held, err = b.Acquire(ctx)
+	assert.NoError(t, err)
+	assert.False(t, held)
+	assert.False(t, b.Held())
+
+	// a renews the lease before it expires
+	server.FastForward(20 * time.Second)
+	clock.now = clock.now.Add(20 * time.Second)
+	held, _ = a.Acquire(ctx)
+	assert.True(t, held)
+	server.FastForward(20 * time.Second)
+	clock.now = clock.now.Add(20 * time.Second)
+	held, _ = b.Acquire(ctx)
+	assert.False(t, held)
+
+	// a stops renewing, b takes over when the lease expires
+	server.FastForward(11 * time.Second)
+	clock.now = clock.now.Add(11 * time.Second)
+	assert.False(t, a.Held())
+	held, _ = b.Acquire(ctx)
+	assert.True(t, held)
+	held, _ = a.Acquire(ctx)
+	assert.False(t, held)
+
+	// releasing lets a take over right away, releasing a lease not held does nothing
+	assert.NoError(t, a.Release(ctx))
+	assert.NoError(t, b.Release(ctx))
+	held, _ = a.Acquire(ctx)
+	assert.True(t, held)
+}
+
+func TestLeaseKeep(t *testing.T) {
+	server, client := newRedis(t)
+	l := NewLease(client, "gmail-ai:leader", 30*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Keep(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, l.Held, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.False(t, l.Held())
+	assert.False(t, server.Exists("gmail-ai:leader"))
+}
+
+func TestRedisHistoryFencedByLease(t *testing.T) {
+	server, client := newRedis(t)
+	service := &fakeService{}
+	service.receive("a", "b")
+	ctx := context.Background()
+
+	leader := NewLease(client, "gmail-ai:leader", time.Minute)
+	standby := NewLease(client, "gmail-ai:leader", time.Minute)
+	leaderHistory := NewRedisHistory(client, "gmail-ai:history", WithHistoryLease(leader))
+	standbyHistory := NewRedisHistory(client, "gmail-ai:history", WithHistoryLease(standby))
+	held, err := leader.Acquire(ctx)
+	assert.NoError(t, err)
+	assert.True(t, held)
+
+	h := &recordingHandler{}
+	assert.NoError(t, NewMessageProvider(service).PollAndProcess(ctx, leaderHistory, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, uint64(2), readHistory(t, standbyHistory))
+	// the standby can not move the history
+	assert.ErrorIs(t, standbyHistory.WriteHistory(3), ErrNotLeader)
+
+	// the leader stops, the standby takes over from where it left
+	server.FastForward(time.Minute)
+	held, err = standby.Acquire(ctx)
+	assert.NoError(t, err)
+	assert.True(t, held)
+	service.receive("c")
+	assert.NoError(t, NewMessageProvider(service).PollAndProcess(ctx, standbyHistory, []MessageHandlerFunc{h.handle}))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, h.messages())
+	assert.Equal(t, uint64(3), readHistory(t, standbyHistory))
+	// the old leader can not move the history anymore
+	assert.ErrorIs(t, leaderHistory.WriteHistory(4), ErrNotLeader)
+}
@@ -0,0 +1,76 @@
+package polling
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+)
+
+// ReportEntry is an action a handler planned on a message, as written to the report of a dry run
+type ReportEntry struct {
+	Time      time.Time `json:"time"`
+	Account   string    `json:"account,omitempty"`
+	MessageID string    `json:"messageId"`
+	Subject   string    `json:"subject"`
+	datamodel.Action
+}
+
+// ActionReport writes the actions planned by the handlers as JSON lines, one per action, instead of applying
+// them. It is safe to use from several accounts.
+type ActionReport struct {
+	account string
+	out     *reportWriter
+}
+
+// reportWriter is the writer shared by the reports of the accounts
+type reportWriter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	w       io.Writer
+	entries int
+}
+
+// NewActionReport creates a report writing to w
+func NewActionReport(w io.Writer) *ActionReport {
+	return &ActionReport{out: &reportWriter{w: w, now: time.Now}}
+}
+
+// ForAccount returns the report of the account, writing to the same writer
+func (r *ActionReport) ForAccount(name string) *ActionReport {
+	return &ActionReport{account: name, out: r.out}
+}
+
+// Write writes the actions planned on the message
+func (r *ActionReport) Write(msg datamodel.Message, actions []datamodel.Action) error {
+	r.out.mu.Lock()
+	defer r.out.mu.Unlock()
+	for _, action := range actions {
+		line, err := json.Marshal(ReportEntry{
+			Time:      r.out.now(),
+			Account:   r.account,
+			MessageID: msg.ID,
+			Subject:   msg.Subject,
+			Action:    action,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := r.out.w.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("unable to write action report: %w", err)
+		}
+		r.out.entries++
+	}
+	return nil
+}
+
+// Entries returns how many actions were written, by all the accounts
+func (r *ActionReport) Entries() int {
+	r.out.mu.Lock()
+	defer r.out.mu.Unlock()
+	return r.out.entries
+}
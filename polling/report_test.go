@@ -0,0 +1,90 @@
+package polling
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+)
+
+// readReport parses the JSON lines of the report
+func readReport(t *testing.T, data []byte) []ReportEntry {
+	var entries []ReportEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry ReportEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestActionReport(t *testing.T) {
+	var buf bytes.Buffer
+	report := NewActionReport(&buf)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	report.out.now = func() time.Time { return now }
+
+	classification := &datamodel.Classification{Classifier: "rejection", Positive: true, Text: "we went with another candidate"}
+	label := datamodel.AddLabel("Rejection")
+	label.Handler, label.Classification = "rejection", classification
+	msg := datamodel.Message{ID: "1", Subject: "Your application"}
+	assert.NoError(t, report.ForAccount("work").Write(msg, []datamodel.Action{label, datamodel.Star()}))
+	assert.NoError(t, report.Write(datamodel.Message{ID: "2"}, nil))
+	assert.Equal(t, 2, report.Entries())
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+	assert.JSONEq(t, `{
+		"time": "2023-05-01T12:00:00Z",
+		"account": "work",
+		"messageId": "1",
+		"subject": "Your application",
+		"type": "addLabel",
+		"label": "Rejection",
+		"handler": "rejection",
+		"classification": {"classifier": "rejection", "positive": true, "text": "we went with another candidate"}
+	}`, string(lines[0]))
+	assert.JSONEq(t, `{"time": "2023-05-01T12:00:00Z", "account": "work", "messageId": "1", "subject": "Your application", "type": "star"}`, string(lines[1]))
+}
+
+func TestPollAndProcessDryRun(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	executor := &recordingExecutor{}
+	var buf bytes.Buffer
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithActionExecutor(executor), WithDryRun(NewActionReport(&buf)))
+
+	labeling := func(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+		if msg.ID == "b" {
+			return nil, nil
+		}
+		return []datamodel.Action{datamodel.AddLabel("Jobs"), datamodel.Archive()}, nil
+	}
+	handlers := []MessageHandlerFunc{labeling, planning(datamodel.AddLabel("Jobs"))}
+	assert.NoError(t, provider.PollAndProcess(context.Background(), ReadOnlyHistory(history), handlers))
+
+	// nothing is applied, every action planned is reported, before they are merged
+	assert.Empty(t, executor.applied())
+	entries := readReport(t, buf.Bytes())
+	assert.Len(t, entries, 4)
+	var reported []string
+	for _, e := range entries {
+		reported = append(reported, e.MessageID+" "+e.Subject+" "+string(e.Type)+" "+e.Label)
+	}
+	assert.ElementsMatch(t, []string{"a subject a addLabel Jobs", "a subject a archive ", "a subject a addLabel Jobs", "b subject b addLabel Jobs"}, reported)
+	// the history did not move
+	assert.Equal(t, uint64(0), readHistory(t, history))
+
+	// the messages are not reported twice by the same provider
+	service.receive("c")
+	assert.NoError(t, provider.PollAndProcess(context.Background(), ReadOnlyHistory(history), handlers))
+	assert.Len(t, readReport(t, buf.Bytes()), 7)
+	assert.Equal(t, uint64(0), readHistory(t, history))
+}
@@ -0,0 +1,115 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jyouturer/gmail-ai/datamodel"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("boom"), false},
+		{"grpc unavailable", status.Error(codes.Unavailable, "classifier restarting"), true},
+		{"wrapped grpc unavailable", fmt.Errorf("error calling IsRejection gRPC: %w", status.Error(codes.Unavailable, "down")), true},
+		{"grpc resource exhausted", status.Error(codes.ResourceExhausted, "slow down"), true},
+		{"grpc invalid argument", status.Error(codes.InvalidArgument, "bad request"), false},
+		{"http 429", &googleapi.Error{Code: 429}, true},
+		{"wrapped http 503", fmt.Errorf("error setting label: %w", &googleapi.Error{Code: 503}), true},
+		{"http 404", &googleapi.Error{Code: 404}, false},
+		{"marked retryable", Retryable(errors.New("busy")), true},
+		{"marked permanent", Permanent(status.Error(codes.Unavailable, "down")), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.retryable, IsRetryable(tc.err))
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, p.Backoff(1))
+	assert.Equal(t, 2*time.Second, p.Backoff(2))
+	assert.Equal(t, 4*time.Second, p.Backoff(3))
+	assert.Equal(t, 5*time.Second, p.Backoff(4))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := p.Backoff(2)
+		assert.GreaterOrEqual(t, backoff, time.Second)
+		assert.LessOrEqual(t, backoff, 3*time.Second)
+	}
+}
+
+// flakyHandler fails with the error the given number of times per message, then succeeds
+type flakyHandler struct {
+	mu       sync.Mutex
+	err      error
+	failures map[string]int
+	calls    map[string]int
+}
+
+func (h *flakyHandler) handle(ctx context.Context, msg datamodel.Message) ([]datamodel.Action, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls[msg.ID]++
+	if h.failures[msg.ID] > 0 {
+		h.failures[msg.ID]--
+		return nil, h.err
+	}
+	return nil, nil
+}
+
+func (h *flakyHandler) callsOf(id string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[id]
+}
+
+func TestPollAndProcessRetriesTransientErrors(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a", "b")
+	h := &flakyHandler{
+		err:      fmt.Errorf("error calling IsRejection gRPC: %w", status.Error(codes.Unavailable, "classifier restarting")),
+		failures: map[string]int{"a": 2},
+		calls:    map[string]int{},
+	}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, 3, h.callsOf("a"))
+	assert.Equal(t, 1, h.callsOf("b"))
+	assert.Equal(t, uint64(2), readHistory(t, history))
+	assert.Equal(t, 0, provider.Attempts("a"))
+}
+
+func TestPollAndProcessDoesNotRetryPermanentErrors(t *testing.T) {
+	service := &fakeService{}
+	service.receive("a")
+	h := &flakyHandler{
+		err:      status.Error(codes.InvalidArgument, "bad request"),
+		failures: map[string]int{"a": 1},
+		calls:    map[string]int{},
+	}
+	history := NewMemoryHistory(0)
+	provider := NewMessageProvider(service, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+
+	assert.NoError(t, provider.PollAndProcess(context.Background(), history, []MessageHandlerFunc{h.handle}))
+	assert.Equal(t, 1, h.callsOf("a"))
+	assert.Equal(t, uint64(0), readHistory(t, history))
+	assert.Equal(t, 1, provider.Attempts("a"))
+}
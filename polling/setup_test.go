@@ -1,6 +1,7 @@
 package polling
 
 import (
+	"os"
 	"testing"
 
 	"github.com/jyouturer/gmail-ai/internal/logging"
@@ -12,4 +13,5 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 	logging.Logger = logger // Set the global logger instance
+	os.Exit(m.Run())
 }
@@ -0,0 +1,167 @@
+package polling
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SideEffectRetention is how long the side effects done are remembered. It is far longer than a message stays
+// in the retries or the dead-letter queue, so a replayed plan does not forward the message again.
+const SideEffectRetention = 365 * 24 * time.Hour
+
+// SideEffectStore remembers the actions with side effects done for the messages, like a forward, so a retried
+// plan does not do them again. Unlike the dedupe store it is not bounded in size: a record is only dropped once
+// it is older than SideEffectRetention, when the store is opened. When opened on a file, every record is
+// appended to it and synced to disk before Add returns.
+type SideEffectStore struct {
+	filename string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	records map[string]time.Time
+	file    *os.File
+}
+
+// NewSideEffectStore creates a side effect store kept in memory only
+func NewSideEffectStore() *SideEffectStore {
+	return &SideEffectStore{now: time.Now, records: map[string]time.Time{}}
+}
+
+// OpenSideEffectStore opens the side effect store persisted in the file, it is created if it does not exist
+func OpenSideEffectStore(filename string) (*SideEffectStore, error) {
+	s := NewSideEffectStore()
+	s.filename = filename
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// rewriting drops the records past the retention
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Contains reports whether the side effect of the account was done
+func (s *SideEffectStore) Contains(account, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.records[dedupeKey(account, key)]
+	return ok
+}
+
+// Add records the side effect of the account as done
+func (s *SideEffectStore) Add(account, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, done := dedupeKey(account, key), s.now()
+	if s.file != nil {
+		if _, err := s.file.WriteString(formatSideEffect(k, done)); err != nil {
+			return fmt.Errorf("unable to save side effect: %w", err)
+		}
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("unable to save side effect: %w", err)
+		}
+	}
+	s.records[k] = done
+	return nil
+}
+
+// Len returns the number of side effects in the store
+func (s *SideEffectStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// Close closes the file of the store
+func (s *SideEffectStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// formatSideEffect formats the record as a line of the file: the unix time and the key
+func formatSideEffect(key string, done time.Time) string {
+	return strconv.FormatInt(done.Unix(), 10) + "\t" + key + "\n"
+}
+
+// load reads the records of the file
+func (s *SideEffectStore) load() error {
+	f, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open side effect store: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		done, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		s.records[fields[1]] = time.Unix(done, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read side effect store: %w", err)
+	}
+	return nil
+}
+
+// compact drops the records past the retention, rewrites the file with the others and opens it for appending
+func (s *SideEffectStore) compact() error {
+	now := s.now()
+	for key, done := range s.records {
+		if now.Sub(done) >= SideEffectRetention {
+			delete(s.records, key)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.filename), filepath.Base(s.filename)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to compact side effect store: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for key, done := range s.records {
+		w.WriteString(formatSideEffect(key, done))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact side effect store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact side effect store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact side effect store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.filename); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to compact side effect store: %w", err)
+	}
+	f, err := os.OpenFile(s.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open side effect store: %w", err)
+	}
+	s.file = f
+	return nil
+}
@@ -0,0 +1,46 @@
+package polling
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSideEffectStorePersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sideeffects.txt")
+	// a forward done long ago, past the retention, and one done recently
+	old := time.Now().Add(-SideEffectRetention - time.Hour).Unix()
+	recent := time.Now().Add(-30 * 24 * time.Hour).Unix()
+	data := strconv.FormatInt(old, 10) + "\tme\told\tforward\tme@example.org\n" +
+		strconv.FormatInt(recent, 10) + "\tme\trecent\tforward\tme@example.org\n"
+	assert.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+
+	s, err := OpenSideEffectStore(filename)
+	assert.NoError(t, err)
+	assert.False(t, s.Contains("me", "old\tforward\tme@example.org"))
+	assert.True(t, s.Contains("me", "recent\tforward\tme@example.org"))
+	// the store is not bounded in size, no record is evicted by the others
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Add("me", fmt.Sprintf("m%d\tforward\tme@example.org", i)))
+	}
+	assert.NoError(t, s.Close())
+
+	s, err = OpenSideEffectStore(filename)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, 100+1, s.Len())
+	assert.True(t, s.Contains("me", "recent\tforward\tme@example.org"))
+	assert.True(t, s.Contains("me", "m0\tforward\tme@example.org"))
+	// side effects are keyed by account
+	assert.False(t, s.Contains("jane@example.org", "m0\tforward\tme@example.org"))
+	// reopening drops the records past the retention from the file
+	contents, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 100+1, strings.Count(string(contents), "\n"))
+}